@@ -0,0 +1,113 @@
+package checkpoint
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* 结束位置存储，保存每个同步的订阅位置，程序重启后从此位置继续 */
+
+// Checkpoint 一个结束位置
+type Checkpoint struct {
+	Key         string              `bson:"_id" json:"-"`
+	Token       bson.Raw            `bson:"token" json:"-"`                   // 订阅位置，resume token或程序定义的开始位置文档
+	ClusterTime primitive.Timestamp `bson:"cluster_time" json:"cluster_time"` // 订阅位置对应的集群时间，无法解析时为0
+	Time        time.Time           `bson:"time" json:"time"`                 // 集群时间对应的时间，便于查看
+	UpdatedAt   time.Time           `bson:"updated_at" json:"updated_at"`     // 保存时间
+}
+
+// New 由订阅位置创建结束位置，解析其中的集群时间
+func New(key string, token []byte) *Checkpoint {
+	cp := &Checkpoint{
+		Key:       key,
+		Token:     bson.Raw(token),
+		UpdatedAt: time.Now(),
+	}
+	if ts, ok := ClusterTime(token); ok {
+		cp.ClusterTime = ts
+		cp.Time = time.Unix(int64(ts.T), 0)
+	}
+	return cp
+}
+
+// Store 结束位置存储
+type Store interface {
+	// 读取全部结束位置，下标为结束位置key
+	Load() (map[string]*Checkpoint, error)
+	// 保存结束位置，已删除的结束位置需调用Delete删除
+	Save(checkpoints map[string]*Checkpoint) error
+	// 删除指定的结束位置
+	Delete(keys []string) error
+	// 读取全部全量同步进度，下标为sync配置key，值为进度json
+	LoadSnapshotProgress() (map[string][]byte, error)
+	// 保存全量同步进度，值为nil时删除，不在其中的进度不变
+	SaveSnapshotProgress(progress map[string][]byte) error
+	// 关闭存储
+	Close() error
+}
+
+// NewStore 按配置创建存储，mongo存储未配置连接地址时使用来源mongo
+func NewStore(cfg *config.Config) (Store, error) {
+	switch cfg.Checkpoint.GetStore() {
+	case config.CheckpointStoreFile:
+		return NewFileStore(cfg.Checkpoint.GetPath(), cfg.Checkpoint.GetGenerations()), nil
+	case config.CheckpointStoreMongo:
+		uri := cfg.Mongo.SourceUri
+		if cfg.Checkpoint.Uri != "" {
+			uri = cfg.Checkpoint.Uri
+		}
+		return NewMongoStore(uri, cfg.Checkpoint.GetDatabase(), cfg.Checkpoint.GetCollection())
+	default:
+		return nil, fmt.Errorf("不支持的结束位置存储: %s", cfg.Checkpoint.GetStore())
+	}
+}
+
+// ClusterTime 解析订阅位置中的集群时间
+// 支持 {startAtOperationTime: ts}、{startAfter: token} 以及change stream的resume token
+func ClusterTime(token []byte) (primitive.Timestamp, bool) {
+	raw := bson.Raw(token)
+	if err := raw.Validate(); err != nil {
+		return primitive.Timestamp{}, false
+	}
+	if val, err := raw.LookupErr("startAtOperationTime"); err == nil {
+		t, i, ok := val.TimestampOK()
+		return primitive.Timestamp{T: t, I: i}, ok
+	}
+	if val, err := raw.LookupErr("startAfter"); err == nil {
+		doc, ok := val.DocumentOK()
+		if !ok {
+			return primitive.Timestamp{}, false
+		}
+		return ClusterTime(doc)
+	}
+	val, err := raw.LookupErr("_data")
+	if err != nil {
+		return primitive.Timestamp{}, false
+	}
+	// resume token的_data为KeyString编码，4.0及以上为hex字符串，3.6为二进制
+	var data []byte
+	switch val.Type {
+	case bsontype.String:
+		data, err = hex.DecodeString(val.StringValue())
+		if err != nil {
+			return primitive.Timestamp{}, false
+		}
+	case bsontype.Binary:
+		_, data = val.Binary()
+	default:
+		return primitive.Timestamp{}, false
+	}
+	// 第一个值为集群时间，类型标识130，随后8字节大端存储
+	if len(data) < 9 || data[0] != 130 {
+		return primitive.Timestamp{}, false
+	}
+	t := uint32(data[1])<<24 | uint32(data[2])<<16 | uint32(data[3])<<8 | uint32(data[4])
+	i := uint32(data[5])<<24 | uint32(data[6])<<16 | uint32(data[7])<<8 | uint32(data[8])
+	return primitive.Timestamp{T: t, I: i}, true
+}
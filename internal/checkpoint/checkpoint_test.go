@@ -0,0 +1,43 @@
+package checkpoint
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestClusterTime(t *testing.T) {
+	ts := primitive.Timestamp{T: 1700000000, I: 3}
+	marshal := func(doc interface{}) []byte {
+		body, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	// 集群时间1700000000(0x6553F100)，序号3
+	data := "826553F100000000032B022C0100296E5A1004"
+	tests := []struct {
+		name  string
+		token []byte
+		want  primitive.Timestamp
+		ok    bool
+	}{
+		{"operation time", marshal(bson.M{"startAtOperationTime": ts}), ts, true},
+		{"resume token", marshal(bson.M{"_data": data}), ts, true},
+		{"start after", marshal(bson.M{"startAfter": bson.M{"_data": data}}), ts, true},
+		// 3.6的resume token为二进制
+		{"binary resume token", marshal(bson.M{"_data": primitive.Binary{Data: []byte{130, 0x65, 0x53, 0xF1, 0, 0, 0, 0, 3, 0x2B}}}), ts, true},
+		{"short resume token", marshal(bson.M{"_data": "8265"}), primitive.Timestamp{}, false},
+		{"not hex", marshal(bson.M{"_data": "zz"}), primitive.Timestamp{}, false},
+		{"no cluster time", marshal(bson.M{"_id": 1}), primitive.Timestamp{}, false},
+		{"invalid bson", []byte("{}"), primitive.Timestamp{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ClusterTime(tt.token)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %v %v, want %v %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package checkpoint
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/* 本地文件存储，先写临时文件再重命名，写入中途崩溃不会损坏已有文件
+ * 全量同步进度保存在同一目录，last_event_ids.json 对应 last_event_ids.snapshot.json */
+
+// LegacySnapshotProgressPath 旧版本在当前目录保存的全量同步进度文件，新文件不存在时读取
+const LegacySnapshotProgressPath = "snapshot_progress.json"
+
+// FileStore 本地文件存储
+type FileStore struct {
+	path        string
+	generations int // 保留的历史版本数，path.1为上一个版本
+}
+
+// 文件中的一个结束位置，订阅位置为mongo扩展json便于查看
+type fileCheckpoint struct {
+	Checkpoint
+	Token json.RawMessage `json:"token"`
+}
+
+// NewFileStore 创建本地文件存储
+func NewFileStore(path string, generations int) *FileStore {
+	return &FileStore{
+		path:        path,
+		generations: generations,
+	}
+}
+
+// Load 读取结束位置，当前文件损坏时依次读取历史版本
+func (fs *FileStore) Load() (map[string]*Checkpoint, error) {
+	var firstErr error
+	for i := 0; i <= fs.generations; i++ {
+		path := fs.generationPath(i)
+		checkpoints, err := fs.load(path)
+		if err == nil {
+			if i > 0 {
+				logger.GlobalLogger.Warnw("结束位置文件损坏，使用历史版本", "err", firstErr, "path", path)
+			}
+			return checkpoints, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if !os.IsNotExist(err) {
+			logger.GlobalLogger.Warnw("读取结束位置文件错误", "err", err, "path", path)
+		}
+	}
+	return nil, firstErr
+}
+
+// 读取一个文件，兼容旧版本的 key:base64订阅位置 格式
+func (fs *FileStore) load(path string) (map[string]*Checkpoint, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	items := make(map[string]json.RawMessage)
+	err = json.Unmarshal(body, &items)
+	if err != nil {
+		return nil, fmt.Errorf("解析结束位置文件错误: %v", err)
+	}
+	checkpoints := make(map[string]*Checkpoint, len(items))
+	for key, item := range items {
+		if len(item) > 0 && item[0] == '"' {
+			var str string
+			json.Unmarshal(item, &str)
+			token, err := base64.StdEncoding.DecodeString(str)
+			if err != nil {
+				return nil, fmt.Errorf("解析结束位置 %s 错误: %v", key, err)
+			}
+			checkpoints[key] = New(key, token)
+			continue
+		}
+		fc := new(fileCheckpoint)
+		err = json.Unmarshal(item, fc)
+		if err != nil {
+			return nil, fmt.Errorf("解析结束位置 %s 错误: %v", key, err)
+		}
+		var token bson.Raw
+		err = bson.UnmarshalExtJSON(fc.Token, true, &token)
+		if err != nil {
+			return nil, fmt.Errorf("解析结束位置 %s 订阅位置错误: %v", key, err)
+		}
+		cp := fc.Checkpoint
+		cp.Key = key
+		cp.Token = token
+		checkpoints[key] = &cp
+	}
+	return checkpoints, nil
+}
+
+// Save 写入临时文件并同步到磁盘，轮转历史版本后重命名为正式文件
+func (fs *FileStore) Save(checkpoints map[string]*Checkpoint) error {
+	items := make(map[string]*fileCheckpoint, len(checkpoints))
+	for key, cp := range checkpoints {
+		token, err := bson.MarshalExtJSON(cp.Token, true, false)
+		if err != nil {
+			return fmt.Errorf("结束位置 %s 订阅位置错误: %v", key, err)
+		}
+		items[key] = &fileCheckpoint{Checkpoint: *cp, Token: token}
+	}
+	body, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath, err := writeTempFile(fs.path, body)
+	if err != nil {
+		return err
+	}
+	// 轮转历史版本 path.n-1 -> path.n ... path -> path.1
+	for i := fs.generations; i > 0; i-- {
+		err = os.Rename(fs.generationPath(i-1), fs.generationPath(i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err = os.Rename(tmpPath, fs.path)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(fs.path))
+	return nil
+}
+
+// Delete 删除指定的结束位置后重新写入
+func (fs *FileStore) Delete(keys []string) error {
+	checkpoints, err := fs.Load()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, key := range keys {
+		delete(checkpoints, key)
+	}
+	return fs.Save(checkpoints)
+}
+
+// LoadSnapshotProgress 读取全量同步进度文件，没有进度时返回空map
+func (fs *FileStore) LoadSnapshotProgress() (map[string][]byte, error) {
+	progress, err := loadSnapshotProgress(fs.snapshotPath())
+	if os.IsNotExist(err) {
+		progress, err = loadSnapshotProgress(LegacySnapshotProgressPath)
+		if err == nil {
+			logger.GlobalLogger.Infow("读取旧版本全量同步进度文件", "path", LegacySnapshotProgressPath, "new_path", fs.snapshotPath())
+		}
+	}
+	if os.IsNotExist(err) {
+		return make(map[string][]byte), nil
+	}
+	return progress, err
+}
+
+// SaveSnapshotProgress 合并到已有进度后重新写入
+func (fs *FileStore) SaveSnapshotProgress(progress map[string][]byte) error {
+	items, err := fs.LoadSnapshotProgress()
+	if err != nil {
+		logger.GlobalLogger.Warnw("读取全量同步进度文件错误，重新写入", "err", err, "path", fs.snapshotPath())
+		items = make(map[string][]byte)
+	}
+	for key, val := range progress {
+		if val == nil {
+			delete(items, key)
+		} else {
+			items[key] = val
+		}
+	}
+	raw := make(map[string]json.RawMessage, len(items))
+	for key, val := range items {
+		raw[key] = val
+	}
+	body, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return WriteFile(fs.snapshotPath(), body)
+}
+
+// 读取一个全量同步进度文件
+func loadSnapshotProgress(path string) (map[string][]byte, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	items := make(map[string]json.RawMessage)
+	err = json.Unmarshal(body, &items)
+	if err != nil {
+		return nil, fmt.Errorf("解析全量同步进度文件 %s 错误: %v", path, err)
+	}
+	progress := make(map[string][]byte, len(items))
+	for key, val := range items {
+		progress[key] = val
+	}
+	return progress, nil
+}
+
+// 全量同步进度文件路径
+func (fs *FileStore) snapshotPath() string {
+	return strings.TrimSuffix(fs.path, filepath.Ext(fs.path)) + ".snapshot.json"
+}
+
+// Close 关闭存储
+func (fs *FileStore) Close() error {
+	return nil
+}
+
+// 历史版本文件路径，0为当前文件
+func (fs *FileStore) generationPath(i int) string {
+	if i == 0 {
+		return fs.path
+	}
+	return fmt.Sprintf("%s.%d", fs.path, i)
+}
+
+// WriteFile 写入临时文件并同步到磁盘后重命名为正式文件，写入中途崩溃不会损坏已有文件
+func WriteFile(path string, body []byte) error {
+	tmpPath, err := writeTempFile(path, body)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// 写入 path.tmp 并同步到磁盘，返回临时文件路径
+func writeTempFile(path string, body []byte) (string, error) {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// 同步目录，保证重命名写入磁盘
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		logger.GlobalLogger.Debugw("同步结束位置目录错误", "err", err, "dir", dir)
+	}
+}
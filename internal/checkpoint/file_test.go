@@ -0,0 +1,172 @@
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// 测试不写日志文件
+	logger.GlobalLogger = &logger.Logger{SugaredLogger: zap.NewNop().Sugar()}
+	os.Exit(m.Run())
+}
+
+func TestFileStoreSnapshotProgress(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFileStore(filepath.Join(dir, "last_event_ids.json"), 3)
+	if got := fs.snapshotPath(); got != filepath.Join(dir, "last_event_ids.snapshot.json") {
+		t.Errorf("snapshot path = %s", got)
+	}
+
+	progress, err := fs.LoadSnapshotProgress()
+	if err != nil || len(progress) != 0 {
+		t.Fatalf("empty store: %v %v", progress, err)
+	}
+	err = fs.SaveSnapshotProgress(map[string][]byte{"a": []byte(`{"collections":{}}`), "b": []byte(`{"resume_tokens":{}}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 只更新和删除指定的key
+	err = fs.SaveSnapshotProgress(map[string][]byte{"a": nil, "c": []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, err = fs.LoadSnapshotProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 2 || string(progress["b"]) != `{"resume_tokens":{}}` || string(progress["c"]) != `{}` {
+		t.Errorf("progress = %q", progress)
+	}
+}
+
+func TestFileStoreLegacySnapshotProgress(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// 新文件不存在时读取当前目录的旧版本进度文件
+	if err := ioutil.WriteFile(LegacySnapshotProgressPath, []byte(`{"a":{"collections":{}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFileStore(filepath.Join("data", "checkpoints.json"), 3)
+	if err := os.Mkdir("data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	progress, err := fs.LoadSnapshotProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(progress["a"]) != `{"collections":{}}` {
+		t.Fatalf("legacy progress = %q", progress)
+	}
+
+	// 保存后读取新文件
+	if err := fs.SaveSnapshotProgress(map[string][]byte{"a": nil}); err != nil {
+		t.Fatal(err)
+	}
+	progress, err = fs.LoadSnapshotProgress()
+	if err != nil || len(progress) != 0 {
+		t.Errorf("progress after save = %q %v", progress, err)
+	}
+	if _, err := os.Stat(filepath.Join("data", "checkpoints.snapshot.json")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileStoreGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	fs := NewFileStore(path, 2)
+	token := func(i uint32) []byte {
+		body, err := bson.Marshal(bson.M{"startAtOperationTime": primitive.Timestamp{T: 1700000000, I: i}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	for i := uint32(1); i <= 4; i++ {
+		if err := fs.Save(map[string]*Checkpoint{"goods": New("goods", token(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path string
+		want uint32
+	}{
+		{path, 4},
+		{path + ".1", 3},
+		{path + ".2", 2},
+	}
+	for _, tt := range tests {
+		checkpoints, err := fs.load(tt.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if got := checkpoints["goods"].ClusterTime.I; got != tt.want {
+			t.Errorf("%s: generation %d, want %d", tt.path, got, tt.want)
+		}
+	}
+	// 只保留配置的历史版本数，重命名后不留临时文件
+	for _, name := range []string{path + ".3", path + ".tmp"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s exists: %v", name, err)
+		}
+	}
+
+	// 当前文件损坏时读取上一个版本
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkpoints, err := fs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := checkpoints["goods"].ClusterTime.I; got != 3 {
+		t.Errorf("fallback generation %d, want 3", got)
+	}
+}
+
+func TestFileStoreLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+		want    primitive.Timestamp
+	}{
+		{"current", `{"goods":{"key":"goods","token":{"startAtOperationTime":{"$timestamp":{"t":1700000000,"i":1}}}}}`, false, primitive.Timestamp{T: 1700000000, I: 1}},
+		// 旧版本为 key:base64订阅位置
+		{"legacy", `{"goods":"IwAAABFzdGFydEF0T3BlcmF0aW9uVGltZQABAAAAAPFTZQA="}`, false, primitive.Timestamp{T: 1700000000, I: 1}},
+		{"legacy invalid base64", `{"goods":"!"}`, true, primitive.Timestamp{}},
+		{"invalid json", `{`, true, primitive.Timestamp{}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "checkpoints.json")
+		if err := ioutil.WriteFile(path, []byte(tt.body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		checkpoints, err := NewFileStore(path, 0).Load()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got, _ := ClusterTime(checkpoints["goods"].Token); got != tt.want {
+			t.Errorf("%s: cluster time %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package checkpoint
+
+import (
+	"context"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* mongo集合存储，每个结束位置一个文档，_id为结束位置key
+ * 全量同步进度保存在 集合名_snapshot 集合，每个sync配置一个文档 */
+
+// MongoStore mongo集合存储
+type MongoStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+	snapshots  *mongo.Collection // 全量同步进度
+}
+
+// 一个sync配置的全量同步进度文档
+type mongoSnapshotProgress struct {
+	Key       string    `bson:"_id"`
+	Progress  string    `bson:"progress"` // 进度json
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+// NewMongoStore 创建mongo集合存储
+func NewMongoStore(uri, database, collection string) (*MongoStore, error) {
+	client, err := mongodb.InitClient(uri)
+	if err != nil {
+		return nil, err
+	}
+	return &MongoStore{
+		client:     client,
+		collection: client.Database(database).Collection(collection),
+		snapshots:  client.Database(database).Collection(collection + "_snapshot"),
+	}, nil
+}
+
+// Load 读取全部结束位置
+func (ms *MongoStore) Load() (map[string]*Checkpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cursor, err := ms.collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	checkpoints := make(map[string]*Checkpoint)
+	for cursor.Next(ctx) {
+		cp := new(Checkpoint)
+		if err := cursor.Decode(cp); err != nil {
+			return nil, err
+		}
+		checkpoints[cp.Key] = cp
+	}
+	return checkpoints, cursor.Err()
+}
+
+// Save 按结束位置key批量写入，多个实例可以共用一个集合，不删除其它结束位置，删除需调用Delete
+func (ms *MongoStore) Save(checkpoints map[string]*Checkpoint) error {
+	if len(checkpoints) == 0 {
+		return nil
+	}
+	writeModels := make([]mongo.WriteModel, 0, len(checkpoints))
+	for key, cp := range checkpoints {
+		writeModels = append(writeModels, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": key}).SetReplacement(cp).SetUpsert(true))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := ms.collection.BulkWrite(ctx, writeModels, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// Delete 删除指定的结束位置
+func (ms *MongoStore) Delete(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := ms.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": keys}})
+	return err
+}
+
+// LoadSnapshotProgress 读取全部全量同步进度
+func (ms *MongoStore) LoadSnapshotProgress() (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cursor, err := ms.snapshots.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	progress := make(map[string][]byte)
+	for cursor.Next(ctx) {
+		doc := new(mongoSnapshotProgress)
+		if err := cursor.Decode(doc); err != nil {
+			return nil, err
+		}
+		progress[doc.Key] = []byte(doc.Progress)
+	}
+	return progress, cursor.Err()
+}
+
+// SaveSnapshotProgress 按sync配置key写入全量同步进度，值为nil时删除
+func (ms *MongoStore) SaveSnapshotProgress(progress map[string][]byte) error {
+	writeModels := make([]mongo.WriteModel, 0, len(progress))
+	for key, val := range progress {
+		if val == nil {
+			writeModels = append(writeModels, mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": key}))
+			continue
+		}
+		doc := &mongoSnapshotProgress{Key: key, Progress: string(val), UpdatedAt: time.Now()}
+		writeModels = append(writeModels, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": key}).SetReplacement(doc).SetUpsert(true))
+	}
+	if len(writeModels) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := ms.snapshots.BulkWrite(ctx, writeModels, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// Close 关闭连接
+func (ms *MongoStore) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return ms.client.Disconnect(ctx)
+}
@@ -4,6 +4,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 /* 公共函数库 */
@@ -31,3 +36,25 @@ func PathExists(path string) (bool, error) {
 	}
 	return false, err
 }
+
+// ParseOperationTime 解析mongo集群时间
+// 支持 秒:序号 格式的集群时间、unix秒和RFC3339格式的时间
+func ParseOperationTime(str string) (primitive.Timestamp, error) {
+	str = strings.TrimSpace(str)
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return primitive.Timestamp{T: uint32(t.Unix()), I: 0}, nil
+	}
+	parts := strings.SplitN(str, ":", 2)
+	t, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return primitive.Timestamp{}, fmt.Errorf("时间格式错误，支持RFC3339、unix秒或 秒:序号 格式: %s", str)
+	}
+	var i uint64
+	if len(parts) == 2 {
+		i, err = strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return primitive.Timestamp{}, fmt.Errorf("集群时间序号格式错误: %s", str)
+		}
+	}
+	return primitive.Timestamp{T: uint32(t), I: uint32(i)}, nil
+}
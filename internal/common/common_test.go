@@ -0,0 +1,35 @@
+package common
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseOperationTime(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    primitive.Timestamp
+		wantErr bool
+	}{
+		{"2023-11-14T22:13:20Z", primitive.Timestamp{T: 1700000000}, false},
+		{"2023-11-15T06:13:20+08:00", primitive.Timestamp{T: 1700000000}, false},
+		{"1700000000", primitive.Timestamp{T: 1700000000}, false},
+		{"1700000000:5", primitive.Timestamp{T: 1700000000, I: 5}, false},
+		{" 1700000000:5 ", primitive.Timestamp{T: 1700000000, I: 5}, false},
+		{"1700000000:x", primitive.Timestamp{}, true},
+		{"-1", primitive.Timestamp{}, true},
+		{"2023-11-14", primitive.Timestamp{}, true},
+		{"", primitive.Timestamp{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseOperationTime(tt.str)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v", tt.str, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.str, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	BatchModeLatency    = "latency"    // 低延迟，分区没有待处理事件时立即写入
+	BatchModeThroughput = "throughput" // 高吞吐，等待凑满批次或达到等待时间再写入
+)
+
+// 各模式的默认批次条件
+var batchModeDefaults = map[string]BatchConfig{
+	BatchModeLatency:    {MaxCount: 100, MaxBytes: 1 << 20, LingerMs: 0},
+	BatchModeThroughput: {MaxCount: 1000, MaxBytes: 5 << 20, LingerMs: 200},
+}
+
+// BatchConfig 消费者批量写入配置，满足任一条件时写入一批
+type BatchConfig struct {
+	Mode     string `toml:"mode" json:"mode,omitempty"`           // latency throughput，默认latency
+	MaxCount int    `toml:"max_count" json:"max_count,omitempty"` // 每批最多事件数，0表示使用模式默认值
+	MaxBytes int    `toml:"max_bytes" json:"max_bytes,omitempty"` // 每批最大字节数(按bson估算)，0表示使用模式默认值
+	LingerMs int    `toml:"linger_ms" json:"linger_ms,omitempty"` // 批次未满时最长等待毫秒数，latency模式默认0表示不等待
+}
+
+func (cfg *BatchConfig) String() string {
+	js, _ := json.Marshal(cfg)
+	return string(js)
+}
+
+// GetMode 批量写入模式，默认latency
+func (cfg *BatchConfig) GetMode() string {
+	if cfg == nil || cfg.Mode == "" {
+		return BatchModeLatency
+	}
+	return cfg.Mode
+}
+
+// GetMaxCount 每批最多事件数
+func (cfg *BatchConfig) GetMaxCount() int {
+	if cfg != nil && cfg.MaxCount > 0 {
+		return cfg.MaxCount
+	}
+	return batchModeDefaults[cfg.GetMode()].MaxCount
+}
+
+// GetMaxBytes 每批最大字节数
+func (cfg *BatchConfig) GetMaxBytes() int {
+	if cfg != nil && cfg.MaxBytes > 0 {
+		return cfg.MaxBytes
+	}
+	return batchModeDefaults[cfg.GetMode()].MaxBytes
+}
+
+// GetLinger 批次未满时最长等待时间
+func (cfg *BatchConfig) GetLinger() time.Duration {
+	lingerMs := batchModeDefaults[cfg.GetMode()].LingerMs
+	if cfg != nil && cfg.LingerMs > 0 {
+		lingerMs = cfg.LingerMs
+	}
+	return time.Duration(lingerMs) * time.Millisecond
+}
+
+// 检查配置
+func (cfg *BatchConfig) check() error {
+	if cfg == nil {
+		return nil
+	}
+	if _, ok := batchModeDefaults[cfg.GetMode()]; !ok {
+		return errors.New("batch.mode只能为 latency throughput")
+	}
+	if cfg.MaxCount < 0 || cfg.MaxBytes < 0 || cfg.LingerMs < 0 {
+		return errors.New("batch.max_count max_bytes linger_ms不能小于0")
+	}
+	return nil
+}
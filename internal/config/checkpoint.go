@@ -0,0 +1,81 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const (
+	CheckpointStoreFile  = "file"  // 本地文件，写入临时文件后重命名，保留最近几个版本
+	CheckpointStoreMongo = "mongo" // mongo集合，每个结束位置一个文档
+
+	DefaultCheckpointPath        = "last_event_ids.json"
+	DefaultCheckpointGenerations = 3
+	DefaultCheckpointDatabase    = "mongodb_sync"
+	DefaultCheckpointCollection  = "checkpoints"
+)
+
+// CheckpointConfig 结束位置存储配置
+type CheckpointConfig struct {
+	Store       string `toml:"store" json:"store,omitempty"`             // 存储方式 file mongo，默认file
+	Path        string `toml:"path" json:"path,omitempty"`               // file存储的文件路径，默认last_event_ids.json，多个实例需要配置不同路径
+	Generations int    `toml:"generations" json:"generations,omitempty"` // file存储保留的历史版本数，默认3
+	Uri         string `toml:"uri" json:"uri,omitempty"`                 // mongo存储的连接地址，默认使用来源mongo
+	Database    string `toml:"database" json:"database,omitempty"`       // mongo存储的db，默认mongodb_sync
+	Collection  string `toml:"collection" json:"collection,omitempty"`   // mongo存储的集合，默认checkpoints
+}
+
+func (cfg *CheckpointConfig) String() string {
+	js, _ := json.Marshal(cfg)
+	return string(js)
+}
+
+// GetStore 存储方式，默认file
+func (cfg *CheckpointConfig) GetStore() string {
+	if cfg == nil || cfg.Store == "" {
+		return CheckpointStoreFile
+	}
+	return cfg.Store
+}
+
+// GetPath file存储的文件路径
+func (cfg *CheckpointConfig) GetPath() string {
+	if cfg == nil || cfg.Path == "" {
+		return DefaultCheckpointPath
+	}
+	return cfg.Path
+}
+
+// GetGenerations file存储保留的历史版本数
+func (cfg *CheckpointConfig) GetGenerations() int {
+	if cfg == nil || cfg.Generations <= 0 {
+		return DefaultCheckpointGenerations
+	}
+	return cfg.Generations
+}
+
+// GetDatabase mongo存储的db
+func (cfg *CheckpointConfig) GetDatabase() string {
+	if cfg == nil || cfg.Database == "" {
+		return DefaultCheckpointDatabase
+	}
+	return cfg.Database
+}
+
+// GetCollection mongo存储的集合
+func (cfg *CheckpointConfig) GetCollection() string {
+	if cfg == nil || cfg.Collection == "" {
+		return DefaultCheckpointCollection
+	}
+	return cfg.Collection
+}
+
+// 检查配置
+func (cfg *CheckpointConfig) check() error {
+	switch cfg.GetStore() {
+	case CheckpointStoreFile, CheckpointStoreMongo:
+		return nil
+	default:
+		return errors.New("checkpoint.store只能为 file mongo")
+	}
+}
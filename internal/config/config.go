@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/naoina/toml"
 	"github.com/shiguanghuxian/mongodb-sync/internal/common"
@@ -12,14 +13,17 @@ import (
 
 // Config 配置文件
 type Config struct {
-	Debug bool          `toml:"debug" json:"debug,omitempty"`
-	Mongo *MongoConfig  `toml:"mongo" json:"mongo,omitempty"`
-	Sync  []*SyncConfig `toml:"sync" json:"sync,omitempty"`
+	Debug      bool              `toml:"debug" json:"debug,omitempty"`
+	Mongo      *MongoConfig      `toml:"mongo" json:"mongo,omitempty"`
+	Checkpoint *CheckpointConfig `toml:"checkpoint" json:"checkpoint,omitempty"`   // 结束位置存储配置
+	DeadLetter *DeadLetterConfig `toml:"dead_letter" json:"dead_letter,omitempty"` // 死信存储配置
+	Sync       []*SyncConfig     `toml:"sync" json:"sync,omitempty"`
 }
 
 type MongoConfig struct {
 	SourceUri     string  `toml:"source_uri" json:"source_uri,omitempty"`
 	SourceVersion float32 `toml:"source_version" json:"source_version,omitempty"`
+	SourceMode    string  `toml:"source_mode" json:"source_mode,omitempty"` // 读取变更方式 change_stream oplog，默认3.6及以上为change_stream，以下为oplog
 }
 
 func (c *MongoConfig) String() string {
@@ -28,20 +32,48 @@ func (c *MongoConfig) String() string {
 }
 
 const (
-	SyncTypeMongo = "mongo"
-	SyncTypeEs    = "elasticsearch"
-	SyncTypeMysql = "mysql"
-	SyncTypeFile  = "file"
+	SourceModeChangeStream = "change_stream" // 订阅change stream，需要3.6及以上版本
+	SourceModeOplog        = "oplog"         // 直接读取local.oplog.rs，用于不支持change stream的版本
 )
 
+// GetSourceMode 读取变更方式
+func (c *MongoConfig) GetSourceMode() string {
+	if c.SourceMode != "" {
+		return c.SourceMode
+	}
+	if c.SourceVersion < 3.6 {
+		return SourceModeOplog
+	}
+	return SourceModeChangeStream
+}
+
 type SyncConfig struct {
-	Enable          bool                `toml:"enable" json:"enable,omitempty"`                     // 是否启用
-	Type            string              `toml:"type" json:"type,omitempty"`                         // mongo elasticsearch mysql file 一种输出类型只能配置一个，如果多个，请开启多个程序
-	DestinationUri  string              `toml:"destination_uri" json:"destination_uri,omitempty"`   // 目标db链接地址
-	SourceDb        string              `toml:"source_db" json:"source_db,omitempty"`               // 源db
-	DestinationDb   string              `toml:"destination_db" json:"destination_db,omitempty"`     // 目标db
-	Collections     map[string]string   `toml:"collections" json:"collections,omitempty"`           // 同步的集合对照 key:来源集合 val:目标集合或表等
-	CollectionField map[string][]string `toml:"collection_field" json:"collection_field,omitempty"` // 需要同步的字段列表 - 下标为来源db的collection名值为同步的字段列表
+	Enable            bool                   `toml:"enable" json:"enable,omitempty"`                           // 是否启用
+	Name              string                 `toml:"name" json:"name,omitempty"`                               // 同步配置名称，不能重复，用于结束位置、日志和消费者注册，未配置时为 类型-目标地址-来源db-目标db
+	Type              string                 `toml:"type" json:"type,omitempty"`                               // 目标类型，内置 mongo elasticsearch mysql sql file process webhook kafka redis，其它类型由导入的消费者包注册
+	DestinationUri    string                 `toml:"destination_uri" json:"destination_uri,omitempty"`         // 目标db链接地址
+	SourceDb          string                 `toml:"source_db" json:"source_db,omitempty"`                     // 源db
+	DestinationDb     string                 `toml:"destination_db" json:"destination_db,omitempty"`           // 目标db
+	Collections       map[string]string      `toml:"collections" json:"collections,omitempty"`                 // 同步的集合对照 key:来源集合 val:目标集合或表等
+	CollectionField   map[string][]string    `toml:"collection_field" json:"collection_field,omitempty"`       // 需要同步的字段列表 - 下标为来源db的collection名值为同步的字段列表
+	Snapshot          bool                   `toml:"snapshot" json:"snapshot,omitempty"`                       // 没有上次结束位置时，是否先全量同步collections中已有数据，再处理订阅
+	SnapshotWorkers   int                    `toml:"snapshot_workers" json:"snapshot_workers,omitempty"`       // 全量同步并发复制的区间数，默认4
+	SnapshotChunkSize int64                  `toml:"snapshot_chunk_size" json:"snapshot_chunk_size,omitempty"` // 全量同步按_id拆分区间，每个区间的文档数，默认100000
+	Workers           int                    `toml:"workers" json:"workers,omitempty"`                         // 消费分区数，同一个文档的变更在同一个分区按顺序处理，默认4
+	Batch             *BatchConfig           `toml:"batch" json:"batch,omitempty"`                             // 批量写入配置，每个分区按条数、字节数或等待时间合并写入
+	Retry             *RetryConfig           `toml:"retry" json:"retry,omitempty"`                             // 写入目标失败的重试配置
+	Filter            *FilterConfig          `toml:"filter" json:"filter,omitempty"`                           // 订阅过滤配置，在源mongo服务端过滤
+	StartAt           string                 `toml:"start_at" json:"start_at,omitempty"`                       // 没有上次结束位置时从此时间开始订阅，RFC3339、unix秒或 秒:序号 格式的集群时间，配置后不做全量同步
+	DDL               *DDLConfig             `toml:"ddl" json:"ddl,omitempty"`                                 // 来源集合重命名、删除以及db删除事件的处理配置
+	KeyColumns        map[string][]string    `toml:"key_columns" json:"key_columns,omitempty"`                 // mysql和sql唯一标识列 key:来源集合 val:字段:列名 列表，默认 _id:document_key
+	Options           map[string]interface{} `toml:"options" json:"options,omitempty"`                         // 目标类型的专有配置，由消费者解析为各自的配置结构
+	// 变更前后文档配置
+	FullDocument             string `toml:"full_document" json:"full_document,omitempty"`                             // 变更后文档模式 updateLookup whenAvailable required default，默认updateLookup
+	FullDocumentBeforeChange string `toml:"full_document_before_change" json:"full_document_before_change,omitempty"` // 变更前文档模式 off whenAvailable required，默认off
+	PostImageMissing         string `toml:"post_image_missing" json:"post_image_missing,omitempty"`                   // 更新事件没有变更后文档(例如文档已被删除)时的处理方式 skip delete updates，默认skip
+	UpdateMode               string `toml:"update_mode" json:"update_mode,omitempty"`                                 // 更新事件应用方式 full_document delta，默认full_document
+
+	debug bool // 与全局debug配置一致
 }
 
 func (cfg *SyncConfig) String() string {
@@ -49,8 +81,19 @@ func (cfg *SyncConfig) String() string {
 	return string(js)
 }
 
-// 用于区分某个同步配置
+// 用于区分某个同步配置，配置了name时为name
 func (cfg *SyncConfig) GetKey() string {
+	if cfg == nil {
+		return ""
+	}
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return cfg.DefaultKey()
+}
+
+// DefaultKey 未配置name时的key，旧版本按此key记录结束位置
+func (cfg *SyncConfig) DefaultKey() string {
 	if cfg == nil {
 		return ""
 	}
@@ -58,6 +101,14 @@ func (cfg *SyncConfig) GetKey() string {
 	return str
 }
 
+// GetDestinationCollection 来源集合对应的目标集合、表等，未配置对照时与来源集合同名
+func (cfg *SyncConfig) GetDestinationCollection(sourceCollection string) string {
+	if destination := cfg.Collections[sourceCollection]; destination != "" {
+		return destination
+	}
+	return sourceCollection
+}
+
 func (cfg *SyncConfig) InCollectionField(collection, field string) bool {
 	// 未配置，表示全部字段同步
 	if cfg.CollectionField == nil {
@@ -89,6 +140,14 @@ func NewConfig(path string) (cfgChan chan *Config, err error) {
 	return
 }
 
+// LoadConfig 读取一次配置文件，不监听变化，用于命令行工具
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		path = common.GetRootDir() + "config/cfg.toml"
+	}
+	return readConfFile(path)
+}
+
 // ReadConfFile 读取配置文件
 func readConfFile(path string) (cfg *Config, err error) {
 	f, err := os.Open(path)
@@ -103,14 +162,58 @@ func readConfFile(path string) (cfg *Config, err error) {
 	if cfg.Mongo == nil || cfg.Mongo.SourceUri == "" {
 		return nil, errors.New("mongo连接配置错误，请配置连接来源和目标连接地址")
 	}
+	if mode := cfg.Mongo.GetSourceMode(); mode != SourceModeChangeStream && mode != SourceModeOplog {
+		return nil, errors.New("mongo.source_mode只能为 change_stream oplog")
+	}
+	if err := cfg.Checkpoint.check(); err != nil {
+		return nil, err
+	}
+	if err := cfg.DeadLetter.check(); err != nil {
+		return nil, err
+	}
 	// 同步库表配置不能为空
 	if len(cfg.Sync) == 0 {
 		return nil, errors.New("同步db配置不能为空")
 	}
+	keys := make(map[string]bool, len(cfg.Sync))
 	for _, v := range cfg.Sync {
-		if v.Type == "" || (v.DestinationUri == "" && v.Type != SyncTypeFile) || v.SourceDb == "" || v.DestinationDb == "" || len(v.Collections) == 0 {
+		// 目标连接地址等由各类型的消费者检查
+		if v.Type == "" || v.SourceDb == "" || v.DestinationDb == "" || len(v.Collections) == 0 {
 			return nil, errors.New("同步collection配置错误")
 		}
+		// #为结束位置key中sync配置key与collection的分隔符
+		if strings.Contains(v.Name, "#") {
+			return nil, fmt.Errorf("同步配置name不能包含#: %s", v.Name)
+		}
+		// 结束位置、死信和消费者按key区分，同类型同目标的多个配置需要设置不同的name
+		if keys[v.GetKey()] {
+			return nil, fmt.Errorf("同步配置key重复: %s，请为每个同步配置设置不同的name", v.GetKey())
+		}
+		keys[v.GetKey()] = true
+		v.debug = cfg.Debug
+		if _, err := v.Filter.Pipeline(); err != nil {
+			return nil, fmt.Errorf("同步过滤配置错误: %v", err)
+		}
+		if err := v.checkImage(cfg.Mongo.SourceVersion); err != nil {
+			return nil, fmt.Errorf("同步变更前后文档配置错误: %v", err)
+		}
+		if err := v.DDL.check(); err != nil {
+			return nil, fmt.Errorf("同步ddl配置错误: %v", err)
+		}
+		if err := v.Batch.check(); err != nil {
+			return nil, fmt.Errorf("同步batch配置错误: %v", err)
+		}
+		if err := v.Retry.check(); err != nil {
+			return nil, fmt.Errorf("同步retry配置错误: %v", err)
+		}
+		if err := v.checkKeyColumns(); err != nil {
+			return nil, fmt.Errorf("key_columns配置错误: %v", err)
+		}
+		if v.StartAt != "" {
+			if _, err := common.ParseOperationTime(v.StartAt); err != nil {
+				return nil, fmt.Errorf("start_at配置错误: %v", err)
+			}
+		}
 	}
 
 	return
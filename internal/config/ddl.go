@@ -0,0 +1,55 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const (
+	DDLDropIgnore   = "ignore"   // 忽略来源集合或db删除
+	DDLDropDrop     = "drop"     // 删除目标集合、表或索引数据
+	DDLDropTruncate = "truncate" // 清空目标集合、表或索引数据
+)
+
+// DDLConfig 来源集合重命名、删除以及db删除事件的处理配置
+type DDLConfig struct {
+	Rename    bool   `toml:"rename" json:"rename,omitempty"`         // 来源集合重命名时是否重命名目标集合或表
+	Drop      string `toml:"drop" json:"drop,omitempty"`             // 来源集合或db删除时目标的处理方式 ignore drop truncate，默认ignore
+	AllowDrop bool   `toml:"allow_drop" json:"allow_drop,omitempty"` // 安全开关，为true时drop和truncate才会执行
+}
+
+func (cfg *DDLConfig) String() string {
+	js, _ := json.Marshal(cfg)
+	return string(js)
+}
+
+// RenameEnabled 是否同步重命名
+func (cfg *DDLConfig) RenameEnabled() bool {
+	return cfg != nil && cfg.Rename
+}
+
+// DropAction 来源集合或db删除时目标的处理方式，未开启安全开关时只能忽略
+func (cfg *DDLConfig) DropAction() string {
+	if cfg == nil || !cfg.AllowDrop {
+		return DDLDropIgnore
+	}
+	switch cfg.Drop {
+	case DDLDropDrop, DDLDropTruncate:
+		return cfg.Drop
+	default:
+		return DDLDropIgnore
+	}
+}
+
+// 检查配置
+func (cfg *DDLConfig) check() error {
+	if cfg == nil {
+		return nil
+	}
+	switch cfg.Drop {
+	case "", DDLDropIgnore, DDLDropDrop, DDLDropTruncate:
+		return nil
+	default:
+		return errors.New("ddl.drop只能为 ignore drop truncate")
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const (
+	DeadLetterStoreOff   = "off"   // 不使用死信存储，出现永久错误时也一直重试
+	DeadLetterStoreFile  = "file"  // 本地目录，每条死信一个文件
+	DeadLetterStoreMongo = "mongo" // mongo集合，每条死信一个文档
+
+	DefaultDeadLetterPath        = "dead_letter"
+	DefaultDeadLetterMaxAttempts = 3
+	DefaultDeadLetterDatabase    = "mongodb_sync"
+	DefaultDeadLetterCollection  = "dead_letters"
+)
+
+// DeadLetterConfig 死信存储配置，写入目标出现永久错误的事件保存到死信存储后继续处理后续事件
+type DeadLetterConfig struct {
+	Store       string `toml:"store" json:"store,omitempty"`               // 存储方式 off file mongo，默认off
+	Path        string `toml:"path" json:"path,omitempty"`                 // file存储的目录，默认dead_letter
+	MaxAttempts int    `toml:"max_attempts" json:"max_attempts,omitempty"` // 永久错误写入失败多少次后保存为死信，默认3
+	Uri         string `toml:"uri" json:"uri,omitempty"`                   // mongo存储的连接地址，默认使用来源mongo
+	Database    string `toml:"database" json:"database,omitempty"`         // mongo存储的db，默认mongodb_sync
+	Collection  string `toml:"collection" json:"collection,omitempty"`     // mongo存储的集合，默认dead_letters
+}
+
+func (cfg *DeadLetterConfig) String() string {
+	js, _ := json.Marshal(cfg)
+	return string(js)
+}
+
+// GetStore 存储方式，默认off
+func (cfg *DeadLetterConfig) GetStore() string {
+	if cfg == nil || cfg.Store == "" {
+		return DeadLetterStoreOff
+	}
+	return cfg.Store
+}
+
+// Enabled 是否使用死信存储
+func (cfg *DeadLetterConfig) Enabled() bool {
+	return cfg.GetStore() != DeadLetterStoreOff
+}
+
+// GetPath file存储的目录
+func (cfg *DeadLetterConfig) GetPath() string {
+	if cfg == nil || cfg.Path == "" {
+		return DefaultDeadLetterPath
+	}
+	return cfg.Path
+}
+
+// GetMaxAttempts 永久错误写入失败多少次后保存为死信
+func (cfg *DeadLetterConfig) GetMaxAttempts() int {
+	if cfg == nil || cfg.MaxAttempts <= 0 {
+		return DefaultDeadLetterMaxAttempts
+	}
+	return cfg.MaxAttempts
+}
+
+// GetDatabase mongo存储的db
+func (cfg *DeadLetterConfig) GetDatabase() string {
+	if cfg == nil || cfg.Database == "" {
+		return DefaultDeadLetterDatabase
+	}
+	return cfg.Database
+}
+
+// GetCollection mongo存储的集合
+func (cfg *DeadLetterConfig) GetCollection() string {
+	if cfg == nil || cfg.Collection == "" {
+		return DefaultDeadLetterCollection
+	}
+	return cfg.Collection
+}
+
+// 检查配置
+func (cfg *DeadLetterConfig) check() error {
+	switch cfg.GetStore() {
+	case DeadLetterStoreOff, DeadLetterStoreFile, DeadLetterStoreMongo:
+		return nil
+	default:
+		return errors.New("dead_letter.store只能为 off file mongo")
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FilterConfig 订阅过滤配置，编译为服务端订阅pipeline，减少源库负载和网络传输
+type FilterConfig struct {
+	Namespaces     []string `toml:"namespaces" json:"namespaces,omitempty"`           // 只订阅的来源集合，为空表示不过滤
+	OperationTypes []string `toml:"operation_types" json:"operation_types,omitempty"` // 只订阅的事件类型 insert update replace delete 等，为空表示不过滤
+	Match          string   `toml:"match" json:"match,omitempty"`                     // 附加$match条件，mongo扩展json，例如 {"fullDocument.status": 1}
+	Project        string   `toml:"project" json:"project,omitempty"`                 // $project阶段，mongo扩展json，例如 {"fullDocument.name": 1}
+}
+
+// 订阅事件中程序依赖的字段，$project为包含模式时自动保留，排除模式时不允许排除
+var changeEventFields = []string{"_id", "operationType", "ns", "documentKey", "to", "clusterTime", "txnNumber", "lsid"}
+
+func (cfg *FilterConfig) String() string {
+	js, _ := json.Marshal(cfg)
+	return string(js)
+}
+
+// Pipeline 编译为订阅pipeline，未配置时为空pipeline
+func (cfg *FilterConfig) Pipeline() (bson.A, error) {
+	pipeline := bson.A{}
+	if cfg == nil {
+		return pipeline, nil
+	}
+	conds := bson.A{}
+	if len(cfg.Namespaces) > 0 {
+		// dropDatabase invalidate 等事件没有集合名，不能过滤
+		conds = append(conds, bson.M{"$or": bson.A{
+			bson.M{"ns.coll": bson.M{"$in": cfg.Namespaces}},
+			bson.M{"ns.coll": bson.M{"$exists": false}},
+		}})
+	}
+	if len(cfg.OperationTypes) > 0 {
+		// invalidate 事件出现时订阅已经结束，需要交给程序处理
+		operationTypes := append([]string{"invalidate"}, cfg.OperationTypes...)
+		conds = append(conds, bson.M{"operationType": bson.M{"$in": operationTypes}})
+	}
+	if cfg.Match != "" {
+		match := bson.D{}
+		err := bson.UnmarshalExtJSON([]byte(cfg.Match), false, &match)
+		if err != nil {
+			return nil, fmt.Errorf("match解析错误: %v", err)
+		}
+		conds = append(conds, match)
+	}
+	if len(conds) > 0 {
+		pipeline = append(pipeline, bson.M{"$match": bson.M{"$and": conds}})
+	}
+
+	if cfg.Project != "" {
+		project, err := compileProject(cfg.Project)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, bson.M{"$project": project})
+	}
+	return pipeline, nil
+}
+
+// 编译$project阶段，保证程序依赖的字段不被去掉
+func compileProject(str string) (bson.D, error) {
+	project := bson.D{}
+	err := bson.UnmarshalExtJSON([]byte(str), false, &project)
+	if err != nil {
+		return nil, fmt.Errorf("project解析错误: %v", err)
+	}
+	// 是否包含模式，_id以外的字段决定
+	include := false
+	fields := make(map[string]interface{}, len(project))
+	for _, v := range project {
+		fields[v.Key] = v.Value
+		if v.Key != "_id" && projectIncluded(v.Value) {
+			include = true
+		}
+	}
+	for _, field := range changeEventFields {
+		val, ok := fields[field]
+		if ok && !projectIncluded(val) {
+			return nil, fmt.Errorf("project不能排除字段 %s", field)
+		}
+		if !ok && include {
+			project = append(project, bson.E{Key: field, Value: 1})
+		}
+	}
+	return project, nil
+}
+
+// $project字段值是否表示保留该字段
+func projectIncluded(val interface{}) bool {
+	switch v := val.(type) {
+	case bool:
+		return v
+	case int32:
+		return v != 0
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	default:
+		// 表达式等计算字段
+		return true
+	}
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFilterPipeline(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *FilterConfig
+		want    string
+		wantErr bool
+	}{
+		{"nil", nil, `[]`, false},
+		{"empty", &FilterConfig{}, `[]`, false},
+		{"namespaces", &FilterConfig{Namespaces: []string{"goods"}},
+			`[{"$match":{"$and":[{"$or":[{"ns.coll":{"$in":["goods"]}},{"ns.coll":{"$exists":false}}]}]}}]`, false},
+		// 自动保留invalidate事件
+		{"operation types", &FilterConfig{OperationTypes: []string{"insert", "delete"}},
+			`[{"$match":{"$and":[{"operationType":{"$in":["invalidate","insert","delete"]}}]}}]`, false},
+		{"match", &FilterConfig{Match: `{"fullDocument.status": 1}`},
+			`[{"$match":{"$and":[{"fullDocument.status":1}]}}]`, false},
+		{"match error", &FilterConfig{Match: `{`}, ``, true},
+		// 包含模式时补充程序依赖的字段
+		{"project include", &FilterConfig{Project: `{"fullDocument.name": 1}`},
+			`[{"$project":{"fullDocument.name":1,"_id":1,"operationType":1,"ns":1,"documentKey":1,"to":1,"clusterTime":1,"txnNumber":1,"lsid":1}}]`, false},
+		{"project exclude", &FilterConfig{Project: `{"fullDocument.secret": 0}`},
+			`[{"$project":{"fullDocument.secret":0}}]`, false},
+		{"project exclude required field", &FilterConfig{Project: `{"documentKey": 0}`}, ``, true},
+		{"project error", &FilterConfig{Project: `[`}, ``, true},
+	}
+	for _, tt := range tests {
+		pipeline, err := tt.cfg.Pipeline()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		js, err := bson.MarshalExtJSON(bson.M{"p": pipeline}, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(js[len(`{"p":`) : len(js)-1]); got != tt.want {
+			t.Errorf("%s: pipeline = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"errors"
+)
+
+const (
+	FullDocumentUpdateLookup  = "updateLookup"  // 更新事件查询当前完整文档
+	FullDocumentWhenAvailable = "whenAvailable" // 有变更后文档时返回，需要6.0及以上并开启changeStreamPreAndPostImages
+	FullDocumentRequired      = "required"      // 必须返回变更后或变更前文档，没有时订阅报错，需要6.0及以上
+	FullDocumentDefault       = "default"       // 更新事件不返回完整文档
+	FullDocumentOff           = "off"           // 不返回变更前文档
+
+	PostImageMissingSkip    = "skip"    // 跳过事件，文档已被删除时后续的删除事件会删除目标数据
+	PostImageMissingDelete  = "delete"  // 按删除事件处理
+	PostImageMissingUpdates = "updates" // 使用updateDescription中更新的字段作为文档内容
+
+	UpdateModeFullDocument = "full_document" // 更新事件使用变更后完整文档覆盖目标字段
+	UpdateModeDelta        = "delta"         // 更新事件按updateDescription精确更新、删除和截短字段
+)
+
+// GetFullDocument 订阅的变更后文档模式，默认updateLookup
+func (cfg *SyncConfig) GetFullDocument() string {
+	if cfg.FullDocument == "" {
+		return FullDocumentUpdateLookup
+	}
+	return cfg.FullDocument
+}
+
+// GetFullDocumentBeforeChange 订阅的变更前文档模式，默认off
+func (cfg *SyncConfig) GetFullDocumentBeforeChange() string {
+	if cfg.FullDocumentBeforeChange == "" {
+		return FullDocumentOff
+	}
+	return cfg.FullDocumentBeforeChange
+}
+
+// GetPostImageMissing 更新事件没有变更后文档时的处理方式，默认skip
+func (cfg *SyncConfig) GetPostImageMissing() string {
+	if cfg.PostImageMissing == "" {
+		return PostImageMissingSkip
+	}
+	return cfg.PostImageMissing
+}
+
+// GetUpdateMode 更新事件应用到目标的方式，默认full_document
+func (cfg *SyncConfig) GetUpdateMode() string {
+	if cfg.UpdateMode == "" {
+		return UpdateModeFullDocument
+	}
+	return cfg.UpdateMode
+}
+
+// 检查变更前后文档配置，whenAvailable和required需要6.0及以上版本
+func (cfg *SyncConfig) checkImage(sourceVersion float32) error {
+	switch cfg.GetFullDocument() {
+	case FullDocumentUpdateLookup, FullDocumentDefault:
+	case FullDocumentWhenAvailable, FullDocumentRequired:
+		if sourceVersion < 6.0 {
+			return errors.New("full_document为whenAvailable或required时需要mongodb 6.0及以上版本")
+		}
+	default:
+		return errors.New("full_document只能为 updateLookup whenAvailable required default")
+	}
+	switch cfg.GetFullDocumentBeforeChange() {
+	case FullDocumentOff:
+	case FullDocumentWhenAvailable, FullDocumentRequired:
+		if sourceVersion < 6.0 {
+			return errors.New("full_document_before_change需要mongodb 6.0及以上版本")
+		}
+	default:
+		return errors.New("full_document_before_change只能为 off whenAvailable required")
+	}
+	switch cfg.GetPostImageMissing() {
+	case PostImageMissingSkip, PostImageMissingDelete, PostImageMissingUpdates:
+	default:
+		return errors.New("post_image_missing只能为 skip delete updates")
+	}
+	switch cfg.GetUpdateMode() {
+	case UpdateModeFullDocument, UpdateModeDelta:
+	default:
+		return errors.New("update_mode只能为 full_document delta")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 默认使用_id作为唯一标识，写入document_key列
+var defaultKeyColumns = []KeyColumn{{Field: "_id", Column: "document_key"}}
+
+// KeyColumn 文档唯一标识字段与目标表列的对应
+type KeyColumn struct {
+	Field  string // 文档唯一标识字段，例如 _id 或分片键字段
+	Column string // 目标表列名
+}
+
+// 解析 字段:列名 格式，省略列名时与字段同名
+func parseKeyColumn(str string) (KeyColumn, error) {
+	parts := strings.SplitN(str, ":", 2)
+	keyColumn := KeyColumn{Field: strings.TrimSpace(parts[0])}
+	keyColumn.Column = keyColumn.Field
+	if len(parts) == 2 {
+		keyColumn.Column = strings.TrimSpace(parts[1])
+	}
+	if keyColumn.Field == "" || keyColumn.Column == "" {
+		return keyColumn, fmt.Errorf("唯一标识列配置错误: %s", str)
+	}
+	return keyColumn, nil
+}
+
+// GetKeyColumns 来源集合的唯一标识列，未配置时为 _id:document_key
+func (cfg *SyncConfig) GetKeyColumns(sourceCollection string) []KeyColumn {
+	list := cfg.KeyColumns[sourceCollection]
+	if len(list) == 0 {
+		return defaultKeyColumns
+	}
+	keyColumns := make([]KeyColumn, 0, len(list))
+	for _, v := range list {
+		keyColumn, err := parseKeyColumn(v)
+		if err != nil {
+			continue
+		}
+		keyColumns = append(keyColumns, keyColumn)
+	}
+	return keyColumns
+}
+
+// 检查唯一标识列配置
+func (cfg *SyncConfig) checkKeyColumns() error {
+	for coll, list := range cfg.KeyColumns {
+		for _, v := range list {
+			if _, err := parseKeyColumn(v); err != nil {
+				return fmt.Errorf("%s: %v", coll, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// DecodeOptions 将目标类型的专有配置 [sync.options] 解析到消费者的配置结构，按json标签对应，不认识的配置项返回错误
+func (cfg *SyncConfig) DecodeOptions(v interface{}) error {
+	if cfg == nil || len(cfg.Options) == 0 {
+		return nil
+	}
+	js, err := json.Marshal(cfg.Options)
+	if err != nil {
+		return fmt.Errorf("%s目标options配置错误: %v", cfg.Type, err)
+	}
+	// 不认识的配置项报错，防止拼写错误的配置被忽略
+	decoder := json.NewDecoder(bytes.NewReader(js))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(v)
+	if err != nil {
+		return fmt.Errorf("%s目标options配置错误: %v", cfg.Type, err)
+	}
+	return nil
+}
+
+// Debug 是否为debug模式，与全局debug配置一致
+func (cfg *SyncConfig) Debug() bool {
+	return cfg != nil && cfg.debug
+}
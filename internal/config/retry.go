@@ -0,0 +1,74 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	DefaultRetryMaxAttempts   = 10
+	DefaultRetryMinIntervalMs = 1000
+	DefaultRetryMaxIntervalMs = 60000
+	DefaultRetryJitter        = 0.2
+)
+
+// RetryConfig 写入目标失败的重试配置
+// 临时错误(超时、限流、网络、可重试的写入错误)按指数退避重试，超过重试次数后分区阻塞，按最大间隔一直重试，不跳过事件
+type RetryConfig struct {
+	MaxAttempts   int     `toml:"max_attempts" json:"max_attempts,omitempty"`       // 指数退避的重试次数，超过后分区阻塞，默认10
+	MinIntervalMs int     `toml:"min_interval_ms" json:"min_interval_ms,omitempty"` // 首次重试间隔毫秒数，默认1000
+	MaxIntervalMs int     `toml:"max_interval_ms" json:"max_interval_ms,omitempty"` // 最大重试间隔毫秒数，默认60000
+	Jitter        float64 `toml:"jitter" json:"jitter,omitempty"`                   // 重试间隔随机浮动比例 0-1，默认0.2
+}
+
+func (cfg *RetryConfig) String() string {
+	js, _ := json.Marshal(cfg)
+	return string(js)
+}
+
+// GetMaxAttempts 指数退避的重试次数
+func (cfg *RetryConfig) GetMaxAttempts() int {
+	if cfg == nil || cfg.MaxAttempts <= 0 {
+		return DefaultRetryMaxAttempts
+	}
+	return cfg.MaxAttempts
+}
+
+// GetMinInterval 首次重试间隔
+func (cfg *RetryConfig) GetMinInterval() time.Duration {
+	if cfg == nil || cfg.MinIntervalMs <= 0 {
+		return DefaultRetryMinIntervalMs * time.Millisecond
+	}
+	return time.Duration(cfg.MinIntervalMs) * time.Millisecond
+}
+
+// GetMaxInterval 最大重试间隔
+func (cfg *RetryConfig) GetMaxInterval() time.Duration {
+	if cfg == nil || cfg.MaxIntervalMs <= 0 {
+		return DefaultRetryMaxIntervalMs * time.Millisecond
+	}
+	return time.Duration(cfg.MaxIntervalMs) * time.Millisecond
+}
+
+// GetJitter 重试间隔随机浮动比例
+func (cfg *RetryConfig) GetJitter() float64 {
+	if cfg == nil || cfg.Jitter <= 0 {
+		return DefaultRetryJitter
+	}
+	return cfg.Jitter
+}
+
+// 检查配置
+func (cfg *RetryConfig) check() error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.Jitter < 0 || cfg.Jitter > 1 {
+		return errors.New("retry.jitter只能为0到1")
+	}
+	if cfg.GetMinInterval() > cfg.GetMaxInterval() {
+		return errors.New("retry.min_interval_ms不能大于max_interval_ms")
+	}
+	return nil
+}
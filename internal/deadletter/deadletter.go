@@ -0,0 +1,73 @@
+package deadletter
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* 死信存储，保存写入目标多次失败的事件，可以查看、重新写入或丢弃 */
+
+// ErrNotFound 死信不存在
+var ErrNotFound = errors.New("死信不存在")
+
+// Record 一条死信，源事务的多条事件保存为一条
+type Record struct {
+	ID        string                `bson:"_id" json:"id"`                // 按创建时间递增
+	Key       string                `bson:"key" json:"key"`               // sync配置key
+	Events    []*models.ChangeEvent `bson:"events" json:"events"`         // 写入失败的事件
+	Error     string                `bson:"error" json:"error"`           // 最后一次写入的错误
+	Attempts  int                   `bson:"attempts" json:"attempts"`     // 已写入次数
+	CreatedAt time.Time             `bson:"created_at" json:"created_at"` // 创建时间
+	UpdatedAt time.Time             `bson:"updated_at" json:"updated_at"` // 最后一次写入时间
+}
+
+// NewRecord 创建一条死信
+func NewRecord(key string, events []*models.ChangeEvent, err error, attempts int) *Record {
+	now := time.Now()
+	return &Record{
+		ID:        primitive.NewObjectIDFromTimestamp(now).Hex(),
+		Key:       key,
+		Events:    events,
+		Error:     err.Error(),
+		Attempts:  attempts,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// Store 死信存储
+type Store interface {
+	// 保存一条死信，id已存在时覆盖
+	Put(record *Record) error
+	// 按创建时间顺序读取死信，key为空时读取全部
+	List(key string) ([]*Record, error)
+	// 读取一条死信，不存在时返回ErrNotFound
+	Get(id string) (*Record, error)
+	// 删除一条死信
+	Delete(id string) error
+	// 关闭存储
+	Close() error
+}
+
+// NewStore 按配置创建存储，mongo存储未配置连接地址时使用来源mongo
+func NewStore(cfg *config.Config) (Store, error) {
+	switch cfg.DeadLetter.GetStore() {
+	case config.DeadLetterStoreFile:
+		return NewFileStore(cfg.DeadLetter.GetPath()), nil
+	case config.DeadLetterStoreMongo:
+		uri := cfg.Mongo.SourceUri
+		if cfg.DeadLetter.Uri != "" {
+			uri = cfg.DeadLetter.Uri
+		}
+		return NewMongoStore(uri, cfg.DeadLetter.GetDatabase(), cfg.DeadLetter.GetCollection())
+	case config.DeadLetterStoreOff:
+		return nil, errors.New("未配置死信存储，请配置dead_letter.store")
+	default:
+		return nil, fmt.Errorf("不支持的死信存储: %s", cfg.DeadLetter.GetStore())
+	}
+}
@@ -0,0 +1,145 @@
+package deadletter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/* 本地目录存储，每条死信一个文件，内容为mongo扩展json，先写临时文件再重命名 */
+
+const fileExt = ".json"
+
+// FileStore 本地目录存储
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore 创建本地目录存储
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{
+		dir: dir,
+	}
+}
+
+// Put 写入临时文件并同步到磁盘后重命名
+func (fs *FileStore) Put(record *Record) error {
+	err := os.MkdirAll(fs.dir, 0755)
+	if err != nil {
+		return err
+	}
+	// canonical格式保留bson类型，重新写入时与原事件一致
+	body, err := bson.MarshalExtJSONIndent(record, true, false, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化死信错误: %v", err)
+	}
+	path := fs.path(record.ID)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(fs.dir)
+	return nil
+}
+
+// List 按文件名顺序读取，文件名为按时间递增的id
+func (fs *FileStore) List(key string) ([]*Record, error) {
+	files, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ids := make([]string, 0, len(files))
+	for _, v := range files {
+		if v.IsDir() || !strings.HasSuffix(v.Name(), fileExt) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(v.Name(), fileExt))
+	}
+	sort.Strings(ids)
+	records := make([]*Record, 0, len(ids))
+	for _, id := range ids {
+		record, err := fs.Get(id)
+		if err != nil {
+			logger.GlobalLogger.Warnw("读取死信文件错误", "err", err, "id", id)
+			continue
+		}
+		if key != "" && record.Key != key {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Get 读取一条死信
+func (fs *FileStore) Get(id string) (*Record, error) {
+	body, err := ioutil.ReadFile(fs.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	record := new(Record)
+	err = bson.UnmarshalExtJSON(body, true, record)
+	if err != nil {
+		return nil, fmt.Errorf("解析死信 %s 错误: %v", id, err)
+	}
+	return record, nil
+}
+
+// Delete 删除死信文件
+func (fs *FileStore) Delete(id string) error {
+	err := os.Remove(fs.path(id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Close 关闭存储
+func (fs *FileStore) Close() error {
+	return nil
+}
+
+// 死信文件路径，id只取文件名部分，防止访问目录外的文件
+func (fs *FileStore) path(id string) string {
+	return filepath.Join(fs.dir, filepath.Base(id)+fileExt)
+}
+
+// 同步目录，保证重命名写入磁盘
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		logger.GlobalLogger.Debugw("同步死信目录错误", "err", err, "dir", dir)
+	}
+}
@@ -0,0 +1,93 @@
+package deadletter
+
+import (
+	"context"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* mongo集合存储，每条死信一个文档 */
+
+// MongoStore mongo集合存储
+type MongoStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoStore 创建mongo集合存储
+func NewMongoStore(uri, database, collection string) (*MongoStore, error) {
+	client, err := mongodb.InitClient(uri)
+	if err != nil {
+		return nil, err
+	}
+	return &MongoStore{
+		client:     client,
+		collection: client.Database(database).Collection(collection),
+	}, nil
+}
+
+// Put 按id写入
+func (ms *MongoStore) Put(record *Record) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := ms.collection.ReplaceOne(ctx, bson.M{"_id": record.ID}, record, options.Replace().SetUpsert(true))
+	return err
+}
+
+// List 按id顺序读取
+func (ms *MongoStore) List(key string) ([]*Record, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	filter := bson.M{}
+	if key != "" {
+		filter["key"] = key
+	}
+	cursor, err := ms.collection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	records := make([]*Record, 0)
+	err = cursor.All(ctx, &records)
+	return records, err
+}
+
+// Get 读取一条死信
+func (ms *MongoStore) Get(id string) (*Record, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	record := new(Record)
+	err := ms.collection.FindOne(ctx, bson.M{"_id": id}).Decode(record)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Delete 删除一条死信
+func (ms *MongoStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := ms.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Close 关闭连接
+func (ms *MongoStore) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return ms.client.Disconnect(ctx)
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// DocumentKey 文档唯一标识，保留原始bson
+// 支持任意类型的_id，分片集合还包含分片键字段
+type DocumentKey struct {
+	raw bson.Raw
+}
+
+// NewDocumentKey 由文档唯一标识字段创建，例如 bson.D{{Key: "_id", Value: id}}
+func NewDocumentKey(key interface{}) (DocumentKey, error) {
+	raw, err := bson.Marshal(key)
+	if err != nil {
+		return DocumentKey{}, err
+	}
+	return DocumentKey{raw: raw}, nil
+}
+
+// UnmarshalBSON 保留原始bson
+func (k *DocumentKey) UnmarshalBSON(data []byte) error {
+	k.raw = append(bson.Raw(nil), data...)
+	return nil
+}
+
+// MarshalBSON 输出原始bson
+func (k DocumentKey) MarshalBSON() ([]byte, error) {
+	if len(k.raw) == 0 {
+		return bson.Marshal(bson.D{})
+	}
+	return k.raw, nil
+}
+
+// MarshalJSON 输出mongo扩展json
+func (k DocumentKey) MarshalJSON() ([]byte, error) {
+	if len(k.raw) == 0 {
+		return []byte("null"), nil
+	}
+	return bson.MarshalExtJSON(k.raw, false, false)
+}
+
+// UnmarshalJSON 解析mongo扩展json
+func (k *DocumentKey) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		k.raw = nil
+		return nil
+	}
+	var raw bson.Raw
+	err := bson.UnmarshalExtJSON(data, false, &raw)
+	if err != nil {
+		return err
+	}
+	k.raw = raw
+	return nil
+}
+
+// IsZero 是否为空
+func (k DocumentKey) IsZero() bool {
+	// 空文档编码为5字节
+	return len(k.raw) <= 5
+}
+
+// Raw 原始bson
+func (k DocumentKey) Raw() bson.Raw {
+	return k.raw
+}
+
+// ID _id的值
+func (k DocumentKey) ID() interface{} {
+	return k.Value("_id")
+}
+
+// Value 指定字段的值，字段不存在时返回nil
+func (k DocumentKey) Value(field string) interface{} {
+	val, err := k.raw.LookupErr(field)
+	if err != nil {
+		return nil
+	}
+	var v interface{}
+	if err := val.Unmarshal(&v); err != nil {
+		return nil
+	}
+	return v
+}
+
+// IDString _id转换的唯一字符串，用于elasticsearch文档id等
+func (k DocumentKey) IDString() string {
+	return k.String("_id")
+}
+
+// String 指定字段值转换的唯一字符串
+// ObjectID为hex，字符串和整数为原值，其它类型为mongo扩展json
+func (k DocumentKey) String(field string) string {
+	val, err := k.raw.LookupErr(field)
+	if err != nil {
+		return ""
+	}
+	switch val.Type {
+	case bsontype.ObjectID:
+		return val.ObjectID().Hex()
+	case bsontype.String:
+		return val.StringValue()
+	case bsontype.Int32:
+		return strconv.FormatInt(int64(val.Int32()), 10)
+	case bsontype.Int64:
+		return strconv.FormatInt(val.Int64(), 10)
+	}
+	js, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: val}}, true, false)
+	if err != nil {
+		return fmt.Sprint(val)
+	}
+	// 去掉外层 {"v": 和 }
+	return string(js[5 : len(js)-1])
+}
+
+// Filter mongo查询条件，包含全部唯一标识字段
+func (k DocumentKey) Filter() bson.D {
+	filter := bson.D{}
+	elements, err := k.raw.Elements()
+	if err != nil {
+		return filter
+	}
+	for _, v := range elements {
+		filter = append(filter, bson.E{Key: v.Key(), Value: v.Value()})
+	}
+	return filter
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UpdateDescription 更新事件的字段变化
+type UpdateDescription struct {
+	UpdatedFields   bson.M           `bson:"updatedFields" json:"updatedFields"`
+	RemovedFields   []string         `bson:"removedFields" json:"removedFields"`
+	TruncatedArrays []TruncatedArray `bson:"truncatedArrays,omitempty" json:"truncatedArrays,omitempty"`
+}
+
+// TruncatedArray 被截短的数组字段，newSize为截短后的长度
+type TruncatedArray struct {
+	Field   string `bson:"field" json:"field"`
+	NewSize int32  `bson:"newSize" json:"newSize"`
+}
+
+// IsEmpty 没有任何字段变化
+func (d *UpdateDescription) IsEmpty() bool {
+	return d == nil || (len(d.UpdatedFields) == 0 && len(d.RemovedFields) == 0 && len(d.TruncatedArrays) == 0)
+}
+
+// Filter 只保留顶层字段满足条件的变化，用于同步字段过滤
+func (d *UpdateDescription) Filter(keep func(field string) bool) {
+	if d == nil {
+		return
+	}
+	for k, _ := range d.UpdatedFields {
+		if !keep(TopLevelField(k)) {
+			delete(d.UpdatedFields, k)
+		}
+	}
+	removedFields := d.RemovedFields[:0]
+	for _, v := range d.RemovedFields {
+		if keep(TopLevelField(v)) {
+			removedFields = append(removedFields, v)
+		}
+	}
+	d.RemovedFields = removedFields
+	truncatedArrays := d.TruncatedArrays[:0]
+	for _, v := range d.TruncatedArrays {
+		if keep(TopLevelField(v.Field)) {
+			truncatedArrays = append(truncatedArrays, v)
+		}
+	}
+	d.TruncatedArrays = truncatedArrays
+}
+
+// TopLevelField 点分路径的顶层字段，例如 a.b.0 为 a
+func TopLevelField(path string) string {
+	if i := strings.IndexByte(path, '.'); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
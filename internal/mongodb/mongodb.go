@@ -7,6 +7,8 @@ import (
 
 	"github.com/shiguanghuxian/mongodb-sync/internal/config"
 	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -58,6 +60,46 @@ func ping(client *mongo.Client) {
 
 }
 
+// OldestOplogTime 获取源mongo oplog中最早的集群时间，早于此时间的位置无法订阅
+func OldestOplogTime(ctx context.Context) (primitive.Timestamp, error) {
+	entry := struct {
+		Ts primitive.Timestamp `bson:"ts"`
+	}{}
+	findOptions := options.FindOne().SetSort(bson.M{"$natural": 1}).SetProjection(bson.M{"ts": 1})
+	err := SourceClient.Database("local").Collection("oplog.rs").FindOne(ctx, bson.M{}, findOptions).Decode(&entry)
+	return entry.Ts, err
+}
+
+// NewestOplogTime 获取源mongo oplog中最新的集群时间
+func NewestOplogTime(ctx context.Context) (primitive.Timestamp, error) {
+	entry := struct {
+		Ts primitive.Timestamp `bson:"ts"`
+	}{}
+	findOptions := options.FindOne().SetSort(bson.M{"$natural": -1}).SetProjection(bson.M{"ts": 1})
+	err := SourceClient.Database("local").Collection("oplog.rs").FindOne(ctx, bson.M{}, findOptions).Decode(&entry)
+	return entry.Ts, err
+}
+
+// OperationTime 获取源mongo当前的集群时间
+// 3.6、4.0的订阅在收到第一个事件前没有位置，全量同步前记录此时间，订阅中断后从此时间继续
+func OperationTime(ctx context.Context) (primitive.Timestamp, error) {
+	var ts primitive.Timestamp
+	err := SourceClient.UseSession(ctx, func(sessCtx mongo.SessionContext) error {
+		err := SourceClient.Database("admin").RunCommand(sessCtx, bson.M{"ping": 1}).Err()
+		if err != nil {
+			return err
+		}
+		if operationTime := sessCtx.OperationTime(); operationTime != nil {
+			ts = *operationTime
+		}
+		return nil
+	})
+	if err == nil && ts.IsZero() {
+		err = fmt.Errorf("源mongo没有返回operationTime")
+	}
+	return ts, err
+}
+
 // 注销源链接
 func DisconnectSourceClient() {
 	if SourceClient != nil {
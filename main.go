@@ -9,6 +9,7 @@ import (
 
 	"github.com/shiguanghuxian/mongodb-sync/internal/config"
 	"github.com/shiguanghuxian/mongodb-sync/program"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 var (
@@ -29,6 +30,21 @@ func main() {
 			fmt.Printf("VERSION: %s\nBUILD_TIME: %s\nGO_VERSION: %s\nGIT_HASH: %s\n", VERSION, BUILD_TIME, GO_VERSION, GIT_HASH)
 			return
 		}
+		// 回退结束位置到指定时间，下次启动时从此时间订阅
+		if os.Args[1] == "rewind" {
+			rewind(os.Args[2:])
+			return
+		}
+		// 删除一个同步配置的结束位置，下次启动时重新全量同步
+		if os.Args[1] == "backfill" {
+			backfill(os.Args[2:])
+			return
+		}
+		// 死信查看、重新写入和丢弃
+		if os.Args[1] == "dlq" {
+			dlq(os.Args[2:])
+			return
+		}
 	}
 
 	// 初始化配置文件
@@ -52,23 +68,138 @@ func main() {
 	go restart(cfgChan)
 
 	// 监听退出信号
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
 	<-c
 	P.Stop()
 	log.Println("Exit")
 }
 
+// 回退结束位置 rewind <sync配置key> <时间>
+func rewind(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: mongodb-sync rewind <sync配置key> <RFC3339时间|unix秒|秒:序号>")
+		os.Exit(1)
+	}
+	cfg, err := config.LoadConfig("")
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	err = program.Rewind(cfg, args[0], args[1])
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	log.Println("结束位置已回退，启动程序后从此时间开始订阅")
+}
+
+// 重新全量同步 backfill <sync配置key>
+func backfill(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: mongodb-sync backfill <sync配置key>")
+		os.Exit(1)
+	}
+	cfg, err := config.LoadConfig("")
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	err = program.Backfill(cfg, args[0])
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	log.Println("结束位置已删除，启动程序后重新全量同步")
+}
+
+// 死信命令 dlq list [sync配置key] | show <id> | redrive [--force] <id...|all> | discard <id...|all>
+func dlq(args []string) {
+	usage := "Usage:\n" +
+		"  mongodb-sync dlq list [sync配置key]\n" +
+		"  mongodb-sync dlq show <id>\n" +
+		"  mongodb-sync dlq redrive --force <id...|all>\n" +
+		"  mongodb-sync dlq discard <id...|all>"
+	if len(args) == 0 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	cfg, err := config.LoadConfig("")
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	// 重新写入可能回退文档状态，需要--force确认
+	force := false
+	if args[0] == "redrive" && len(args) >= 2 && args[1] == "--force" {
+		force = true
+		args = append(args[:1], args[2:]...)
+	}
+	// all表示全部死信
+	ids := args[1:]
+	if len(ids) == 1 && ids[0] == "all" {
+		ids = nil
+	}
+	switch {
+	case args[0] == "list" && len(args) <= 2:
+		key := ""
+		if len(args) == 2 {
+			key = args[1]
+		}
+		records, err := program.ListDeadLetters(cfg, key)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		for _, v := range records {
+			fmt.Printf("%s\t%s\tevents=%d\tattempts=%d\t%s\t%s\n", v.ID, v.Key, len(v.Events), v.Attempts, v.CreatedAt.Format(time.RFC3339), v.Error)
+		}
+		fmt.Printf("共 %d 条死信\n", len(records))
+	case args[0] == "show" && len(args) == 2:
+		record, err := program.GetDeadLetter(cfg, args[1])
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		js, err := bson.MarshalExtJSONIndent(record, false, false, "", "  ")
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(string(js))
+	case args[0] == "redrive" && len(args) >= 2:
+		count, err := program.RedriveDeadLetters(cfg, ids, force)
+		log.Printf("已重新写入 %d 条死信\n", count)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	case args[0] == "discard" && len(args) >= 2:
+		count, err := program.DiscardDeadLetters(cfg, ids)
+		log.Printf("已丢弃 %d 条死信\n", count)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+}
+
 // 重启应用
 func restart(cfgChan chan *config.Config) {
 	var err error
 	for {
 		cfg := <-cfgChan
-		P.Stop()
+		if P != nil {
+			P.Stop()
+		}
 		P, err = program.New(cfg)
 		if err != nil {
 			log.Println(err)
 			time.Sleep(time.Second)
+			continue
 		}
 		P.Run()
 	}
@@ -0,0 +1,101 @@
+package program
+
+import (
+	"strings"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* lastEventIds中除resume token外的特殊开始位置 */
+
+const (
+	CheckpointKeySeparator = "#" // sync配置key与订阅的collection之间的分隔符
+
+	OperationTimeKey = "startAtOperationTime" // 按时间开始订阅时，lastEventIds中存储的文档字段
+	StartAfterKey    = "startAfter"           // invalidate事件后重新订阅时，lastEventIds中存储的文档字段
+)
+
+// 结束位置key，每个sync配置的每个订阅单独记录结束位置
+// 订阅整个db或读取oplog时为sync配置key，逐个订阅collection时为 sync配置key#collection
+func checkpointKey(key, sourceCollection string) string {
+	if sourceCollection == "" {
+		return key
+	}
+	return key + CheckpointKeySeparator + sourceCollection
+}
+
+// 结束位置key是否属于此sync配置
+func isCheckpointKeyOf(checkpointKey, key string) bool {
+	return checkpointKey == key || strings.HasPrefix(checkpointKey, key+CheckpointKeySeparator)
+}
+
+// 配置了name的sync配置没有结束位置时，将按默认key记录的结束位置和全量同步进度改为name
+// 多个sync配置的默认key相同时无法区分，不迁移，返回需要从存储删除的旧key
+func migrateNamedCheckpoints(cfg *config.Config, lastEventIds map[string][]byte, progress map[string]*snapshotProgress) []string {
+	migratedKeys := make([]string, 0)
+	defaultKeys := make(map[string]int, len(cfg.Sync))
+	for _, v := range cfg.Sync {
+		defaultKeys[v.DefaultKey()]++
+	}
+	for _, v := range cfg.Sync {
+		key, defaultKey := v.GetKey(), v.DefaultKey()
+		if key == defaultKey || defaultKeys[defaultKey] > 1 {
+			continue
+		}
+		hasKey, hasDefaultKey := false, false
+		for k := range lastEventIds {
+			hasKey = hasKey || isCheckpointKeyOf(k, key)
+			hasDefaultKey = hasDefaultKey || isCheckpointKeyOf(k, defaultKey)
+		}
+		if hasKey || !hasDefaultKey {
+			continue
+		}
+		for k, val := range lastEventIds {
+			if isCheckpointKeyOf(k, defaultKey) {
+				lastEventIds[key+strings.TrimPrefix(k, defaultKey)] = val
+				delete(lastEventIds, k)
+				migratedKeys = append(migratedKeys, k)
+			}
+		}
+		if progress[defaultKey] != nil && progress[key] == nil {
+			progress[key] = progress[defaultKey]
+			delete(progress, defaultKey)
+		}
+		logger.GlobalLogger.Infow("结束位置已改为按name记录", "name", key, "default_key", defaultKey)
+	}
+	return migratedKeys
+}
+
+// 按时间开始订阅的位置，与resume token一样存储在lastEventIds中
+func operationTimeCheckpoint(ts primitive.Timestamp) []byte {
+	checkpoint, _ := bson.Marshal(bson.M{OperationTimeKey: ts})
+	return checkpoint
+}
+
+// 解析按时间开始订阅的位置，不是时间位置时返回false
+func parseOperationTimeCheckpoint(checkpoint []byte) (primitive.Timestamp, bool) {
+	val, err := bson.Raw(checkpoint).LookupErr(OperationTimeKey)
+	if err != nil {
+		return primitive.Timestamp{}, false
+	}
+	t, i, ok := val.TimestampOK()
+	return primitive.Timestamp{T: t, I: i}, ok
+}
+
+// invalidate事件之后开始订阅的位置，invalidate事件的resume token只能用于startAfter
+func startAfterCheckpoint(resumeToken []byte) []byte {
+	checkpoint, _ := bson.Marshal(bson.M{StartAfterKey: bson.Raw(resumeToken)})
+	return checkpoint
+}
+
+// 解析invalidate事件之后开始订阅的位置，不是此类位置时返回false
+func parseStartAfterCheckpoint(checkpoint []byte) (bson.Raw, bool) {
+	val, err := bson.Raw(checkpoint).LookupErr(StartAfterKey)
+	if err != nil {
+		return nil, false
+	}
+	return val.DocumentOK()
+}
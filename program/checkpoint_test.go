@@ -0,0 +1,66 @@
+package program
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+)
+
+func TestMigrateNamedCheckpoints(t *testing.T) {
+	syncCfg := func(name, destinationUri string) *config.SyncConfig {
+		return &config.SyncConfig{Name: name, Type: "es", DestinationUri: destinationUri, SourceDb: "src", DestinationDb: "dst"}
+	}
+	defaultKey := syncCfg("", "a").DefaultKey()
+	token := []byte("token")
+	tests := []struct {
+		name         string
+		sync         []*config.SyncConfig
+		lastEventIds map[string][]byte
+		progress     map[string]*snapshotProgress
+		wantIds      []string
+		wantProgress []string
+		wantMigrated []string
+	}{
+		{"migrate", []*config.SyncConfig{syncCfg("goods", "a")},
+			map[string][]byte{defaultKey: token, defaultKey + "#goods": token, "other": token},
+			map[string]*snapshotProgress{defaultKey: newSnapshotProgress()},
+			[]string{"goods", "goods#goods", "other"}, []string{"goods"}, []string{defaultKey, defaultKey + "#goods"}},
+		// name已有结束位置时不迁移
+		{"named exists", []*config.SyncConfig{syncCfg("goods", "a")},
+			map[string][]byte{defaultKey: token, "goods": token},
+			map[string]*snapshotProgress{},
+			[]string{defaultKey, "goods"}, []string{}, []string{}},
+		// 默认key相同无法区分
+		{"ambiguous", []*config.SyncConfig{syncCfg("goods", "a"), syncCfg("users", "a")},
+			map[string][]byte{defaultKey: token},
+			map[string]*snapshotProgress{defaultKey: newSnapshotProgress()},
+			[]string{defaultKey}, []string{defaultKey}, []string{}},
+		{"no name", []*config.SyncConfig{syncCfg("", "a")},
+			map[string][]byte{defaultKey: token},
+			map[string]*snapshotProgress{},
+			[]string{defaultKey}, []string{}, []string{}},
+	}
+	keys := func(m interface{}) []string {
+		list := make([]string, 0)
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			list = append(list, k.String())
+		}
+		sort.Strings(list)
+		return list
+	}
+	for _, tt := range tests {
+		migrated := migrateNamedCheckpoints(&config.Config{Sync: tt.sync}, tt.lastEventIds, tt.progress)
+		sort.Strings(migrated)
+		if got := keys(tt.lastEventIds); !reflect.DeepEqual(got, tt.wantIds) {
+			t.Errorf("%s: last event ids %v, want %v", tt.name, got, tt.wantIds)
+		}
+		if got := keys(tt.progress); !reflect.DeepEqual(got, tt.wantProgress) {
+			t.Errorf("%s: progress %v, want %v", tt.name, got, tt.wantProgress)
+		}
+		if !reflect.DeepEqual(migrated, tt.wantMigrated) {
+			t.Errorf("%s: migrated %v, want %v", tt.name, migrated, tt.wantMigrated)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package consumers
 
 import (
-	"log"
+	"context"
 	"time"
 
 	"github.com/shiguanghuxian/mongodb-sync/internal/config"
@@ -16,49 +16,165 @@ const (
 	TimeoutCtx = 3 * time.Second
 )
 
+// Consumer 消费者，将事件写入一个目标，由注册的Factory创建
 type Consumer interface {
-	// 初始化连接
-	InitClient(cfg *config.SyncConfig) error
+	// 处理一条事件，返回错误表示没有写入目标，需要重试
+	HandleData(ctx context.Context, data *models.ChangeEvent) error
+	// 删除不需要同步的字段
+	FilterField(collection string, document bson.M) error
+	// 支持的能力
+	Capabilities() Capabilities
+	// 检查目标是否可用
+	Health(ctx context.Context) error
 	// 销毁连接
 	Disconnect() error
-	// 处理一条消息
-	HandleData(data *models.ChangeEvent) error
-	// 删除无用
-	FilterField(collection string, document bson.M) error
 }
 
-var (
-	ConsumerMap = make(map[string]Consumer) // 下标为一个sync配置
-)
+// TransactionConsumer 支持事务的消费者，同一个源事务的多条事件在一个目标事务中处理
+type TransactionConsumer interface {
+	HandleTransaction(ctx context.Context, data []*models.ChangeEvent) error
+}
+
+// BatchConsumer 支持批量写入的消费者，一批事件为不同源事务的增删改，按顺序写入
+type BatchConsumer interface {
+	HandleBatch(ctx context.Context, data []*models.ChangeEvent) error
+}
+
+// Capabilities 消费者支持的能力
+type Capabilities struct {
+	Transaction bool // 同一个源事务的事件在目标事务中处理，需要实现TransactionConsumer
+	Batch       bool // 一批事件合并写入，需要实现BatchConsumer
+	DeltaUpdate bool // 按updateDescription精确更新，支持update_mode为delta
+	Rename      bool // 同步来源集合重命名
+	Drop        bool // 同步来源集合删除
+}
+
+// 发送到webhook、kafka等目标的事件，带有目标db和集合
+type eventMessage struct {
+	Db         string              `json:"db"`
+	Collection string              `json:"collection"`
+	Event      *models.ChangeEvent `json:"event"`
+}
+
+func newEventMessage(cfg *config.SyncConfig, data *models.ChangeEvent) *eventMessage {
+	return &eventMessage{
+		Db:         cfg.DestinationDb,
+		Collection: cfg.GetDestinationCollection(data.Namespace.Coll),
+		Event:      data,
+	}
+}
+
+// 重命名事件对应的目标新名称，跨db重命名或未开启重命名时返回false
+func renameDestination(cfg *config.SyncConfig, data *models.ChangeEvent) (string, bool) {
+	if !cfg.DDL.RenameEnabled() {
+		logger.GlobalLogger.Infow("未开启重命名，忽略重命名事件", "namespace", data.Namespace, "to", data.NewCollectionName, "cfg", cfg)
+		return "", false
+	}
+	db, coll := data.RenameTo()
+	if db != cfg.SourceDb || coll == "" {
+		logger.GlobalLogger.Warnw("跨db重命名，忽略重命名事件", "namespace", data.Namespace, "to", data.NewCollectionName, "cfg", cfg)
+		return "", false
+	}
+	return cfg.GetDestinationCollection(coll), true
+}
+
+// 删除事件的处理方式和影响的来源集合，删除db时为全部同步的集合
+func dropCollections(cfg *config.SyncConfig, data *models.ChangeEvent) (string, []string) {
+	action := cfg.DDL.DropAction()
+	if action == config.DDLDropIgnore {
+		logger.GlobalLogger.Infow("未开启删除，忽略删除事件", "operation", data.Operation, "namespace", data.Namespace, "cfg", cfg)
+		return action, nil
+	}
+	if data.Operation != "dropDatabase" {
+		return action, []string{data.Namespace.Coll}
+	}
+	collections := make([]string, 0, len(cfg.Collections))
+	for k, _ := range cfg.Collections {
+		collections = append(collections, k)
+	}
+	return action, collections
+}
 
-// 注册消费者
-func registerConsumer(key string, consumer Consumer) {
-	if consumer == nil {
-		log.Println("消费者不能为nil")
-		return
+// 按消费者的字段过滤规则过滤更新事件的字段变化，以顶层字段判断
+func filterUpdates(consumer Consumer, collection string, updates *models.UpdateDescription) error {
+	if updates.IsEmpty() {
+		return nil
+	}
+	fields := bson.M{}
+	for k, _ := range updates.UpdatedFields {
+		fields[models.TopLevelField(k)] = nil
+	}
+	for _, v := range updates.RemovedFields {
+		fields[models.TopLevelField(v)] = nil
 	}
-	ConsumerMap[key] = consumer
+	for _, v := range updates.TruncatedArrays {
+		fields[models.TopLevelField(v.Field)] = nil
+	}
+	err := consumer.FilterField(collection, fields)
+	if err != nil {
+		return err
+	}
+	updates.Filter(func(field string) bool {
+		_, ok := fields[field]
+		return ok
+	})
+	return nil
 }
 
-// 删除一个消费者
-func unRegisterConsumer(key string) {
-	ConsumerMap[key] = nil
+// 按消费者的字段过滤规则过滤一组事件
+func filterEvents(consumer Consumer, data []*models.ChangeEvent) {
+	for _, event := range data {
+		err := consumer.FilterField(event.Namespace.Coll, event.Document)
+		if err == nil {
+			err = consumer.FilterField(event.Namespace.Coll, event.DocumentBefore)
+		}
+		if err == nil {
+			err = filterUpdates(consumer, event.Namespace.Coll, event.Updates)
+		}
+		if err != nil {
+			logger.GlobalLogger.Errorw("一个消费对象过滤字段出现错误", "err", err, "namespace", event.Namespace)
+		}
+	}
+}
+
+// HandleBatch 批量处理消息，多条事件为不同源事务，消费者不支持批量写入时逐条处理
+// 返回错误表示这批事件没有全部写入目标，需要重试
+func HandleBatch(ctx context.Context, consumer Consumer, data []*models.ChangeEvent) error {
+	filterEvents(consumer, data)
+	if batchConsumer, ok := consumer.(BatchConsumer); ok && consumer.Capabilities().Batch {
+		err := batchConsumer.HandleBatch(ctx, data)
+		if err != nil {
+			logger.GlobalLogger.Errorw("一个消费对象批量处理出现错误", "err", err, "count", len(data))
+		}
+		return err
+	}
+	return handleEach(ctx, consumer, data)
+}
+
+// HandleData 统一处理消息，多条事件为同一个源事务
+// 返回错误表示事件没有全部写入目标，需要重试
+func HandleData(ctx context.Context, consumer Consumer, data []*models.ChangeEvent) error {
+	// 过滤字段
+	filterEvents(consumer, data)
+	// 源事务在目标事务中处理
+	if txnConsumer, ok := consumer.(TransactionConsumer); ok && consumer.Capabilities().Transaction && len(data) > 1 {
+		err := txnConsumer.HandleTransaction(ctx, data)
+		if err != nil {
+			logger.GlobalLogger.Errorw("一个消费对象处理事务出现错误", "err", err, "count", len(data))
+		}
+		return err
+	}
+	return handleEach(ctx, consumer, data)
 }
 
-// 统一处理消息
-func HandleData(key string, data *models.ChangeEvent) {
-	for k, v := range ConsumerMap {
-		if k == key {
-			// 过滤字段
-			err := v.FilterField(data.Namespace.Coll, data.Document)
-			if err != nil {
-				logger.GlobalLogger.Errorw("一个消费对象过滤字段出现错误", "err", err, "key", k, "namespace", data.Namespace)
-			}
-			// 交给对应消费者处理
-			err = v.HandleData(data)
-			if err != nil {
-				logger.GlobalLogger.Errorw("一个消费对象处理出现错误", "err", err, "key", k, "namespace", data.Namespace)
-			}
+// 逐条交给消费者处理
+func handleEach(ctx context.Context, consumer Consumer, data []*models.ChangeEvent) error {
+	for _, event := range data {
+		err := consumer.HandleData(ctx, event)
+		if err != nil {
+			logger.GlobalLogger.Errorw("一个消费对象处理出现错误", "err", err, "namespace", event.Namespace)
+			return err
 		}
 	}
+	return nil
 }
@@ -0,0 +1,36 @@
+package consumers
+
+import (
+	"os"
+	"testing"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// 测试不写日志文件
+	logger.GlobalLogger = &logger.Logger{SugaredLogger: zap.NewNop().Sugar()}
+	os.Exit(m.Run())
+}
+
+// 测试用事件，文档唯一标识为 {_id: id}
+func testEvent(t *testing.T, operation, collection string, id interface{}, document bson.M) *models.ChangeEvent {
+	t.Helper()
+	data := &models.ChangeEvent{
+		Operation: operation,
+		Document:  document,
+	}
+	data.Namespace.Db = "src"
+	data.Namespace.Coll = collection
+	if id != nil {
+		documentKey, err := models.NewDocumentKey(bson.D{{Key: "_id", Value: id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data.DocumentKey = documentKey
+	}
+	return data
+}
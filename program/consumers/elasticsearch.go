@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/olivere/elastic"
@@ -17,25 +19,44 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 )
 
+const TypeElasticsearch = "elasticsearch"
+
+func init() {
+	Register(TypeElasticsearch, NewElasticsearchConsumer)
+}
+
 /* elasticsearch目标数据落地 */
 type ElasticsearchConsumer struct {
-	client *elastic.Client
-	cfg    *config.SyncConfig
-	Index  string
+	client  *elastic.Client
+	cfg     *config.SyncConfig
+	options *ElasticsearchOptions
+	Index   string
+}
+
+// ElasticsearchOptions elasticsearch目标专有配置 [sync.options]
+type ElasticsearchOptions struct {
+	Sniff        bool   `json:"sniff"`          // 是否自动发现集群节点，默认false
+	Username     string `json:"username"`       // basic auth用户名
+	Password     string `json:"password"`       // basic auth密码
+	IndexJsonDir string `json:"index_json_dir"` // 创建索引json所在目录，文件名为 索引名.json，默认./config/elasticsearch
 }
 
 // NewElasticsearchConsumer 创建一个elasticsearch消费对象
-func NewElasticsearchConsumer(cfg *config.SyncConfig) error {
+func NewElasticsearchConsumer(cfg *config.SyncConfig) (Consumer, error) {
 	elasticsearchConsumer := &ElasticsearchConsumer{
-		cfg:   cfg,
-		Index: cfg.DestinationDb,
+		cfg:     cfg,
+		options: &ElasticsearchOptions{IndexJsonDir: "./config/elasticsearch"},
+		Index:   cfg.DestinationDb,
 	}
-	err := elasticsearchConsumer.InitClient(cfg)
+	err := cfg.DecodeOptions(elasticsearchConsumer.options)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	registerConsumer(cfg.GetKey(), elasticsearchConsumer)
-	return nil
+	err = elasticsearchConsumer.InitClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return elasticsearchConsumer, nil
 }
 
 // 初始化连接
@@ -44,7 +65,15 @@ func (ec *ElasticsearchConsumer) InitClient(cfg *config.SyncConfig) error {
 		return errors.New("elasticsearch目标db链接配置错误")
 	}
 	address := strings.Split(cfg.DestinationUri, ";")
-	esClient, err := elastic.NewClient(elastic.SetURL(address...), elastic.SetSniff(false), elastic.SetErrorLog(log.New(os.Stdout, "ES-ERROR: ", 0)))
+	clientOptions := []elastic.ClientOptionFunc{
+		elastic.SetURL(address...),
+		elastic.SetSniff(ec.options.Sniff),
+		elastic.SetErrorLog(log.New(os.Stdout, "ES-ERROR: ", 0)),
+	}
+	if ec.options.Username != "" {
+		clientOptions = append(clientOptions, elastic.SetBasicAuth(ec.options.Username, ec.options.Password))
+	}
+	esClient, err := elastic.NewClient(clientOptions...)
 	if err != nil {
 		return err
 	}
@@ -54,6 +83,29 @@ func (ec *ElasticsearchConsumer) InitClient(cfg *config.SyncConfig) error {
 	return err
 }
 
+// Capabilities elasticsearch不支持事务，多个集合共用一个索引，type无法重命名
+func (ec *ElasticsearchConsumer) Capabilities() Capabilities {
+	return Capabilities{
+		Batch:       true,
+		DeltaUpdate: true,
+		Drop:        true,
+	}
+}
+
+// Health 检查集群状态，red时不可用
+func (ec *ElasticsearchConsumer) Health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+	defer cancel()
+	res, err := ec.client.ClusterHealth().Do(ctx)
+	if err != nil {
+		return err
+	}
+	if res.Status == "red" {
+		return fmt.Errorf("elasticsearch集群状态为%s", res.Status)
+	}
+	return nil
+}
+
 // 初始创建化索引 - 当索引不存在时
 func (ec *ElasticsearchConsumer) initCreateIndexs() error {
 	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
@@ -67,7 +119,7 @@ func (ec *ElasticsearchConsumer) initCreateIndexs() error {
 		return nil
 	}
 	// 查看创建索引json是否存在
-	createIndexJsonPath := fmt.Sprintf("./config/elasticsearch/%s.json", ec.Index)
+	createIndexJsonPath := filepath.Join(ec.options.IndexJsonDir, ec.Index+".json")
 	isExist, err := common.PathExists(createIndexJsonPath)
 	if err != nil {
 		logger.GlobalLogger.Errorw("查看创建索引json是否存在错误", "err", err, "index", ec.Index, "create_index_json_path", createIndexJsonPath)
@@ -95,19 +147,76 @@ func (ec *ElasticsearchConsumer) initCreateIndexs() error {
 
 // 销毁连接
 func (ec *ElasticsearchConsumer) Disconnect() error {
-	// 注销
-	unRegisterConsumer(ec.cfg.GetKey())
+	return nil
+}
+
+// HandleBatch 一批消息合并为一个bulk请求写入，不单独flush
+func (ec *ElasticsearchConsumer) HandleBatch(ctx context.Context, data []*models.ChangeEvent) error {
+	log.Println("elasticsearch批量处理收到数据", len(data))
+	bulkRequest := ec.client.Bulk()
+	for _, v := range data {
+		typeName := ec.cfg.GetDestinationCollection(v.Namespace.Coll)
+		id := v.DocumentKey.IDString()
+		switch v.Operation {
+		case "insert":
+			bulkRequest.Add(elastic.NewBulkUpdateRequest().Index(ec.Index).Type(typeName).Id(id).Doc(v.Document).DocAsUpsert(true))
+		case "update":
+			bulkRequest.Add(ec.updateRequest(v, typeName))
+		case "delete":
+			bulkRequest.Add(elastic.NewBulkDeleteRequest().Index(ec.Index).Type(typeName).Id(id))
+		case "replace":
+			bulkRequest.Add(elastic.NewBulkIndexRequest().Index(ec.Index).Type(typeName).Id(id).Doc(v.Document))
+		default:
+			// 表结构变化等事件不会合并到批次中，按单条处理
+			if err := ec.HandleData(ctx, v); err != nil {
+				return err
+			}
+		}
+	}
+	if bulkRequest.NumberOfActions() == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+	defer cancel()
+	bulkResponse, err := bulkRequest.Do(ctx)
+	if err != nil {
+		logger.GlobalLogger.Errorw("elasticsearch批量写入错误", "err", err, "count", len(data), "cfg", ec.cfg)
+		return err
+	}
+	err = ec.bulkFailed(bulkResponse)
+	if err != nil {
+		logger.GlobalLogger.Errorw("elasticsearch批量写入部分失败", "err", err, "count", len(data), "cfg", ec.cfg)
+		return err
+	}
+	log.Println("elasticsearch批量写入成功", len(bulkResponse.Succeeded()))
+	return nil
+}
+
+// bulk响应中第一个失败的条目转换为错误，按状态码区分永久错误和临时错误
+func (ec *ElasticsearchConsumer) bulkFailed(bulkResponse *elastic.BulkResponse) error {
+	for _, v := range bulkResponse.Failed() {
+		// 删除不存在的文档返回404，不算失败
+		if v.Status == 404 && v.Error == nil {
+			continue
+		}
+		// delta模式没有变更后文档时更新请求没有upsert，目标文档不存在时重试无法解决，与其它目标一样跳过
+		if v.Error != nil && v.Error.Type == "document_missing_exception" {
+			logger.GlobalLogger.Warnw("目标文档不存在且没有变更后文档，跳过更新", "type", v.Type, "id", v.Id, "cfg", ec.cfg)
+			continue
+		}
+		return fmt.Errorf("elasticsearch批量写入部分失败 id:%s: %w", v.Id, &elastic.Error{Status: v.Status, Details: v.Error})
+	}
 	return nil
 }
 
 // 处理一条消息
-func (ec *ElasticsearchConsumer) HandleData(data *models.ChangeEvent) error {
+func (ec *ElasticsearchConsumer) HandleData(ctx context.Context, data *models.ChangeEvent) error {
 	log.Println("elasticsearch处理收到数据", data.Namespace.Db, data.Namespace.Coll, data.Operation)
 	var err error
 	// 保证每次数据写入成功
 	defer func() {
 		if err == nil {
-			ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+			ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
 			defer cancel()
 			_, err = ec.client.Flush().Index(ec.Index).Do(ctx)
 			if err != nil {
@@ -125,15 +234,20 @@ func (ec *ElasticsearchConsumer) HandleData(data *models.ChangeEvent) error {
 	// 根据操作不同处理
 	switch data.Operation {
 	case "insert":
-		err = ec.insert(data, typeName)
+		err = ec.insert(ctx, data, typeName)
 	case "update":
-		err = ec.update(data, typeName)
+		err = ec.update(ctx, data, typeName)
 	case "delete":
-		err = ec.delete(data, typeName)
+		err = ec.delete(ctx, data, typeName)
 	case "replace":
-		err = ec.replace(data, typeName)
+		err = ec.replace(ctx, data, typeName)
+	case "drop", "dropDatabase":
+		err = ec.drop(ctx, data)
+	case "rename":
+		// 多个集合共用一个索引，type无法重命名
+		logger.GlobalLogger.Warnw("elasticsearch不支持重命名type，忽略重命名事件", "namespace", data.Namespace, "to", data.NewCollectionName, "cfg", ec.cfg)
 	default:
-		err = errors.New("未知事件类型")
+		err = Permanent(errors.New("未知事件类型"))
 		return err
 	}
 	if err != nil {
@@ -158,57 +272,184 @@ func (ec *ElasticsearchConsumer) FilterField(collection string, document bson.M)
 }
 
 // 插入es一条数据 - 未来可优化为批量插入 - 需要考虑时间和数据一致性
-func (ec *ElasticsearchConsumer) insert(data *models.ChangeEvent, typeName string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+func (ec *ElasticsearchConsumer) insert(ctx context.Context, data *models.ChangeEvent, typeName string) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
 	defer cancel()
 	bulkRequest := ec.client.Bulk()
-	bulkRequest.Add(elastic.NewBulkUpdateRequest().Index(ec.Index).Type(typeName).Id(data.DocumentKey.ID.Hex()).Doc(data.Document).DocAsUpsert(true))
+	bulkRequest.Add(elastic.NewBulkUpdateRequest().Index(ec.Index).Type(typeName).Id(data.DocumentKey.IDString()).Doc(data.Document).DocAsUpsert(true))
 	bulkResponse, err := bulkRequest.Do(ctx)
 	if err != nil {
 		logger.GlobalLogger.Errorw("数据插入elasticsearch错误", "err", err, "data", data, "cfg", ec.cfg)
 		return err
 	}
+	err = ec.bulkFailed(bulkResponse)
+	if err != nil {
+		logger.GlobalLogger.Errorw("数据插入elasticsearch错误", "err", err, "data", data, "cfg", ec.cfg)
+		return err
+	}
 	log.Println("创建文档数", len(bulkResponse.Succeeded()))
 	return nil
 }
 
 // 更新数据
-func (ec *ElasticsearchConsumer) update(data *models.ChangeEvent, typeName string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+func (ec *ElasticsearchConsumer) update(ctx context.Context, data *models.ChangeEvent, typeName string) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
 	defer cancel()
 	// 更新数据
 	bulkRequest := ec.client.Bulk()
-	bulkRequest.Add(elastic.NewBulkUpdateRequest().Index(ec.Index).Type(typeName).Id(data.DocumentKey.ID.Hex()).Doc(data.Document).DocAsUpsert(true))
+	bulkRequest.Add(ec.updateRequest(data, typeName))
 	bulkResponse, err := bulkRequest.Do(ctx)
 	if err != nil {
 		logger.GlobalLogger.Errorw("更新elasticsearch数据错误", "err", err, "data", data, "cfg", ec.cfg)
 		return err
 	}
+	err = ec.bulkFailed(bulkResponse)
+	if err != nil {
+		logger.GlobalLogger.Errorw("更新elasticsearch数据错误", "err", err, "data", data, "cfg", ec.cfg)
+		return err
+	}
 	log.Println("更新文档数", len(bulkResponse.Updated()))
 	return nil
 }
 
+// 更新请求，文档不存在时插入
+func (ec *ElasticsearchConsumer) updateRequest(data *models.ChangeEvent, typeName string) *elastic.BulkUpdateRequest {
+	updateRequest := elastic.NewBulkUpdateRequest().Index(ec.Index).Type(typeName).Id(data.DocumentKey.IDString())
+	if ec.cfg.GetUpdateMode() == config.UpdateModeDelta && data.Updates != nil {
+		// 按字段变化局部更新，文档不存在时使用变更后文档创建
+		updateRequest.Script(deltaUpdateScript(data.Updates))
+		if data.Document != nil {
+			updateRequest.Upsert(data.Document)
+		}
+	} else {
+		updateRequest.Doc(data.Document).DocAsUpsert(true)
+	}
+	return updateRequest
+}
+
+// 按updateDescription局部更新文档的脚本，依次截短数组、更新字段、删除字段
+// 字段为点分路径，数字表示数组下标
+const deltaUpdateSource = `
+def parent(def root, String path) {
+	String[] parts = path.splitOnToken('.');
+	def obj = root;
+	for (int i = 0; i < parts.length - 1 && obj != null; i++) {
+		def next = obj instanceof List ? obj.get(Integer.parseInt(parts[i])) : obj.get(parts[i]);
+		if (next == null && obj instanceof Map) {
+			next = new HashMap();
+			obj.put(parts[i], next);
+		}
+		obj = next;
+	}
+	return obj;
+}
+String last(String path) {
+	String[] parts = path.splitOnToken('.');
+	return parts[parts.length - 1];
+}
+for (def item : params.truncated) {
+	def obj = parent(ctx._source, item.field);
+	def list = obj instanceof Map ? obj.get(last(item.field)) : null;
+	while (list instanceof List && list.size() > item.newSize) {
+		list.remove(list.size() - 1);
+	}
+}
+for (def entry : params.updated.entrySet()) {
+	def obj = parent(ctx._source, entry.getKey());
+	if (obj instanceof List) {
+		int index = Integer.parseInt(last(entry.getKey()));
+		if (index < obj.size()) {
+			obj.set(index, entry.getValue());
+		} else {
+			obj.add(entry.getValue());
+		}
+	} else if (obj != null) {
+		obj.put(last(entry.getKey()), entry.getValue());
+	}
+}
+for (def field : params.removed) {
+	def obj = parent(ctx._source, field);
+	if (obj instanceof Map) {
+		obj.remove(last(field));
+	}
+}
+`
+
+// 局部更新脚本及参数
+func deltaUpdateScript(updates *models.UpdateDescription) *elastic.Script {
+	updated := updates.UpdatedFields
+	if updated == nil {
+		updated = bson.M{}
+	}
+	removed := updates.RemovedFields
+	if removed == nil {
+		removed = []string{}
+	}
+	truncated := updates.TruncatedArrays
+	if truncated == nil {
+		truncated = []models.TruncatedArray{}
+	}
+	return elastic.NewScript(deltaUpdateSource).Lang("painless").Params(map[string]interface{}{
+		"updated":   updated,
+		"removed":   removed,
+		"truncated": truncated,
+	})
+}
+
 // 删除一条数据
-func (ec *ElasticsearchConsumer) delete(data *models.ChangeEvent, typeName string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+func (ec *ElasticsearchConsumer) delete(ctx context.Context, data *models.ChangeEvent, typeName string) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
 	defer cancel()
 	bulkRequest := ec.client.Bulk()
-	bulkRequest.Add(elastic.NewBulkDeleteRequest().Index(ec.Index).Type(typeName).Id(data.DocumentKey.ID.Hex()))
+	bulkRequest.Add(elastic.NewBulkDeleteRequest().Index(ec.Index).Type(typeName).Id(data.DocumentKey.IDString()))
 	bulkResponse, err := bulkRequest.Do(ctx)
 	if err != nil {
 		logger.GlobalLogger.Errorw("删除elasticsearch数据错误", "err", err, "data", data, "cfg", ec.cfg)
 		return err
 	}
+	err = ec.bulkFailed(bulkResponse)
+	if err != nil {
+		logger.GlobalLogger.Errorw("删除elasticsearch数据错误", "err", err, "data", data, "cfg", ec.cfg)
+		return err
+	}
 	log.Println("删除文档数", len(bulkResponse.Deleted()))
 	return nil
 }
 
 // 替换全部文档内容时，先删后加
-func (ec *ElasticsearchConsumer) replace(data *models.ChangeEvent, typeName string) error {
-	err := ec.delete(data, typeName)
+func (ec *ElasticsearchConsumer) replace(ctx context.Context, data *models.ChangeEvent, typeName string) error {
+	err := ec.delete(ctx, data, typeName)
 	if err != nil {
 		return err
 	}
-	err = ec.insert(data, typeName)
+	err = ec.insert(ctx, data, typeName)
 	return err
 }
+
+// 来源集合或db删除，删除索引中对应type的全部文档
+// 多个集合共用一个索引，drop和truncate都只删除文档，不删除索引
+func (ec *ElasticsearchConsumer) drop(ctx context.Context, data *models.ChangeEvent) error {
+	action, collections := dropCollections(ec.cfg, data)
+	for _, v := range collections {
+		ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+		typeName := ec.cfg.GetDestinationCollection(v)
+		res, err := ec.client.DeleteByQuery(ec.Index).Type(typeName).Query(elastic.NewMatchAllQuery()).Do(ctx)
+		cancel()
+		if err != nil {
+			logger.GlobalLogger.Errorw("elasticsearch删除type文档错误", "err", err, "action", action, "type", typeName, "cfg", ec.cfg)
+			return err
+		}
+		log.Println("elasticsearch删除type文档成功", action, typeName, res.Deleted)
+	}
+	return nil
+}
+
+// IsPermanentError elasticsearch返回400(映射冲突、文档格式错误等)和413为永久错误
+// 429限流、409版本冲突、403只读索引、5xx以及连接错误为临时错误
+func (ec *ElasticsearchConsumer) IsPermanentError(err error) bool {
+	var esErr *elastic.Error
+	if !errors.As(err, &esErr) {
+		return false
+	}
+	return esErr.Status == http.StatusBadRequest || esErr.Status == http.StatusRequestEntityTooLarge
+}
@@ -0,0 +1,98 @@
+package consumers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+/* 写入目标错误分类，永久错误(例如映射冲突、错误的sql)重试无法解决，临时错误(超时、限流、网络)重试后可能成功 */
+
+// ErrorClassifier 区分目标返回的永久错误和临时错误的消费者
+type ErrorClassifier interface {
+	// 是否为永久错误
+	IsPermanentError(err error) bool
+}
+
+// 标记为永久错误的错误
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent 标记为永久错误，例如事件无法转换为目标格式
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// 目标要求等待指定时间后重试的错误
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// WithRetryAfter 标记目标要求的最短重试间隔，例如http响应的Retry-After
+func WithRetryAfter(err error, delay time.Duration) error {
+	if err == nil || delay <= 0 {
+		return err
+	}
+	return &retryAfterError{err: err, delay: delay}
+}
+
+// RetryAfter 目标要求的最短重试间隔，没有要求时返回false
+func RetryAfter(err error) (time.Duration, bool) {
+	var re *retryAfterError
+	if errors.As(err, &re) {
+		return re.delay, true
+	}
+	return 0, false
+}
+
+// IsPermanentError 判断消费者返回的错误是否为永久错误
+// 超时、网络错误为临时错误，其余由消费者判断，无法判断时视为临时错误，重试而不是跳过
+func IsPermanentError(consumer Consumer, err error) bool {
+	if err == nil {
+		return false
+	}
+	var pe *permanentError
+	if errors.As(err, &pe) {
+		return true
+	}
+	if isTransientError(err) {
+		return false
+	}
+	if classifier, ok := consumer.(ErrorClassifier); ok {
+		return classifier.IsPermanentError(err)
+	}
+	return false
+}
+
+// 通用的临时错误
+func isTransientError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -1,11 +1,14 @@
 package consumers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/shiguanghuxian/mongodb-sync/internal/config"
 	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
@@ -17,26 +20,45 @@ import (
 /* 订阅mongo更新日志，写入日志文件类似oplog，便于数据回滚 */
 
 const (
-	BasePath    = "./oplog/" // 输出根目录
-	FileMaxSize = 100
+	TypeFile    = "file"
+	BasePath    = "./oplog/" // 默认输出根目录
+	FileMaxSize = 100        // 默认单个文件最大MB
 )
 
+func init() {
+	Register(TypeFile, NewFileLogConsumer)
+}
+
 type FileLogConsumer struct {
 	cfg         *config.SyncConfig
+	options     *FileLogOptions
 	filepath    string
 	oplogWriter *lumberjack.Logger
 }
 
-func NewFileLogConsumer(cfg *config.SyncConfig) error {
+// FileLogOptions file目标专有配置 [sync.options]
+type FileLogOptions struct {
+	Dir     string `json:"dir"`      // 输出根目录，默认./oplog/
+	MaxSize int    `json:"max_size"` // 单个文件最大MB，超过后切割压缩，默认100
+}
+
+func NewFileLogConsumer(cfg *config.SyncConfig) (Consumer, error) {
 	fileLogConsumer := &FileLogConsumer{
-		cfg: cfg,
+		cfg:     cfg,
+		options: &FileLogOptions{Dir: BasePath, MaxSize: FileMaxSize},
 	}
-	err := fileLogConsumer.InitClient(cfg)
+	err := cfg.DecodeOptions(fileLogConsumer.options)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	registerConsumer(cfg.GetKey(), fileLogConsumer)
-	return nil
+	if fileLogConsumer.options.MaxSize <= 0 {
+		return nil, errors.New("file配置max_size必须大于0")
+	}
+	err = fileLogConsumer.InitClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return fileLogConsumer, nil
 }
 
 // 初始化连接
@@ -45,22 +67,48 @@ func (fl *FileLogConsumer) InitClient(cfg *config.SyncConfig) error {
 		return errors.New("file输出文件名(destination_db)配置不能为空错误")
 	}
 	// 创建输出目录
-	err := os.MkdirAll(BasePath, os.ModePerm)
+	err := os.MkdirAll(fl.options.Dir, os.ModePerm)
 	if err != nil {
-		logger.GlobalLogger.Errorw("oplog根目录创建失败", "err", err, "path", BasePath)
+		logger.GlobalLogger.Errorw("oplog根目录创建失败", "err", err, "path", fl.options.Dir)
 		return err
 	}
-	fl.filepath = fmt.Sprintf("%s%s-to-%s.oplog", BasePath, cfg.SourceDb, cfg.DestinationDb)
+	fl.filepath = filepath.Join(fl.options.Dir, fileLogName(cfg))
 	// 初始化日志输出，定期整理压缩
 	fl.oplogWriter = &lumberjack.Logger{
 		Filename:  fl.filepath,
-		MaxSize:   FileMaxSize,
+		MaxSize:   fl.options.MaxSize,
 		LocalTime: true,
 		Compress:  true,
 	}
 	return nil
 }
 
+// 输出文件名，配置了name时以name开头，多个同步配置的来源db和目标db相同时不会写入同一个文件
+// 未配置name时沿用 来源db-to-目标db.oplog
+func fileLogName(cfg *config.SyncConfig) string {
+	name := fmt.Sprintf("%s-to-%s.oplog", cfg.SourceDb, cfg.DestinationDb)
+	if cfg.Name == "" {
+		return name
+	}
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(cfg.Name) + "-" + name
+}
+
+// Capabilities 文件原样记录所有事件
+func (fl *FileLogConsumer) Capabilities() Capabilities {
+	return Capabilities{
+		Batch:       true,
+		DeltaUpdate: true,
+		Rename:      true,
+		Drop:        true,
+	}
+}
+
+// Health 检查输出目录是否可访问
+func (fl *FileLogConsumer) Health(ctx context.Context) error {
+	_, err := os.Stat(fl.options.Dir)
+	return err
+}
+
 // 销毁连接
 func (fl *FileLogConsumer) Disconnect() error {
 	if fl.oplogWriter != nil {
@@ -74,7 +122,7 @@ func (fl *FileLogConsumer) Disconnect() error {
 }
 
 // 处理一条消息
-func (fl *FileLogConsumer) HandleData(data *models.ChangeEvent) error {
+func (fl *FileLogConsumer) HandleData(ctx context.Context, data *models.ChangeEvent) error {
 	if data == nil {
 		return errors.New("file处理收到数据为nil")
 	}
@@ -94,6 +142,28 @@ func (fl *FileLogConsumer) HandleData(data *models.ChangeEvent) error {
 	return nil
 }
 
+// HandleBatch 一批消息合并为一次写入
+func (fl *FileLogConsumer) HandleBatch(ctx context.Context, data []*models.ChangeEvent) error {
+	log.Println("file批量处理收到数据", len(data))
+	body := make([]byte, 0)
+	for _, v := range data {
+		js, err := json.Marshal(v)
+		if err != nil {
+			logger.GlobalLogger.Errorw("file处理收到数据转json错误", "err", err, "data", v)
+			return err
+		}
+		body = append(body, js...)
+		body = append(body, '\n')
+	}
+	n, err := fl.oplogWriter.Write(body)
+	if err != nil {
+		logger.GlobalLogger.Errorw("file批量处理收到数据存储到oplog文件错误", "err", err, "count", len(data))
+		return err
+	}
+	logger.GlobalLogger.Debugw("file批量处理收到数据，写入成功", "count", len(data), "n", n)
+	return nil
+}
+
 // FilterField 删除无用
 func (fl *FileLogConsumer) FilterField(collection string, document bson.M) error {
 	if document == nil {
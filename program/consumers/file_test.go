@@ -0,0 +1,38 @@
+package consumers
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+)
+
+func TestFileLogName(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		want string
+	}{
+		// 未配置name时沿用旧文件名
+		{"", "src-to-dst.oplog"},
+		{"goods-file", "goods-file-src-to-dst.oplog"},
+		{"goods/users", "goods_users-src-to-dst.oplog"},
+	}
+	for _, tt := range tests {
+		cfg := &config.SyncConfig{
+			Name:          tt.name,
+			Type:          TypeFile,
+			SourceDb:      "src",
+			DestinationDb: "dst",
+			Options:       map[string]interface{}{"dir": dir},
+		}
+		consumer, err := NewFileLogConsumer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := consumer.(*FileLogConsumer).filepath; got != filepath.Join(dir, tt.want) {
+			t.Errorf("name %q: path = %s, want %s", tt.name, got, tt.want)
+		}
+		consumer.Disconnect()
+	}
+}
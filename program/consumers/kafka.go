@@ -0,0 +1,282 @@
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/* kafka目标，来源集合按collections对照写入topic，消息key为文档唯一标识的mongo扩展json
+ * 同一个文档的消息写入同一个分区，保持顺序，消息体为 {"db":"目标db","collection":"topic","event":{事件}}
+ * 同步发送，broker确认后才返回，结束位置不会越过未确认的消息 */
+
+const (
+	TypeKafka = "kafka"
+
+	DefaultKafkaVersion   = "2.1.0"
+	DefaultKafkaTimeoutMs = 10000
+)
+
+func init() {
+	Register(TypeKafka, NewKafkaConsumer)
+}
+
+// KafkaConsumer kafka消费者
+type KafkaConsumer struct {
+	cfg      *config.SyncConfig
+	options  *KafkaOptions
+	client   sarama.Client
+	producer sarama.SyncProducer
+}
+
+// KafkaOptions kafka目标专有配置 [sync.options]
+type KafkaOptions struct {
+	Version         string `json:"version"`           // kafka版本，默认2.1.0，幂等写入需要0.11及以上，zstd压缩需要2.1及以上
+	ClientID        string `json:"client_id"`         // 客户端id，默认sarama
+	Idempotent      *bool  `json:"idempotent"`        // 幂等写入，broker重试不会产生重复消息，默认true
+	Compression     string `json:"compression"`       // 压缩方式 none gzip snappy lz4 zstd，默认none
+	RequiredAcks    string `json:"required_acks"`     // 确认方式 all local none，幂等写入只能为all，默认all
+	TimeoutMs       int    `json:"timeout_ms"`        // 等待broker确认的毫秒数，默认10000
+	MaxMessageBytes int    `json:"max_message_bytes"` // 单条消息最大字节数，默认1000000
+	Username        string `json:"username"`          // sasl plain用户名，为空时不认证
+	Password        string `json:"password"`          // sasl plain密码
+	TLS             bool   `json:"tls"`               // 是否使用tls连接
+}
+
+// NewKafkaConsumer 创建一个kafka消费对象
+func NewKafkaConsumer(cfg *config.SyncConfig) (Consumer, error) {
+	kafkaConsumer := &KafkaConsumer{
+		cfg:     cfg,
+		options: new(KafkaOptions),
+	}
+	err := cfg.DecodeOptions(kafkaConsumer.options)
+	if err != nil {
+		return nil, err
+	}
+	err = kafkaConsumer.InitClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return kafkaConsumer, nil
+}
+
+// 初始化连接
+func (kc *KafkaConsumer) InitClient(cfg *config.SyncConfig) error {
+	if cfg.DestinationUri == "" {
+		return errors.New("kafka目标broker地址(destination_uri)配置不能为空")
+	}
+	saramaConfig, err := kc.saramaConfig()
+	if err != nil {
+		return err
+	}
+	kc.client, err = sarama.NewClient(strings.Split(cfg.DestinationUri, ";"), saramaConfig)
+	if err != nil {
+		return err
+	}
+	kc.producer, err = sarama.NewSyncProducerFromClient(kc.client)
+	if err != nil {
+		kc.client.Close()
+		return err
+	}
+	return nil
+}
+
+// 按专有配置生成客户端配置
+func (kc *KafkaConsumer) saramaConfig() (*sarama.Config, error) {
+	options := kc.options
+	saramaConfig := sarama.NewConfig()
+	version := options.Version
+	if version == "" {
+		version = DefaultKafkaVersion
+	}
+	var err error
+	saramaConfig.Version, err = sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("kafka配置version错误: %v", err)
+	}
+	if options.ClientID != "" {
+		saramaConfig.ClientID = options.ClientID
+	}
+	if options.Compression != "" {
+		err = saramaConfig.Producer.Compression.UnmarshalText([]byte(options.Compression))
+		if err != nil {
+			return nil, fmt.Errorf("kafka配置compression错误: %v", err)
+		}
+	}
+	switch options.RequiredAcks {
+	case "", "all":
+		saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
+	case "local":
+		saramaConfig.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		saramaConfig.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, fmt.Errorf("kafka配置required_acks只能为 all local none: %s", options.RequiredAcks)
+	}
+	if options.Idempotent == nil || *options.Idempotent {
+		// 幂等写入要求每个连接只有一个未确认的请求
+		saramaConfig.Producer.Idempotent = true
+		saramaConfig.Net.MaxOpenRequests = 1
+	}
+	timeout := time.Duration(options.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DefaultKafkaTimeoutMs * time.Millisecond
+	}
+	saramaConfig.Producer.Timeout = timeout
+	if options.MaxMessageBytes > 0 {
+		saramaConfig.Producer.MaxMessageBytes = options.MaxMessageBytes
+	}
+	// 同一个文档的消息按key写入同一个分区
+	saramaConfig.Producer.Partitioner = sarama.NewHashPartitioner
+	saramaConfig.Producer.Return.Successes = true
+	if options.Username != "" {
+		saramaConfig.Net.SASL.Enable = true
+		saramaConfig.Net.SASL.User = options.Username
+		saramaConfig.Net.SASL.Password = options.Password
+	}
+	saramaConfig.Net.TLS.Enable = options.TLS
+	err = saramaConfig.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("kafka配置错误: %v", err)
+	}
+	return saramaConfig, nil
+}
+
+// Capabilities 事件原样写入topic，由下游处理增量更新和表结构变化，不支持事务
+func (kc *KafkaConsumer) Capabilities() Capabilities {
+	return Capabilities{
+		Batch:       true,
+		DeltaUpdate: true,
+		Rename:      true,
+		Drop:        true,
+	}
+}
+
+// Health 刷新topic元数据，检查broker是否可用
+func (kc *KafkaConsumer) Health(ctx context.Context) error {
+	topics := make([]string, 0, len(kc.cfg.Collections))
+	for collection := range kc.cfg.Collections {
+		topics = append(topics, kc.cfg.GetDestinationCollection(collection))
+	}
+	return kc.client.RefreshMetadata(topics...)
+}
+
+// 销毁连接
+func (kc *KafkaConsumer) Disconnect() error {
+	if kc.producer != nil {
+		err := kc.producer.Close()
+		if err != nil {
+			logger.GlobalLogger.Errorw("关闭kafka生产者错误", "err", err, "cfg", kc.cfg)
+		}
+	}
+	if kc.client != nil && !kc.client.Closed() {
+		return kc.client.Close()
+	}
+	return nil
+}
+
+// 处理一条消息，broker确认后返回
+func (kc *KafkaConsumer) HandleData(ctx context.Context, data *models.ChangeEvent) error {
+	if data == nil {
+		return errors.New("kafka处理收到数据为nil")
+	}
+	log.Println("kafka处理收到数据", data.Namespace.Db, data.Namespace.Coll, data.Operation)
+	msg, err := kc.message(data)
+	if err != nil {
+		return err
+	}
+	_, _, err = kc.producer.SendMessage(msg)
+	if err != nil {
+		logger.GlobalLogger.Errorw("kafka写入消息错误", "err", err, "topic", msg.Topic, "namespace", data.Namespace)
+	}
+	return err
+}
+
+// HandleBatch 一批消息一起发送，全部确认后返回，任一消息失败时整批重试
+func (kc *KafkaConsumer) HandleBatch(ctx context.Context, data []*models.ChangeEvent) error {
+	log.Println("kafka批量处理收到数据", len(data))
+	msgs := make([]*sarama.ProducerMessage, 0, len(data))
+	for _, v := range data {
+		msg, err := kc.message(v)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+	err := kc.producer.SendMessages(msgs)
+	if err == nil {
+		return nil
+	}
+	var producerErrs sarama.ProducerErrors
+	if errors.As(err, &producerErrs) && len(producerErrs) > 0 {
+		logger.GlobalLogger.Errorw("kafka批量写入消息错误", "err", producerErrs[0].Err, "failed", len(producerErrs), "count", len(data))
+		return producerErrs[0]
+	}
+	logger.GlobalLogger.Errorw("kafka批量写入消息错误", "err", err, "count", len(data))
+	return err
+}
+
+// 一条事件对应的消息，topic为目标集合，key为文档唯一标识
+func (kc *KafkaConsumer) message(data *models.ChangeEvent) (*sarama.ProducerMessage, error) {
+	value, err := json.Marshal(newEventMessage(kc.cfg, data))
+	if err != nil {
+		logger.GlobalLogger.Errorw("kafka处理收到数据转json错误", "err", err, "data", data)
+		return nil, Permanent(err)
+	}
+	msg := &sarama.ProducerMessage{
+		Topic: kc.cfg.GetDestinationCollection(data.Namespace.Coll),
+		Value: sarama.ByteEncoder(value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("operation"), Value: []byte(data.Operation)},
+		},
+	}
+	// 表结构变化等事件没有文档唯一标识，按集合名分区
+	if !data.DocumentKey.IsZero() {
+		key, err := data.DocumentKey.MarshalJSON()
+		if err != nil {
+			return nil, Permanent(err)
+		}
+		msg.Key = sarama.ByteEncoder(key)
+	} else {
+		msg.Key = sarama.StringEncoder(data.Namespace.Coll)
+	}
+	return msg, nil
+}
+
+// IsPermanentError 消息过大、格式错误、没有权限等错误重试无法解决
+func (kc *KafkaConsumer) IsPermanentError(err error) bool {
+	var kerr sarama.KError
+	if !errors.As(err, &kerr) {
+		return false
+	}
+	switch kerr {
+	case sarama.ErrMessageSizeTooLarge, sarama.ErrInvalidMessage, sarama.ErrInvalidMessageSize,
+		sarama.ErrInvalidTopic, sarama.ErrTopicAuthorizationFailed, sarama.ErrClusterAuthorizationFailed,
+		sarama.ErrPolicyViolation, sarama.ErrInvalidRecord:
+		return true
+	}
+	return false
+}
+
+// FilterField 删除无用
+func (kc *KafkaConsumer) FilterField(collection string, document bson.M) error {
+	if document == nil {
+		return nil
+	}
+	for k := range document {
+		if !kc.cfg.InCollectionField(collection, k) {
+			delete(document, k)
+		}
+	}
+	return nil
+}
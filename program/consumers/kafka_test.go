@@ -0,0 +1,104 @@
+package consumers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 使用mock生产者的kafka消费者，goods写入topic t_goods，users写入同名topic
+func newTestKafkaConsumer(t *testing.T) (*KafkaConsumer, *mocks.SyncProducer) {
+	t.Helper()
+	producer := mocks.NewSyncProducer(t, nil)
+	t.Cleanup(func() { producer.Close() })
+	return &KafkaConsumer{
+		cfg: &config.SyncConfig{
+			Type:          TypeKafka,
+			SourceDb:      "src",
+			DestinationDb: "dst",
+			Collections:   map[string]string{"goods": "t_goods", "users": ""},
+		},
+		options:  new(KafkaOptions),
+		producer: producer,
+	}, producer
+}
+
+// 记录发送的消息
+func recordMessages(producer *mocks.SyncProducer, count int, msgs *[]*sarama.ProducerMessage) {
+	for i := 0; i < count; i++ {
+		producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			*msgs = append(*msgs, msg)
+			return nil
+		})
+	}
+}
+
+func TestKafkaTopicAndKey(t *testing.T) {
+	kc, producer := newTestKafkaConsumer(t)
+	var msgs []*sarama.ProducerMessage
+	recordMessages(producer, 3, &msgs)
+
+	err := kc.HandleBatch(context.Background(), []*models.ChangeEvent{
+		testEvent(t, "insert", "goods", "g1", bson.M{"name": "a"}),
+		testEvent(t, "delete", "users", int32(7), nil),
+		testEvent(t, "drop", "goods", nil, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		topic     string
+		key       string
+		operation string
+	}{
+		{"t_goods", `{"_id":"g1"}`, "insert"},
+		{"users", `{"_id":7}`, "delete"},
+		// 没有文档唯一标识的事件按来源集合名分区
+		{"t_goods", "goods", "drop"},
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("messages = %d, want %d", len(msgs), len(want))
+	}
+	for i, w := range want {
+		msg := msgs[i]
+		if msg.Topic != w.topic {
+			t.Errorf("message %d topic = %s, want %s", i, msg.Topic, w.topic)
+		}
+		key, _ := msg.Key.Encode()
+		if string(key) != w.key {
+			t.Errorf("message %d key = %s, want %s", i, key, w.key)
+		}
+		if len(msg.Headers) != 1 || string(msg.Headers[0].Key) != "operation" || string(msg.Headers[0].Value) != w.operation {
+			t.Errorf("message %d headers = %v", i, msg.Headers)
+		}
+	}
+}
+
+func TestKafkaBatchFailure(t *testing.T) {
+	kc, producer := newTestKafkaConsumer(t)
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndFail(sarama.ErrNotEnoughReplicas)
+
+	// 任一消息失败时整批返回错误，分发不会推进结束位置，整批重试
+	err := kc.HandleBatch(context.Background(), []*models.ChangeEvent{
+		testEvent(t, "insert", "goods", "g1", bson.M{"name": "a"}),
+		testEvent(t, "insert", "goods", "g2", bson.M{"name": "b"}),
+	})
+	if err == nil {
+		t.Fatal("batch with failed message succeeded")
+	}
+	if IsPermanentError(kc, err) {
+		t.Errorf("not enough replicas error %v is permanent", err)
+	}
+
+	producer.ExpectSendMessageAndFail(sarama.ErrMessageSizeTooLarge)
+	err = kc.HandleData(context.Background(), testEvent(t, "insert", "goods", "g3", bson.M{"name": "c"}))
+	if !IsPermanentError(kc, err) {
+		t.Errorf("message too large error %v is not permanent", err)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
-	"time"
 
 	"github.com/shiguanghuxian/mongodb-sync/internal/config"
 	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
@@ -16,23 +15,40 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+const TypeMongo = "mongo"
+
+func init() {
+	Register(TypeMongo, NewMongoConsumer)
+}
+
 /* mogno目标数据落地 */
 type MongoConsumer struct {
-	client *mongo.Client
-	cfg    *config.SyncConfig
+	client      *mongo.Client
+	cfg         *config.SyncConfig
+	options     *MongoOptions
+	transaction bool // 目标是否支持事务，副本集或分片集群支持
+}
+
+// MongoOptions mongo目标专有配置 [sync.options]
+type MongoOptions struct {
+	DisableTransaction bool `json:"disable_transaction"` // 不使用目标事务，源事务的事件逐条写入
 }
 
 // NewMongoConsumer 创建一个mongo消费对象
-func NewMongoConsumer(cfg *config.SyncConfig) error {
+func NewMongoConsumer(cfg *config.SyncConfig) (Consumer, error) {
 	mongoConsumer := &MongoConsumer{
-		cfg: cfg,
+		cfg:     cfg,
+		options: new(MongoOptions),
 	}
-	err := mongoConsumer.InitClient(cfg)
+	err := cfg.DecodeOptions(mongoConsumer.options)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	registerConsumer(cfg.GetKey(), mongoConsumer)
-	return nil
+	err = mongoConsumer.InitClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return mongoConsumer, nil
 }
 
 // 初始化连接
@@ -45,26 +61,46 @@ func (mc *MongoConsumer) InitClient(cfg *config.SyncConfig) error {
 	if err != nil {
 		return err
 	}
-	// 定时轮训防止连接断开
-	go func() {
-		for {
-			func() {
-				ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
-				defer cancel()
-				err := mc.client.Ping(ctx, nil)
-				logger.GlobalLogger.Errorw("定时轮训防止连接断开错误", "err", err, "cfg", mc.cfg)
-			}()
-			time.Sleep(time.Minute)
-		}
-	}()
-
+	// 检查目标是否支持事务
+	mc.transaction = !mc.options.DisableTransaction && mc.supportTransaction()
 	return nil
 }
 
+// Capabilities 目标为副本集或分片集群时支持事务
+func (mc *MongoConsumer) Capabilities() Capabilities {
+	return Capabilities{
+		Transaction: mc.transaction,
+		Batch:       true,
+		DeltaUpdate: true,
+		Rename:      true,
+		Drop:        true,
+	}
+}
+
+// Health 检查目标mongo是否可用
+func (mc *MongoConsumer) Health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+	defer cancel()
+	return mc.client.Ping(ctx, nil)
+}
+
+// 目标是否支持事务，单机不支持
+func (mc *MongoConsumer) supportTransaction() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+	defer cancel()
+	result := bson.M{}
+	err := mc.client.Database("admin").RunCommand(ctx, bson.M{"isMaster": 1}).Decode(&result)
+	if err != nil {
+		logger.GlobalLogger.Warnw("检查目标mongo是否支持事务错误，按不支持处理", "err", err, "cfg", mc.cfg)
+		return false
+	}
+	_, isReplicaSet := result["setName"]
+	isMongos := result["msg"] == "isdbgrid"
+	return isReplicaSet || isMongos
+}
+
 // 销毁连接
 func (mc *MongoConsumer) Disconnect() error {
-	// 注销
-	unRegisterConsumer(mc.cfg.GetKey())
 	// 关闭连接
 	if mc.client != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
@@ -78,7 +114,119 @@ func (mc *MongoConsumer) Disconnect() error {
 }
 
 // 处理一条消息
-func (mc *MongoConsumer) HandleData(data *models.ChangeEvent) (err error) {
+func (mc *MongoConsumer) HandleData(ctx context.Context, data *models.ChangeEvent) (err error) {
+	return mc.handle(ctx, data)
+}
+
+// HandleTransaction 同一个源事务的多条消息在一个mongo事务中处理，目标不支持事务时逐条处理
+func (mc *MongoConsumer) HandleTransaction(ctx context.Context, data []*models.ChangeEvent) error {
+	log.Println("mongo处理收到事务", len(data))
+	if !mc.transaction {
+		for _, v := range data {
+			err := mc.handle(ctx, v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	session, err := mc.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		for _, v := range data {
+			err := mc.handle(sessCtx, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		logger.GlobalLogger.Errorw("mongo事务处理错误", "err", err, "count", len(data), "cfg", mc.cfg)
+		return err
+	}
+	return nil
+}
+
+// HandleBatch 一批消息按目标集合合并为有序的bulkWrite，写入均为幂等的upsert、更新和删除
+func (mc *MongoConsumer) HandleBatch(ctx context.Context, data []*models.ChangeEvent) error {
+	log.Println("mongo批量处理收到数据", len(data))
+	collectionName := ""
+	batch := make([]mongo.WriteModel, 0, len(data))
+	for _, v := range data {
+		name := mc.cfg.GetDestinationCollection(v.Namespace.Coll)
+		// 目标集合变化时先写入之前的集合，保证顺序
+		if name != collectionName {
+			if err := mc.bulkWrite(ctx, collectionName, batch); err != nil {
+				return err
+			}
+			collectionName = name
+			batch = batch[:0]
+		}
+		writeModels, ok := mc.writeModels(v)
+		if !ok {
+			// 表结构变化等事件不会合并到批次中，按单条处理
+			if err := mc.bulkWrite(ctx, collectionName, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+			if err := mc.handle(ctx, v); err != nil {
+				return err
+			}
+			continue
+		}
+		batch = append(batch, writeModels...)
+	}
+	return mc.bulkWrite(ctx, collectionName, batch)
+}
+
+// 一条消息对应的写入操作，不支持批量写入的事件返回false
+func (mc *MongoConsumer) writeModels(data *models.ChangeEvent) ([]mongo.WriteModel, bool) {
+	filter := data.DocumentKey.Filter()
+	switch data.Operation {
+	case "insert", "replace":
+		return []mongo.WriteModel{mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(data.Document).SetUpsert(true)}, true
+	case "update":
+		if mc.cfg.GetUpdateMode() == config.UpdateModeDelta && data.Updates != nil {
+			writeModels := make([]mongo.WriteModel, 0, 2)
+			for _, updateDoc := range deltaUpdateDocs(data.Updates) {
+				writeModels = append(writeModels, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(updateDoc))
+			}
+			return writeModels, true
+		}
+		if data.Document == nil {
+			return nil, true
+		}
+		return []mongo.WriteModel{mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(bson.M{"$set": data.Document}).SetUpsert(true)}, true
+	case "delete":
+		return []mongo.WriteModel{mongo.NewDeleteOneModel().SetFilter(filter)}, true
+	}
+	return nil, false
+}
+
+// 有序批量写入一个目标集合
+func (mc *MongoConsumer) bulkWrite(ctx context.Context, collectionName string, writeModels []mongo.WriteModel) error {
+	if len(writeModels) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+	defer cancel()
+	coll := mc.client.Database(mc.cfg.DestinationDb).Collection(collectionName)
+	result, err := coll.BulkWrite(ctx, writeModels, options.BulkWrite().SetOrdered(true))
+	if err != nil {
+		logger.GlobalLogger.Errorw("mongo批量写入目标db错误", "err", err, "collection", collectionName, "count", len(writeModels), "cfg", mc.cfg)
+		return err
+	}
+	js, _ := json.Marshal(result)
+	log.Println("mongo批量写入成功", collectionName, string(js))
+	return nil
+}
+
+// 使用指定上下文处理一条消息，上下文可以携带事务
+func (mc *MongoConsumer) handle(ctx context.Context, data *models.ChangeEvent) (err error) {
 	log.Println("mongo处理收到数据", data.Namespace.Db, data.Namespace.Coll, data.Operation)
 	collectionName := mc.cfg.Collections[data.Namespace.Coll]
 	if collectionName == "" {
@@ -88,15 +236,19 @@ func (mc *MongoConsumer) HandleData(data *models.ChangeEvent) (err error) {
 	coll := mc.client.Database(mc.cfg.DestinationDb).Collection(collectionName)
 	switch data.Operation {
 	case "insert":
-		err = mc.insert(coll, data)
+		err = mc.insert(ctx, coll, data)
 	case "update":
-		err = mc.update(coll, data)
+		err = mc.update(ctx, coll, data)
 	case "delete":
-		err = mc.delete(coll, data)
+		err = mc.delete(ctx, coll, data)
 	case "replace":
-		err = mc.replace(coll, data)
+		err = mc.replace(ctx, coll, data)
+	case "drop", "dropDatabase":
+		err = mc.drop(ctx, data)
+	case "rename":
+		err = mc.rename(ctx, coll, data)
 	default:
-		return errors.New("未知事件类型")
+		return Permanent(errors.New("未知事件类型"))
 	}
 	if err != nil {
 		logger.GlobalLogger.Errorw("处理数据错误", "err", err, "data", data, "cfg", mc.cfg)
@@ -120,10 +272,18 @@ func (mc *MongoConsumer) FilterField(collection string, document bson.M) error {
 }
 
 // 插入数据
-func (mc *MongoConsumer) insert(coll *mongo.Collection, data *models.ChangeEvent) error {
-	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+func (mc *MongoConsumer) insert(ctx context.Context, coll *mongo.Collection, data *models.ChangeEvent) error {
+	// 事务中重复键错误会中止服务端事务，无法回退为替换，直接使用upsert替换
+	if mongo.SessionFromContext(ctx) != nil {
+		return mc.replace(ctx, coll, data)
+	}
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
 	defer cancel()
 	result, err := coll.InsertOne(ctx, data.Document)
+	if mongo.IsDuplicateKeyError(err) {
+		// 结束位置之后的事件可能重复处理，文档已存在时按替换处理
+		return mc.replace(ctx, coll, data)
+	}
 	if err != nil {
 		logger.GlobalLogger.Errorw("mongo将数据插入目标db错误", "err", err, "result", result, "data", data, "cfg", mc.cfg)
 		return err
@@ -133,34 +293,71 @@ func (mc *MongoConsumer) insert(coll *mongo.Collection, data *models.ChangeEvent
 }
 
 // 更新数据
-func (mc *MongoConsumer) update(coll *mongo.Collection, data *models.ChangeEvent) error {
-	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+func (mc *MongoConsumer) update(ctx context.Context, coll *mongo.Collection, data *models.ChangeEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
 	defer cancel()
-	docCount, err := coll.CountDocuments(ctx, bson.M{"_id": data.DocumentKey.ID})
+	docCount, err := coll.CountDocuments(ctx, data.DocumentKey.Filter())
 	if err != nil {
 		logger.GlobalLogger.Errorw("更新前查询数据是否存在错误", "err", err, "data", data, "cfg", mc.cfg)
 		return err
 	}
 	if docCount == 0 {
-		return mc.insert(coll, data)
+		if data.Document == nil {
+			logger.GlobalLogger.Warnw("目标文档不存在且没有变更后文档，跳过更新", "namespace", data.Namespace, "document_key", data.DocumentKey, "cfg", mc.cfg)
+			return nil
+		}
+		return mc.insert(ctx, coll, data)
 	}
 	updateOpts := options.Update().SetUpsert(false)
-	updateDoc := bson.M{"$set": data.Document}
-	result, err := coll.UpdateOne(ctx, bson.M{"_id": data.DocumentKey.ID}, updateDoc, updateOpts)
-	if err != nil {
-		logger.GlobalLogger.Errorw("mongo将数据更新目标db错误", "err", err, "result", result, "data", data, "cfg", mc.cfg)
-		return err
+	updateDocs := []bson.M{{"$set": data.Document}}
+	if mc.cfg.GetUpdateMode() == config.UpdateModeDelta && data.Updates != nil {
+		updateDocs = deltaUpdateDocs(data.Updates)
+	}
+	for _, updateDoc := range updateDocs {
+		result, err := coll.UpdateOne(ctx, data.DocumentKey.Filter(), updateDoc, updateOpts)
+		if err != nil {
+			logger.GlobalLogger.Errorw("mongo将数据更新目标db错误", "err", err, "result", result, "data", data, "cfg", mc.cfg)
+			return err
+		}
+		js, _ := json.Marshal(result)
+		log.Println("更新数据成功", string(js))
 	}
-	js, _ := json.Marshal(result)
-	log.Println("更新数据成功", string(js))
 	return nil
 }
 
+// 按updateDescription生成更新语句
+// 数组截短与更新数组元素的路径冲突，需要先单独截短再更新
+func deltaUpdateDocs(updates *models.UpdateDescription) []bson.M {
+	updateDocs := make([]bson.M, 0, 2)
+	if len(updates.TruncatedArrays) > 0 {
+		push := bson.M{}
+		for _, v := range updates.TruncatedArrays {
+			push[v.Field] = bson.M{"$each": bson.A{}, "$slice": v.NewSize}
+		}
+		updateDocs = append(updateDocs, bson.M{"$push": push})
+	}
+	updateDoc := bson.M{}
+	if len(updates.UpdatedFields) > 0 {
+		updateDoc["$set"] = updates.UpdatedFields
+	}
+	if len(updates.RemovedFields) > 0 {
+		unset := bson.M{}
+		for _, v := range updates.RemovedFields {
+			unset[v] = ""
+		}
+		updateDoc["$unset"] = unset
+	}
+	if len(updateDoc) > 0 {
+		updateDocs = append(updateDocs, updateDoc)
+	}
+	return updateDocs
+}
+
 // 删除
-func (mc *MongoConsumer) delete(coll *mongo.Collection, data *models.ChangeEvent) error {
-	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+func (mc *MongoConsumer) delete(ctx context.Context, coll *mongo.Collection, data *models.ChangeEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
 	defer cancel()
-	result, err := coll.DeleteOne(ctx, bson.M{"_id": data.DocumentKey.ID})
+	result, err := coll.DeleteOne(ctx, data.DocumentKey.Filter())
 	if err != nil {
 		logger.GlobalLogger.Errorw("mongo删除目标db一条数据错误", "err", err, "result", result, "data", data, "cfg", mc.cfg)
 		return err
@@ -169,11 +366,12 @@ func (mc *MongoConsumer) delete(coll *mongo.Collection, data *models.ChangeEvent
 	return nil
 }
 
-// 查找结果，替换
-func (mc *MongoConsumer) replace(coll *mongo.Collection, data *models.ChangeEvent) error {
-	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+// 查找结果，替换 - 不存在则插入
+func (mc *MongoConsumer) replace(ctx context.Context, coll *mongo.Collection, data *models.ChangeEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
 	defer cancel()
-	result, err := coll.ReplaceOne(ctx, bson.M{"_id": data.DocumentKey.ID}, data.Document)
+	replaceOpts := options.Replace().SetUpsert(true)
+	result, err := coll.ReplaceOne(ctx, data.DocumentKey.Filter(), data.Document, replaceOpts)
 	if err != nil {
 		logger.GlobalLogger.Errorw("mongo删除目标db一条数据错误", "err", err, "result", result, "data", data, "cfg", mc.cfg)
 		return err
@@ -182,3 +380,88 @@ func (mc *MongoConsumer) replace(coll *mongo.Collection, data *models.ChangeEven
 	log.Println("replace更新数据成功", string(js))
 	return nil
 }
+
+// 来源集合或db删除，按配置删除或清空目标集合
+func (mc *MongoConsumer) drop(ctx context.Context, data *models.ChangeEvent) error {
+	action, collections := dropCollections(mc.cfg, data)
+	for _, v := range collections {
+		ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+		coll := mc.client.Database(mc.cfg.DestinationDb).Collection(mc.cfg.GetDestinationCollection(v))
+		var err error
+		if action == config.DDLDropDrop {
+			err = coll.Drop(ctx)
+		} else {
+			_, err = coll.DeleteMany(ctx, bson.M{})
+		}
+		cancel()
+		if err != nil {
+			logger.GlobalLogger.Errorw("mongo删除目标集合错误", "err", err, "action", action, "collection", coll.Name(), "cfg", mc.cfg)
+			return err
+		}
+		log.Println("mongo删除目标集合成功", action, coll.Name())
+	}
+	return nil
+}
+
+// 来源集合重命名，同步重命名目标集合
+func (mc *MongoConsumer) rename(ctx context.Context, coll *mongo.Collection, data *models.ChangeEvent) error {
+	to, ok := renameDestination(mc.cfg, data)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+	defer cancel()
+	cmd := bson.D{
+		{Key: "renameCollection", Value: mc.cfg.DestinationDb + "." + coll.Name()},
+		{Key: "to", Value: mc.cfg.DestinationDb + "." + to},
+	}
+	err := mc.client.Database("admin").RunCommand(ctx, cmd).Err()
+	if err != nil {
+		// 目标集合不存在时无需重命名
+		if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == 26 {
+			return nil
+		}
+		logger.GlobalLogger.Errorw("mongo重命名目标集合错误", "err", err, "collection", coll.Name(), "to", to, "cfg", mc.cfg)
+		return err
+	}
+	log.Println("mongo重命名目标集合成功", coll.Name(), to)
+	return nil
+}
+
+// mongo临时错误码，主从切换、写冲突、超时等
+var mongoTransientErrors = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	50,    // MaxTimeMSExpired
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	112,   // WriteConflict
+	189,   // PrimarySteppedDown
+	262,   // ExceededTimeLimit
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// IsPermanentError mongo服务端返回的非临时错误为永久错误，例如文档校验失败、唯一索引冲突
+func (mc *MongoConsumer) IsPermanentError(err error) bool {
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return false
+	}
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	if serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError") {
+		return false
+	}
+	for _, code := range mongoTransientErrors {
+		if serverErr.HasErrorCode(code) {
+			return false
+		}
+	}
+	return true
+}
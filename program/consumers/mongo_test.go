@@ -0,0 +1,38 @@
+package consumers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDeltaUpdateDocs(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates *models.UpdateDescription
+		want    []bson.M
+	}{
+		{"empty", &models.UpdateDescription{}, []bson.M{}},
+		{"set", &models.UpdateDescription{UpdatedFields: bson.M{"name": "a"}},
+			[]bson.M{{"$set": bson.M{"name": "a"}}}},
+		{"set and unset", &models.UpdateDescription{UpdatedFields: bson.M{"name": "a"}, RemovedFields: []string{"age"}},
+			[]bson.M{{"$set": bson.M{"name": "a"}, "$unset": bson.M{"age": ""}}}},
+		// 截短数组单独更新，避免与更新数组元素的路径冲突
+		{"truncated", &models.UpdateDescription{
+			UpdatedFields:   bson.M{"tags.1": "b"},
+			TruncatedArrays: []models.TruncatedArray{{Field: "tags", NewSize: 2}},
+		}, []bson.M{
+			{"$push": bson.M{"tags": bson.M{"$each": bson.A{}, "$slice": int32(2)}}},
+			{"$set": bson.M{"tags.1": "b"}},
+		}},
+		{"truncated only", &models.UpdateDescription{TruncatedArrays: []models.TruncatedArray{{Field: "tags", NewSize: 0}}},
+			[]bson.M{{"$push": bson.M{"tags": bson.M{"$each": bson.A{}, "$slice": int32(0)}}}}},
+	}
+	for _, tt := range tests {
+		if got := deltaUpdateDocs(tt.updates); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,14 +1,15 @@
 package consumers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"sort"
 	"strings"
-	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 	"github.com/shiguanghuxian/mongodb-sync/internal/common"
 	"github.com/shiguanghuxian/mongodb-sync/internal/config"
@@ -17,23 +18,38 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 )
 
+const TypeMysql = "mysql"
+
+func init() {
+	Register(TypeMysql, NewMysqlConsumer)
+}
+
 type MysqlConsumer struct {
 	debug bool
 	cfg   *config.SyncConfig
 	db    *gorm.DB
 }
 
-func NewMysqlConsumer(cfg *config.SyncConfig, debug bool) error {
+// MysqlOptions mysql目标专有配置 [sync.options]
+type MysqlOptions struct {
+	LogSql bool `json:"log_sql"` // 输出执行的sql，全局debug开启时也会输出
+}
+
+func NewMysqlConsumer(cfg *config.SyncConfig) (Consumer, error) {
+	options := new(MysqlOptions)
+	err := cfg.DecodeOptions(options)
+	if err != nil {
+		return nil, err
+	}
 	mysqlConsumer := &MysqlConsumer{
 		cfg:   cfg,
-		debug: debug,
+		debug: cfg.Debug() || options.LogSql,
 	}
-	err := mysqlConsumer.InitClient(cfg)
+	err = mysqlConsumer.InitClient(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	registerConsumer(cfg.GetKey(), mysqlConsumer)
-	return nil
+	return mysqlConsumer, nil
 }
 
 // 初始化连接
@@ -51,21 +67,27 @@ func (mc *MysqlConsumer) InitClient(cfg *config.SyncConfig) (err error) {
 	}
 	// 更新操作必须有条件
 	mc.db.BlockGlobalUpdate(true)
-	// 防连接断开
-	go func() {
-		for {
-			func() {
-				err := mc.db.DB().Ping()
-				if err != nil {
-					logger.GlobalLogger.Errorw("定时轮训防止连接断开错误", "err", err, "cfg", mc.cfg)
-				}
-			}()
-			time.Sleep(time.Minute)
-		}
-	}()
 	return nil
 }
 
+// Capabilities mysql支持事务、批量、增量更新、删表和重命名表
+func (mc *MysqlConsumer) Capabilities() Capabilities {
+	return Capabilities{
+		Transaction: true,
+		Batch:       true,
+		DeltaUpdate: true,
+		Rename:      true,
+		Drop:        true,
+	}
+}
+
+// Health ping数据库，同时保持连接活跃
+func (mc *MysqlConsumer) Health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+	defer cancel()
+	return mc.db.DB().PingContext(ctx)
+}
+
 // 初始创建数据表 - 当表不存在时
 func (mc *MysqlConsumer) initCreateTable(tableName string) error {
 	hasTable := mc.db.HasTable(tableName)
@@ -95,8 +117,6 @@ func (mc *MysqlConsumer) initCreateTable(tableName string) error {
 
 // 销毁连接
 func (mc *MysqlConsumer) Disconnect() error {
-	// 注销
-	unRegisterConsumer(mc.cfg.GetKey())
 	// 关闭连接
 	if mc.db != nil {
 		err := mc.db.Close()
@@ -108,29 +128,175 @@ func (mc *MysqlConsumer) Disconnect() error {
 }
 
 // 处理一条消息
-func (mc *MysqlConsumer) HandleData(data *models.ChangeEvent) (err error) {
+func (mc *MysqlConsumer) HandleData(ctx context.Context, data *models.ChangeEvent) (err error) {
+	return mc.handle(mc.db, data)
+}
+
+// HandleTransaction 同一个源事务的多条消息在一个mysql事务中处理
+func (mc *MysqlConsumer) HandleTransaction(ctx context.Context, data []*models.ChangeEvent) (err error) {
+	log.Println("mysql处理收到事务", len(data))
+	// 建表会隐式提交事务，需要在事务开始前完成
+	for _, v := range data {
+		err = mc.initCreateTable(mc.cfg.GetDestinationCollection(v.Namespace.Coll))
+		if err != nil {
+			return err
+		}
+	}
+	tx := mc.db.BeginTx(ctx, nil)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, v := range data {
+		err = mc.handle(tx, v)
+		if err != nil {
+			tx.Rollback()
+			logger.GlobalLogger.Errorw("mysql事务处理错误，已回滚", "err", err, "count", len(data), "cfg", mc.cfg)
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// HandleBatch 一批消息在一个mysql事务中处理，连续插入同一个表的行合并为一条INSERT
+func (mc *MysqlConsumer) HandleBatch(ctx context.Context, data []*models.ChangeEvent) (err error) {
+	log.Println("mysql批量处理收到数据", len(data))
+	// 建表会隐式提交事务，需要在事务开始前完成
+	for _, v := range data {
+		err = mc.initCreateTable(mc.cfg.GetDestinationCollection(v.Namespace.Coll))
+		if err != nil {
+			return err
+		}
+	}
+	tx := mc.db.BeginTx(ctx, nil)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for i := 0; i < len(data); {
+		j := i + 1
+		if data[i].Operation == "insert" {
+			for j < len(data) && data[j].Operation == "insert" && data[j].Namespace.Coll == data[i].Namespace.Coll {
+				j++
+			}
+		}
+		if j-i > 1 {
+			err = mc.insertRows(tx, data[i:j])
+		} else {
+			err = mc.handle(tx, data[i])
+		}
+		if err != nil {
+			tx.Rollback()
+			logger.GlobalLogger.Errorw("mysql批量处理错误，已回滚", "err", err, "count", len(data), "cfg", mc.cfg)
+			return err
+		}
+		i = j
+	}
+	return tx.Commit().Error
+}
+
+// 给模型数据添加唯一标识列，返回唯一标识列
+func (mc *MysqlConsumer) prepareDocument(data *models.ChangeEvent) []config.KeyColumn {
+	// 删除事件没有文档内容
+	if data.Document == nil {
+		data.Document = bson.M{}
+	}
+	keyColumns := mc.cfg.GetKeyColumns(data.Namespace.Coll)
+	for _, v := range keyColumns {
+		data.Document[v.Column] = data.DocumentKey.String(v.Field)
+	}
+	return keyColumns
+}
+
+// 多行插入同一个表，行缺少的列使用默认值
+// 至少一次投递时重启或重试会重放插入，唯一标识冲突时更新其余列
+func (mc *MysqlConsumer) insertRows(conn *gorm.DB, data []*models.ChangeEvent) error {
+	tableName := mc.cfg.GetDestinationCollection(data[0].Namespace.Coll)
+	columnSet := make(map[string]bool)
+	columns := make([]string, 0)
+	keyColumns := make([]string, 0)
+	for _, v := range mc.cfg.GetKeyColumns(data[0].Namespace.Coll) {
+		keyColumns = append(keyColumns, v.Column)
+	}
+	for _, v := range data {
+		mc.prepareDocument(v)
+		for k, _ := range v.Document {
+			if !columnSet[k] {
+				columnSet[k] = true
+				columns = append(columns, k)
+			}
+		}
+	}
+	sort.Strings(columns)
+	fields := make([]string, 0, len(columns))
+	for _, v := range columns {
+		fields = append(fields, "`"+v+"`")
+	}
+	rows := make([]string, 0, len(data))
+	args := make([]interface{}, 0, len(data)*len(columns))
+	for _, v := range data {
+		values := make([]string, 0, len(columns))
+		for _, column := range columns {
+			val, ok := v.Document[column]
+			if !ok {
+				values = append(values, "DEFAULT")
+				continue
+			}
+			if val == nil {
+				val = ""
+			}
+			values = append(values, "?")
+			args = append(args, fmt.Sprint(val))
+		}
+		rows = append(rows, "("+strings.Join(values, ",")+")")
+	}
+	sql := fmt.Sprintf("INSERT INTO `%s` (%s) VALUES %s ON DUPLICATE KEY UPDATE %s", tableName, strings.Join(fields, ","), strings.Join(rows, ","),
+		mysqlUpdateValues(columns, keyColumns))
+	return conn.Exec(sql, args...).Error
+}
+
+// 唯一标识冲突时用插入的值更新其余列，只有唯一标识列时更新为自身，效果同忽略
+func mysqlUpdateValues(columns, keyColumns []string) string {
+	others := nonKeyColumns(columns, keyColumns)
+	if len(others) == 0 {
+		others = keyColumns[:1]
+	}
+	sets := make([]string, 0, len(others))
+	for _, v := range others {
+		sets = append(sets, "`"+v+"`=VALUES(`"+v+"`)")
+	}
+	return strings.Join(sets, ",")
+}
+
+// 使用指定连接或事务处理一条消息
+func (mc *MysqlConsumer) handle(conn *gorm.DB, data *models.ChangeEvent) (err error) {
 	log.Println("mysql处理收到数据", data.Namespace.Db, data.Namespace.Coll, data.Operation)
 	tableName := mc.cfg.Collections[data.Namespace.Coll]
 	if tableName == "" {
 		tableName = data.Namespace.Coll
 	}
+	// 表结构变化事件
+	switch data.Operation {
+	case "drop", "dropDatabase":
+		return mc.drop(data)
+	case "rename":
+		return mc.rename(data, tableName)
+	}
 	err = mc.initCreateTable(tableName)
 	if err != nil {
 		return err
 	}
-	db := mc.db.Table(tableName)                              // 保证表名固定
-	data.Document["document_key"] = data.DocumentKey.ID.Hex() // 给模型数据添加唯一标识
+	db := conn.Table(tableName) // 保证表名固定
+	keyColumns := mc.prepareDocument(data)
 	switch data.Operation {
 	case "insert":
-		err = mc.insert(db, data, tableName)
+		err = mc.insert(db, data)
 	case "update":
-		err = mc.update(db, data, tableName)
+		err = mc.update(db, data, tableName, keyColumns)
 	case "delete":
-		err = mc.delete(db, data, tableName)
+		err = mc.delete(db, data, tableName, keyColumns)
 	case "replace":
-		err = mc.replace(db, data, tableName)
+		err = mc.replace(db, data, tableName, keyColumns)
 	default:
-		return errors.New("未知事件类型")
+		return Permanent(errors.New("未知事件类型"))
 	}
 	if err != nil {
 		logger.GlobalLogger.Errorw("处理数据错误", "err", err, "data", data, "cfg", mc.cfg)
@@ -153,21 +319,9 @@ func (mc *MysqlConsumer) FilterField(collection string, document bson.M) error {
 	return nil
 }
 
-// 插入数据
-func (mc *MysqlConsumer) insert(db *gorm.DB, data *models.ChangeEvent, tableName string) (err error) {
-	tpl := "INSERT INTO `%s` (%s) VALUES (%s)"
-	fields := make([]string, 0)
-	values := make([]string, 0)
-	for k, v := range data.Document {
-		fields = append(fields, "`"+k+"`")
-		if v == nil {
-			v = ""
-		}
-		values = append(values, "'"+fmt.Sprint(v)+"'")
-	}
-	sql := fmt.Sprintf(tpl, tableName, strings.Join(fields, ","), strings.Join(values, ","))
-	err = db.Exec(sql).Error
-	return
+// 插入数据，重放的插入更新已有行
+func (mc *MysqlConsumer) insert(db *gorm.DB, data *models.ChangeEvent) error {
+	return mc.insertRows(db, []*models.ChangeEvent{data})
 }
 
 // MysqlCount 用于统计mysql数据行数
@@ -175,33 +329,160 @@ type MysqlCount struct {
 	CountTable int64 `gorm:"column:count_table" json:"count_table"`
 }
 
+// 唯一标识列查询条件
+func keyColumnsWhere(data *models.ChangeEvent, keyColumns []config.KeyColumn) (string, []interface{}) {
+	conds := make([]string, 0, len(keyColumns))
+	args := make([]interface{}, 0, len(keyColumns))
+	for _, v := range keyColumns {
+		conds = append(conds, "`"+v.Column+"` = ?")
+		args = append(args, data.Document[v.Column])
+	}
+	return strings.Join(conds, " AND "), args
+}
+
 // 更新数据 - 不存在则插入
-func (mc *MysqlConsumer) update(db *gorm.DB, data *models.ChangeEvent, tableName string) (err error) {
+func (mc *MysqlConsumer) update(db *gorm.DB, data *models.ChangeEvent, tableName string, keyColumns []config.KeyColumn) (err error) {
+	where, args := keyColumnsWhere(data, keyColumns)
 	mysqlCount := new(MysqlCount)
-	err = db.Where("document_key = ?", data.Document["document_key"]).Select("count(*) as count_table").First(mysqlCount).Error
+	err = db.Where(where, args...).Select("count(*) as count_table").First(mysqlCount).Error
 	if err != nil {
 		return
 	}
-	if mysqlCount.CountTable > 0 {
-		err = db.Where("document_key = ?", data.Document["document_key"]).Updates(data.Document).Error
-	} else {
-		err = mc.insert(db, data, tableName)
+	if mysqlCount.CountTable == 0 {
+		// 删除事件和delta模式下没有变更后文档时只有唯一标识列
+		if len(data.Document) <= len(keyColumns) {
+			logger.GlobalLogger.Warnw("目标行不存在且没有变更后文档，跳过更新", "table", tableName, "document_key", data.DocumentKey, "cfg", mc.cfg)
+			return nil
+		}
+		return mc.insert(db, data)
+	}
+	columns := map[string]interface{}(data.Document)
+	if mc.cfg.GetUpdateMode() == config.UpdateModeDelta && data.Updates != nil {
+		columns = deltaUpdateColumns(data)
+		if len(columns) == 0 {
+			return nil
+		}
 	}
+	err = db.Where(where, args...).Updates(columns).Error
 	return
 }
 
+// 按updateDescription计算需要更新的列，列对应文档顶层字段
+// 删除的顶层字段置为NULL，嵌套字段变化时使用变更后文档中的顶层字段值
+func deltaUpdateColumns(data *models.ChangeEvent) map[string]interface{} {
+	columns := make(map[string]interface{})
+	nested := make([]string, 0)
+	for k, v := range data.Updates.UpdatedFields {
+		if field := models.TopLevelField(k); field != k {
+			nested = append(nested, field)
+		} else {
+			columns[k] = v
+		}
+	}
+	for _, v := range data.Updates.RemovedFields {
+		if field := models.TopLevelField(v); field != v {
+			nested = append(nested, field)
+		} else {
+			columns[v] = nil
+		}
+	}
+	for _, v := range data.Updates.TruncatedArrays {
+		nested = append(nested, models.TopLevelField(v.Field))
+	}
+	for _, field := range nested {
+		val, ok := data.Document[field]
+		if !ok {
+			logger.GlobalLogger.Warnw("嵌套字段变化没有变更后文档，跳过该列", "field", field, "namespace", data.Namespace, "document_key", data.DocumentKey)
+			continue
+		}
+		columns[field] = val
+	}
+	return columns
+}
+
 // 删除
-func (mc *MysqlConsumer) delete(db *gorm.DB, data *models.ChangeEvent, tableName string) (err error) {
-	err = db.Exec(fmt.Sprintf("DELETE FROM %s WHERE document_key = ?", tableName), data.Document["document_key"]).Error
+func (mc *MysqlConsumer) delete(db *gorm.DB, data *models.ChangeEvent, tableName string, keyColumns []config.KeyColumn) (err error) {
+	where, args := keyColumnsWhere(data, keyColumns)
+	err = db.Exec(fmt.Sprintf("DELETE FROM `%s` WHERE %s", tableName, where), args...).Error
 	return
 }
 
 // 查找结果，替换
-func (mc *MysqlConsumer) replace(db *gorm.DB, data *models.ChangeEvent, tableName string) (err error) {
-	err = mc.delete(db, data, tableName)
+func (mc *MysqlConsumer) replace(db *gorm.DB, data *models.ChangeEvent, tableName string, keyColumns []config.KeyColumn) (err error) {
+	err = mc.delete(db, data, tableName, keyColumns)
 	if err != nil {
 		return
 	}
-	err = mc.insert(db, data, tableName)
+	err = mc.insert(db, data)
 	return
 }
+
+// 来源集合或db删除，按配置删除或清空目标表
+func (mc *MysqlConsumer) drop(data *models.ChangeEvent) error {
+	action, collections := dropCollections(mc.cfg, data)
+	for _, v := range collections {
+		tableName := mc.cfg.GetDestinationCollection(v)
+		sql := fmt.Sprintf("DROP TABLE IF EXISTS `%s`", tableName)
+		if action == config.DDLDropTruncate {
+			if !mc.db.HasTable(tableName) {
+				continue
+			}
+			sql = fmt.Sprintf("TRUNCATE TABLE `%s`", tableName)
+		}
+		err := mc.db.Exec(sql).Error
+		if err != nil {
+			logger.GlobalLogger.Errorw("mysql删除目标表错误", "err", err, "action", action, "table", tableName, "cfg", mc.cfg)
+			return err
+		}
+		log.Println("mysql删除目标表成功", action, tableName)
+	}
+	return nil
+}
+
+// 来源集合重命名，同步重命名目标表
+func (mc *MysqlConsumer) rename(data *models.ChangeEvent, tableName string) error {
+	to, ok := renameDestination(mc.cfg, data)
+	if !ok || !mc.db.HasTable(tableName) {
+		return nil
+	}
+	err := mc.db.Exec(fmt.Sprintf("RENAME TABLE `%s` TO `%s`", tableName, to)).Error
+	if err != nil {
+		logger.GlobalLogger.Errorw("mysql重命名目标表错误", "err", err, "table", tableName, "to", to, "cfg", mc.cfg)
+		return err
+	}
+	log.Println("mysql重命名目标表成功", tableName, to)
+	return nil
+}
+
+// mysql临时错误码，其余mysql服务端错误(语法、类型、列不存在等)重试无法解决
+var mysqlTransientErrors = map[uint16]bool{
+	1040: true, // Too many connections
+	1053: true, // Server shutdown in progress
+	1158: true, // 网络读写错误
+	1159: true,
+	1160: true,
+	1161: true,
+	1205: true, // Lock wait timeout exceeded
+	1213: true, // Deadlock found
+	1290: true, // 主从切换时的 --read-only
+	1317: true, // Query execution was interrupted
+	1792: true, // Cannot execute statement in a READ ONLY transaction
+	3024: true, // Query execution was interrupted, maximum statement execution time exceeded
+}
+
+// IsPermanentError mysql服务端返回的非临时错误为永久错误，连接错误为临时错误
+func (mc *MysqlConsumer) IsPermanentError(err error) bool {
+	if errs, ok := err.(gorm.Errors); ok {
+		for _, v := range errs {
+			if !mc.IsPermanentError(v) {
+				return false
+			}
+		}
+		return len(errs) > 0
+	}
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return !mysqlTransientErrors[mysqlErr.Number]
+}
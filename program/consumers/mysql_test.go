@@ -0,0 +1,125 @@
+package consumers
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 使用sqlmock的mysql消费者，goods写入表t_goods
+func newTestMysqlConsumer(t *testing.T) (*MysqlConsumer, sqlmock.Sqlmock) {
+	t.Helper()
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("mysql", sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.BlockGlobalUpdate(true)
+	return &MysqlConsumer{
+		cfg: &config.SyncConfig{
+			Type:          TypeMysql,
+			SourceDb:      "src",
+			DestinationDb: "dst",
+			Collections:   map[string]string{"goods": "t_goods"},
+		},
+		db: db,
+	}, mock
+}
+
+// 检查表是否存在，返回已存在
+func expectMysqlTable(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT DATABASE()")).WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("dst"))
+	mock.ExpectQuery(regexp.QuoteMeta("SHOW TABLES FROM `dst`")).WithArgs("t_goods").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("t_goods"))
+}
+
+func TestMysqlInsertReplay(t *testing.T) {
+	mc, mock := newTestMysqlConsumer(t)
+	insertSql := regexp.QuoteMeta("INSERT INTO `t_goods` (`document_key`,`name`) VALUES (?,?) ON DUPLICATE KEY UPDATE `name`=VALUES(`name`)")
+	// 第二次为重启或重试后重放的同一个插入，更新已有行
+	expectMysqlTable(mock)
+	mock.ExpectExec(insertSql).WithArgs("g1", "a").WillReturnResult(sqlmock.NewResult(1, 1))
+	expectMysqlTable(mock)
+	mock.ExpectExec(insertSql).WithArgs("g1", "a").WillReturnResult(sqlmock.NewResult(0, 2))
+
+	for i := 0; i < 2; i++ {
+		if err := mc.HandleData(context.Background(), testEvent(t, "insert", "goods", "g1", bson.M{"name": "a"})); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMysqlBatchInsertReplay(t *testing.T) {
+	mc, mock := newTestMysqlConsumer(t)
+	insertSql := regexp.QuoteMeta("INSERT INTO `t_goods` (`document_key`,`name`) VALUES (?,?),(?,?) ON DUPLICATE KEY UPDATE `name`=VALUES(`name`)")
+	batch := func() []*models.ChangeEvent {
+		return []*models.ChangeEvent{
+			testEvent(t, "insert", "goods", "g1", bson.M{"name": "a"}),
+			testEvent(t, "insert", "goods", "g2", bson.M{"name": "b"}),
+		}
+	}
+	for i := 0; i < 2; i++ {
+		expectMysqlTable(mock)
+		expectMysqlTable(mock)
+		mock.ExpectBegin()
+		mock.ExpectExec(insertSql).WithArgs("g1", "a", "g2", "b").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := mc.HandleBatch(context.Background(), batch()); err != nil {
+			t.Fatalf("batch %d: %v", i, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMysqlSnapshotHandoff(t *testing.T) {
+	mc, mock := newTestMysqlConsumer(t)
+	// 全量复制的文档为replace，订阅在复制前打开，衔接时重放同一个文档的插入
+	expectMysqlTable(mock)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `t_goods` WHERE `document_key` = ?")).WithArgs("g1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `t_goods` (`document_key`,`name`) VALUES (?,?) ON DUPLICATE KEY UPDATE")).WithArgs("g1", "b").WillReturnResult(sqlmock.NewResult(1, 1))
+	expectMysqlTable(mock)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `t_goods` (`document_key`,`name`) VALUES (?,?) ON DUPLICATE KEY UPDATE")).WithArgs("g1", "a").WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := mc.HandleData(context.Background(), testEvent(t, "replace", "goods", "g1", bson.M{"name": "b"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.HandleData(context.Background(), testEvent(t, "insert", "goods", "g1", bson.M{"name": "a"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMysqlUpdateValues(t *testing.T) {
+	tests := []struct {
+		columns []string
+		want    string
+	}{
+		{[]string{"age", "document_key", "name"}, "`age`=VALUES(`age`),`name`=VALUES(`name`)"},
+		// 只有唯一标识列时更新为自身
+		{[]string{"document_key"}, "`document_key`=VALUES(`document_key`)"},
+	}
+	for _, tt := range tests {
+		if got := mysqlUpdateValues(tt.columns, []string{"document_key"}); got != tt.want {
+			t.Errorf("columns %v: %s, want %s", tt.columns, got, tt.want)
+		}
+	}
+}
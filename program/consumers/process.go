@@ -0,0 +1,461 @@
+package consumers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/* 外部进程目标，启动配置的命令，每个事件以一行json写入子进程stdin，子进程按行在stdout返回确认
+ * 请求 {"id":1,"db":"目标db","collection":"目标集合","event":{事件}}
+ * 确认 {"id":1} 表示处理成功，{"id":1,"error":"原因","permanent":true} 表示处理失败，permanent为true时不重试
+ * 只有收到成功确认的事件才会推进结束位置，子进程退出后按退避间隔重启，未确认的事件重新发送 */
+
+const (
+	TypeProcess = "process"
+
+	DefaultProcessAckTimeoutMs         = 30000
+	DefaultProcessRestartMinIntervalMs = 1000
+	DefaultProcessRestartMaxIntervalMs = 60000
+)
+
+var errProcessNotRunning = errors.New("process子进程未运行")
+
+func init() {
+	Register(TypeProcess, NewProcessConsumer)
+}
+
+// ProcessConsumer 外部进程消费者，多个分区共用一个子进程，按请求id对应确认
+type ProcessConsumer struct {
+	cfg     *config.SyncConfig
+	options *ProcessOptions
+	nextID  uint64 // 请求id，原子递增
+	mutex   sync.RWMutex
+	child   *processChild // 当前运行的子进程，重启中为nil
+	stop    chan struct{} // 关闭后不再重启子进程
+	done    chan struct{} // 子进程管理结束
+}
+
+// ProcessOptions process目标专有配置 [sync.options]
+type ProcessOptions struct {
+	Command              []string          `json:"command"`                 // 命令和参数，例如 ["python3", "transform.py"]
+	Dir                  string            `json:"dir"`                     // 工作目录，默认当前目录
+	Env                  map[string]string `json:"env"`                     // 附加的环境变量
+	AckTimeoutMs         int               `json:"ack_timeout_ms"`          // 等待确认的毫秒数，超时后重试，默认30000
+	RestartMinIntervalMs int               `json:"restart_min_interval_ms"` // 子进程退出后首次重启间隔毫秒数，默认1000
+	RestartMaxIntervalMs int               `json:"restart_max_interval_ms"` // 子进程连续退出时最大重启间隔毫秒数，默认60000
+}
+
+// 写入子进程的一行请求
+type processRequest struct {
+	ID         uint64              `json:"id"`
+	Db         string              `json:"db"`
+	Collection string              `json:"collection"`
+	Event      *models.ChangeEvent `json:"event"`
+}
+
+// 子进程返回的一行确认
+type processAck struct {
+	ID        uint64 `json:"id"`
+	Error     string `json:"error,omitempty"`
+	Permanent bool   `json:"permanent,omitempty"`
+}
+
+// 一个运行中的子进程
+type processChild struct {
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	writeMutex sync.Mutex // 多个分区同时写入时保证每行完整
+	mutex      sync.Mutex
+	pending    map[uint64]chan *processAck // 等待确认的请求
+	exited     chan struct{}               // 子进程退出后关闭
+	err        error                       // 退出原因，exited关闭后可读
+}
+
+// NewProcessConsumer 创建一个外部进程消费对象，启动子进程失败时返回错误
+func NewProcessConsumer(cfg *config.SyncConfig) (Consumer, error) {
+	processConsumer := &ProcessConsumer{
+		cfg:     cfg,
+		options: new(ProcessOptions),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	err := cfg.DecodeOptions(processConsumer.options)
+	if err != nil {
+		return nil, err
+	}
+	if len(processConsumer.options.Command) == 0 || processConsumer.options.Command[0] == "" {
+		return nil, errors.New("process配置command不能为空")
+	}
+	child, err := processConsumer.start()
+	if err != nil {
+		return nil, err
+	}
+	processConsumer.child = child
+	go processConsumer.run(child)
+	return processConsumer, nil
+}
+
+// 启动子进程
+func (pc *ProcessConsumer) start() (*processChild, error) {
+	cmd := exec.Command(pc.options.Command[0], pc.options.Command[1:]...)
+	cmd.Dir = pc.options.Dir
+	if len(pc.options.Env) > 0 {
+		cmd.Env = os.Environ()
+		for k, v := range pc.options.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("process启动子进程错误: %v", err)
+	}
+	child := &processChild{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[uint64]chan *processAck),
+		exited:  make(chan struct{}),
+	}
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		pc.logStderr(stderr)
+	}()
+	go func() {
+		pc.readAcks(child, stdout)
+		// 读取完管道后才能Wait
+		<-stderrDone
+		child.err = cmd.Wait()
+		if child.err == nil {
+			child.err = errors.New("process子进程已退出")
+		}
+		close(child.exited)
+	}()
+	logger.GlobalLogger.Infow("process子进程已启动", "pid", cmd.Process.Pid, "command", pc.options.Command, "key", pc.cfg.GetKey())
+	return child, nil
+}
+
+// 管理子进程，退出后按指数退避间隔重启，运行时间超过最大间隔后重新从最小间隔开始
+func (pc *ProcessConsumer) run(child *processChild) {
+	defer close(pc.done)
+	interval := time.Duration(0)
+	for {
+		var err error
+		if child != nil {
+			started := time.Now()
+			select {
+			case <-child.exited:
+			case <-pc.stop:
+				pc.setChild(nil)
+				child.close()
+				return
+			}
+			pc.setChild(nil)
+			err = child.err
+			if time.Since(started) > pc.restartMaxInterval() {
+				interval = 0
+			}
+		}
+		if interval == 0 {
+			interval = pc.restartMinInterval()
+		} else {
+			interval *= 2
+		}
+		if max := pc.restartMaxInterval(); interval > max {
+			interval = max
+		}
+		logger.GlobalLogger.Errorw("process子进程未运行，等待重启", "err", err, "key", pc.cfg.GetKey(), "restart_interval", interval.String())
+		log.Println("process子进程未运行，等待重启", pc.cfg.GetKey(), err)
+		select {
+		case <-time.After(interval):
+		case <-pc.stop:
+			return
+		}
+		child, err = pc.start()
+		if err != nil {
+			logger.GlobalLogger.Errorw("process重启子进程错误", "err", err, "key", pc.cfg.GetKey())
+			child = nil
+			continue
+		}
+		pc.setChild(child)
+	}
+}
+
+func (pc *ProcessConsumer) setChild(child *processChild) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.child = child
+}
+
+func (pc *ProcessConsumer) getChild() *processChild {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+	return pc.child
+}
+
+func (pc *ProcessConsumer) ackTimeout() time.Duration {
+	if pc.options.AckTimeoutMs <= 0 {
+		return DefaultProcessAckTimeoutMs * time.Millisecond
+	}
+	return time.Duration(pc.options.AckTimeoutMs) * time.Millisecond
+}
+
+func (pc *ProcessConsumer) restartMinInterval() time.Duration {
+	if pc.options.RestartMinIntervalMs <= 0 {
+		return DefaultProcessRestartMinIntervalMs * time.Millisecond
+	}
+	return time.Duration(pc.options.RestartMinIntervalMs) * time.Millisecond
+}
+
+func (pc *ProcessConsumer) restartMaxInterval() time.Duration {
+	if pc.options.RestartMaxIntervalMs <= 0 {
+		return DefaultProcessRestartMaxIntervalMs * time.Millisecond
+	}
+	return time.Duration(pc.options.RestartMaxIntervalMs) * time.Millisecond
+}
+
+// 读取子进程stdout的确认，交给等待的请求，直到子进程关闭stdout
+func (pc *ProcessConsumer) readAcks(child *processChild, stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			ack := new(processAck)
+			if jsonErr := json.Unmarshal(line, ack); jsonErr != nil {
+				logger.GlobalLogger.Warnw("process子进程输出的确认格式错误，忽略", "err", jsonErr, "line", string(line), "key", pc.cfg.GetKey())
+			} else if !child.ack(ack) {
+				logger.GlobalLogger.Warnw("process子进程确认的请求不存在或已超时，忽略", "id", ack.ID, "key", pc.cfg.GetKey())
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 子进程stderr按行输出到日志
+func (pc *ProcessConsumer) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		logger.GlobalLogger.Infow("process子进程输出", "line", scanner.Text(), "key", pc.cfg.GetKey())
+	}
+}
+
+// Capabilities 事件原样交给子进程，由子进程处理增量更新和表结构变化，不支持事务
+func (pc *ProcessConsumer) Capabilities() Capabilities {
+	return Capabilities{
+		Batch:       true,
+		DeltaUpdate: true,
+		Rename:      true,
+		Drop:        true,
+	}
+}
+
+// Health 检查子进程是否运行
+func (pc *ProcessConsumer) Health(ctx context.Context) error {
+	if pc.getChild() == nil {
+		return errProcessNotRunning
+	}
+	return nil
+}
+
+// 销毁连接，关闭子进程stdin，超时未退出时结束子进程
+func (pc *ProcessConsumer) Disconnect() error {
+	select {
+	case <-pc.stop:
+	default:
+		close(pc.stop)
+	}
+	<-pc.done
+	return nil
+}
+
+// 处理一条消息
+func (pc *ProcessConsumer) HandleData(ctx context.Context, data *models.ChangeEvent) error {
+	if data == nil {
+		return errors.New("process处理收到数据为nil")
+	}
+	log.Println("process处理收到数据", data.Namespace.Db, data.Namespace.Coll, data.Operation)
+	return pc.send(ctx, []*models.ChangeEvent{data})
+}
+
+// HandleBatch 一批消息一次写入子进程，全部确认成功后返回
+func (pc *ProcessConsumer) HandleBatch(ctx context.Context, data []*models.ChangeEvent) error {
+	log.Println("process批量处理收到数据", len(data))
+	return pc.send(ctx, data)
+}
+
+// 将事件写入子进程并等待全部确认，任一事件失败或超时返回错误，整批重试
+func (pc *ProcessConsumer) send(ctx context.Context, data []*models.ChangeEvent) error {
+	child := pc.getChild()
+	if child == nil {
+		return errProcessNotRunning
+	}
+	ids := make([]uint64, 0, len(data))
+	acks := make([]chan *processAck, 0, len(data))
+	defer func() {
+		child.cancel(ids)
+	}()
+	body := make([]byte, 0)
+	for _, v := range data {
+		request := &processRequest{
+			ID:         atomic.AddUint64(&pc.nextID, 1),
+			Db:         pc.cfg.DestinationDb,
+			Collection: pc.cfg.GetDestinationCollection(v.Namespace.Coll),
+			Event:      v,
+		}
+		js, err := json.Marshal(request)
+		if err != nil {
+			logger.GlobalLogger.Errorw("process处理收到数据转json错误", "err", err, "data", v)
+			return Permanent(err)
+		}
+		body = append(body, js...)
+		body = append(body, '\n')
+		ids = append(ids, request.ID)
+		acks = append(acks, child.wait(request.ID))
+	}
+	// 子进程不读取stdin时写入会一直阻塞，写入和确认共用确认超时
+	timer := time.NewTimer(pc.ackTimeout())
+	defer timer.Stop()
+	written := make(chan error, 1)
+	go func() {
+		written <- child.write(body)
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			return fmt.Errorf("process写入子进程错误: %v", err)
+		}
+	case <-child.exited:
+		return fmt.Errorf("process子进程在确认前退出: %v", child.err)
+	case <-timer.C:
+		// 结束子进程后按退避间隔重启，未确认的事件重新发送
+		child.kill("写入process子进程超时，结束子进程", pc.cfg.GetKey())
+		return fmt.Errorf("写入process子进程超时: %w", context.DeadlineExceeded)
+	case <-ctx.Done():
+		// 可能只写入了部分请求，结束子进程避免之后的请求行不完整
+		child.kill("写入process子进程时已取消，结束子进程", pc.cfg.GetKey())
+		return ctx.Err()
+	}
+	for i, ch := range acks {
+		select {
+		case ack := <-ch:
+			if ack.Error == "" {
+				continue
+			}
+			err := fmt.Errorf("process子进程处理事件失败: %s", ack.Error)
+			logger.GlobalLogger.Errorw("process子进程处理事件失败", "err", err, "permanent", ack.Permanent, "namespace", data[i].Namespace, "key", pc.cfg.GetKey())
+			if ack.Permanent {
+				return Permanent(err)
+			}
+			return err
+		case <-child.exited:
+			return fmt.Errorf("process子进程在确认前退出: %v", child.err)
+		case <-timer.C:
+			// 子进程可能已卡住，与写入超时相同结束子进程后重启
+			child.kill("等待process子进程确认超时，结束子进程", pc.cfg.GetKey())
+			return fmt.Errorf("等待process子进程确认超时: %w", context.DeadlineExceeded)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	logger.GlobalLogger.Debugw("process子进程确认成功", "count", len(data), "key", pc.cfg.GetKey())
+	return nil
+}
+
+// FilterField 删除无用
+func (pc *ProcessConsumer) FilterField(collection string, document bson.M) error {
+	if document == nil {
+		return nil
+	}
+	for k := range document {
+		if !pc.cfg.InCollectionField(collection, k) {
+			delete(document, k)
+		}
+	}
+	return nil
+}
+
+// 登记等待确认的请求
+func (c *processChild) wait(id uint64) chan *processAck {
+	ch := make(chan *processAck, 1)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pending[id] = ch
+	return ch
+}
+
+// 取消等待，已确认的请求已删除
+func (c *processChild) cancel(ids []uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, id := range ids {
+		delete(c.pending, id)
+	}
+}
+
+// 交给等待的请求，请求不存在时返回false
+func (c *processChild) ack(ack *processAck) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ch, ok := c.pending[ack.ID]
+	if !ok {
+		return false
+	}
+	delete(c.pending, ack.ID)
+	ch <- ack
+	return true
+}
+
+// 写入多行请求
+func (c *processChild) write(body []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.stdin.Write(body)
+	return err
+}
+
+// 结束子进程，阻塞的写入随之返回错误
+func (c *processChild) kill(msg, key string) {
+	logger.GlobalLogger.Warnw(msg, "pid", c.cmd.Process.Pid, "key", key)
+	c.cmd.Process.Kill()
+}
+
+// 关闭stdin通知子进程结束，超时未退出时结束子进程
+func (c *processChild) close() {
+	c.stdin.Close()
+	select {
+	case <-c.exited:
+		return
+	case <-time.After(TimeoutCtx):
+	}
+	logger.GlobalLogger.Warnw("process子进程未在超时前退出，结束子进程", "pid", c.cmd.Process.Pid)
+	c.cmd.Process.Kill()
+	<-c.exited
+}
@@ -0,0 +1,110 @@
+package consumers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func newTestProcessConsumer(t *testing.T, options map[string]interface{}) *ProcessConsumer {
+	t.Helper()
+	cfg := &config.SyncConfig{
+		Type:          TypeProcess,
+		SourceDb:      "src",
+		DestinationDb: "dst",
+		Collections:   map[string]string{"goods": "t_goods"},
+		Options:       options,
+	}
+	consumer, err := NewProcessConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { consumer.Disconnect() })
+	return consumer.(*ProcessConsumer)
+}
+
+func TestProcessAck(t *testing.T) {
+	// 每行请求返回对应id的成功确认
+	pc := newTestProcessConsumer(t, map[string]interface{}{
+		"command": []string{"sed", "-u", `s/^{"id":\([0-9]*\).*/{"id":\1}/`},
+	})
+	err := pc.HandleBatch(context.Background(), []*models.ChangeEvent{
+		testEvent(t, "insert", "goods", "1", bson.M{"name": "a"}),
+		testEvent(t, "delete", "goods", "2", nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessWriteTimeout(t *testing.T) {
+	// 子进程不读取stdin，写满管道后写入阻塞
+	pc := newTestProcessConsumer(t, map[string]interface{}{
+		"command":                 []string{"sleep", "60"},
+		"ack_timeout_ms":          100,
+		"restart_min_interval_ms": 60000,
+	})
+	child := pc.getChild()
+	started := time.Now()
+	err := pc.HandleData(context.Background(), testEvent(t, "insert", "goods", "1", bson.M{"name": strings.Repeat("a", 1<<20)}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want deadline exceeded", err)
+	}
+	if IsPermanentError(pc, err) {
+		t.Errorf("write timeout error %v is permanent", err)
+	}
+	if elapsed := time.Since(started); elapsed > TimeoutCtx {
+		t.Errorf("write took %v", elapsed)
+	}
+	// 超时后结束子进程，等待重启
+	select {
+	case <-child.exited:
+	case <-time.After(TimeoutCtx):
+		t.Fatal("child not killed after write timeout")
+	}
+}
+
+func TestProcessAckTimeout(t *testing.T) {
+	// 子进程读取请求但不返回确认
+	pc := newTestProcessConsumer(t, map[string]interface{}{
+		"command":                 []string{"sh", "-c", "exec cat > /dev/null"},
+		"ack_timeout_ms":          100,
+		"restart_min_interval_ms": 60000,
+	})
+	child := pc.getChild()
+	err := pc.HandleData(context.Background(), testEvent(t, "insert", "goods", "1", bson.M{"name": "a"}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want deadline exceeded", err)
+	}
+	// 确认超时后结束子进程，等待重启
+	select {
+	case <-child.exited:
+	case <-time.After(TimeoutCtx):
+		t.Fatal("child not killed after ack timeout")
+	}
+}
+
+func TestProcessWriteCanceled(t *testing.T) {
+	pc := newTestProcessConsumer(t, map[string]interface{}{
+		"command":                 []string{"sleep", "60"},
+		"restart_min_interval_ms": 60000,
+	})
+	child := pc.getChild()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := pc.HandleData(ctx, testEvent(t, "insert", "goods", "1", bson.M{"name": strings.Repeat("a", 1<<20)}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want context deadline exceeded", err)
+	}
+	select {
+	case <-child.exited:
+	case <-time.After(TimeoutCtx):
+		t.Fatal("child not killed after canceled write")
+	}
+}
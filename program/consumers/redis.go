@@ -0,0 +1,383 @@
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* redis目标，按mode处理事件
+ * invalidate 文档变化时删除按key_template生成的缓存key
+ * hash 文档镜像为hash，每个顶层字段一个hash字段
+ * json 文档镜像为mongo扩展json字符串
+ * stream 事件追加到按stream_key生成的stream
+ * key模板中 {db} 为目标db，{collection} 为目标集合，{id} 为文档_id */
+
+const (
+	TypeRedis = "redis"
+
+	RedisModeInvalidate = "invalidate"
+	RedisModeHash       = "hash"
+	RedisModeJson       = "json"
+	RedisModeStream     = "stream"
+
+	DefaultRedisKeyTemplate = "{db}:{collection}:{id}"
+	DefaultRedisStreamKey   = "{db}:{collection}"
+	RedisScanCount          = 1000 // 删除集合时每次scan的key数
+)
+
+func init() {
+	Register(TypeRedis, NewRedisConsumer)
+}
+
+// RedisConsumer redis消费者
+type RedisConsumer struct {
+	cfg     *config.SyncConfig
+	options *RedisOptions
+	client  *redis.Client
+}
+
+// RedisOptions redis目标专有配置 [sync.options]
+type RedisOptions struct {
+	Mode         string `json:"mode"`           // 处理方式 invalidate hash json stream，默认invalidate
+	KeyTemplate  string `json:"key_template"`   // 缓存key模板，默认 {db}:{collection}:{id}
+	TTLSeconds   int    `json:"ttl_seconds"`    // hash和json镜像的过期秒数，为0时不过期
+	StreamKey    string `json:"stream_key"`     // stream key模板，默认 {db}:{collection}
+	StreamMaxLen int64  `json:"stream_max_len"` // stream近似最大长度，为0时不裁剪
+}
+
+// NewRedisConsumer 创建一个redis消费对象
+func NewRedisConsumer(cfg *config.SyncConfig) (Consumer, error) {
+	redisConsumer := &RedisConsumer{
+		cfg: cfg,
+		options: &RedisOptions{
+			Mode:        RedisModeInvalidate,
+			KeyTemplate: DefaultRedisKeyTemplate,
+			StreamKey:   DefaultRedisStreamKey,
+		},
+	}
+	err := cfg.DecodeOptions(redisConsumer.options)
+	if err != nil {
+		return nil, err
+	}
+	switch redisConsumer.options.Mode {
+	case RedisModeInvalidate, RedisModeHash, RedisModeJson:
+		if !strings.Contains(redisConsumer.options.KeyTemplate, "{id}") {
+			return nil, errors.New("redis配置key_template必须包含{id}")
+		}
+	case RedisModeStream:
+	default:
+		return nil, fmt.Errorf("redis配置mode只能为 invalidate hash json stream: %s", redisConsumer.options.Mode)
+	}
+	err = redisConsumer.InitClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return redisConsumer, nil
+}
+
+// 初始化连接，destination_uri为 redis://:密码@地址:端口/db 格式
+func (rc *RedisConsumer) InitClient(cfg *config.SyncConfig) error {
+	if cfg.DestinationUri == "" {
+		return errors.New("redis目标db链接配置错误")
+	}
+	redisOptions, err := redis.ParseURL(cfg.DestinationUri)
+	if err != nil {
+		return fmt.Errorf("redis目标db链接配置错误: %v", err)
+	}
+	rc.client = redis.NewClient(redisOptions)
+	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+	defer cancel()
+	err = rc.client.Ping(ctx).Err()
+	if err != nil {
+		rc.client.Close()
+		return err
+	}
+	return nil
+}
+
+// Capabilities 镜像需要完整文档，不支持增量更新，stream原样记录所有事件
+func (rc *RedisConsumer) Capabilities() Capabilities {
+	capabilities := Capabilities{
+		Batch: true,
+		Drop:  true,
+	}
+	switch rc.options.Mode {
+	case RedisModeInvalidate:
+		capabilities.DeltaUpdate = true
+	case RedisModeStream:
+		capabilities.DeltaUpdate = true
+		capabilities.Rename = true
+	}
+	return capabilities
+}
+
+// Health 检查目标redis是否可用
+func (rc *RedisConsumer) Health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+	defer cancel()
+	return rc.client.Ping(ctx).Err()
+}
+
+// 销毁连接
+func (rc *RedisConsumer) Disconnect() error {
+	if rc.client != nil {
+		return rc.client.Close()
+	}
+	return nil
+}
+
+// 处理一条消息
+func (rc *RedisConsumer) HandleData(ctx context.Context, data *models.ChangeEvent) error {
+	if data == nil {
+		return errors.New("redis处理收到数据为nil")
+	}
+	log.Println("redis处理收到数据", data.Namespace.Db, data.Namespace.Coll, data.Operation)
+	return rc.handle(ctx, []*models.ChangeEvent{data})
+}
+
+// HandleBatch 一批消息在一个MULTI中按顺序执行
+func (rc *RedisConsumer) HandleBatch(ctx context.Context, data []*models.ChangeEvent) error {
+	log.Println("redis批量处理收到数据", len(data))
+	return rc.handle(ctx, data)
+}
+
+func (rc *RedisConsumer) handle(ctx context.Context, data []*models.ChangeEvent) error {
+	pipe := rc.client.TxPipeline()
+	for _, v := range data {
+		ok, err := rc.queue(pipe, v)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		// 删除集合需要scan，不能放在MULTI中，先执行之前的命令保证顺序
+		if err := rc.exec(ctx, pipe); err != nil {
+			return err
+		}
+		if err := rc.handleDDL(ctx, v); err != nil {
+			return err
+		}
+	}
+	return rc.exec(ctx, pipe)
+}
+
+// 执行MULTI中的命令
+func (rc *RedisConsumer) exec(ctx context.Context, pipe redis.Pipeliner) error {
+	if pipe.Len() == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+	defer cancel()
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		logger.GlobalLogger.Errorw("redis执行命令错误", "err", err, "cfg", rc.cfg)
+	}
+	return err
+}
+
+// 一条消息对应的命令加入MULTI，表结构变化等需要单独处理的事件返回false
+func (rc *RedisConsumer) queue(pipe redis.Pipeliner, data *models.ChangeEvent) (bool, error) {
+	if rc.options.Mode == RedisModeStream {
+		return true, rc.queueStream(pipe, data)
+	}
+	switch data.Operation {
+	case "insert", "update", "replace", "delete":
+	case "drop", "dropDatabase", "rename":
+		return false, nil
+	default:
+		return false, Permanent(errors.New("未知事件类型"))
+	}
+	key := rc.key(data.Namespace.Coll, data.DocumentKey.IDString())
+	// 删除或没有变更后文档时只删除key
+	if rc.options.Mode == RedisModeInvalidate || data.Operation == "delete" || data.Document == nil {
+		pipe.Del(context.Background(), key)
+		return true, nil
+	}
+	ttl := time.Duration(rc.options.TTLSeconds) * time.Second
+	if rc.options.Mode == RedisModeJson {
+		js, err := bson.MarshalExtJSON(data.Document, false, false)
+		if err != nil {
+			return false, Permanent(err)
+		}
+		pipe.Set(context.Background(), key, js, ttl)
+		return true, nil
+	}
+	// 先删除，已删除的字段不会残留在hash中
+	values := make([]interface{}, 0, len(data.Document)*2)
+	for k, v := range data.Document {
+		val, err := redisHashValue(v)
+		if err != nil {
+			return false, Permanent(err)
+		}
+		values = append(values, k, val)
+	}
+	pipe.Del(context.Background(), key)
+	if len(values) > 0 {
+		pipe.HSet(context.Background(), key, values...)
+	}
+	if ttl > 0 {
+		pipe.Expire(context.Background(), key, ttl)
+	}
+	return true, nil
+}
+
+// 事件追加到stream
+func (rc *RedisConsumer) queueStream(pipe redis.Pipeliner, data *models.ChangeEvent) error {
+	event, err := json.Marshal(newEventMessage(rc.cfg, data))
+	if err != nil {
+		logger.GlobalLogger.Errorw("redis处理收到数据转json错误", "err", err, "data", data)
+		return Permanent(err)
+	}
+	documentKey, err := data.DocumentKey.MarshalJSON()
+	if err != nil {
+		return Permanent(err)
+	}
+	args := &redis.XAddArgs{
+		Stream: rc.streamKey(data.Namespace.Coll),
+		Values: []interface{}{
+			"operation", data.Operation,
+			"db", rc.cfg.DestinationDb,
+			"collection", rc.cfg.GetDestinationCollection(data.Namespace.Coll),
+			"document_key", string(documentKey),
+			"event", string(event),
+		},
+	}
+	if rc.options.StreamMaxLen > 0 {
+		args.MaxLen = rc.options.StreamMaxLen
+		args.Approx = true
+	}
+	pipe.XAdd(context.Background(), args)
+	return nil
+}
+
+// 来源集合或db删除时删除对应的全部key，不支持重命名
+func (rc *RedisConsumer) handleDDL(ctx context.Context, data *models.ChangeEvent) error {
+	if data.Operation == "rename" {
+		logger.GlobalLogger.Warnw("redis不支持重命名key，忽略重命名事件", "namespace", data.Namespace, "to", data.NewCollectionName, "cfg", rc.cfg)
+		return nil
+	}
+	_, collections := dropCollections(rc.cfg, data)
+	for _, v := range collections {
+		pattern := rc.keyPattern(v)
+		count, err := rc.deleteKeys(ctx, pattern)
+		if err != nil {
+			logger.GlobalLogger.Errorw("redis删除集合对应的key错误", "err", err, "pattern", pattern, "cfg", rc.cfg)
+			return err
+		}
+		logger.GlobalLogger.Infow("来源集合已删除，删除对应的key", "collection", v, "pattern", pattern, "count", count)
+	}
+	return nil
+}
+
+// scan删除匹配的key
+func (rc *RedisConsumer) deleteKeys(ctx context.Context, pattern string) (int, error) {
+	count := 0
+	cursor := uint64(0)
+	for {
+		scanCtx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+		keys, next, err := rc.client.Scan(scanCtx, cursor, pattern, RedisScanCount).Result()
+		if err == nil && len(keys) > 0 {
+			err = rc.client.Del(scanCtx, keys...).Err()
+		}
+		cancel()
+		if err != nil {
+			return count, err
+		}
+		count += len(keys)
+		if next == 0 {
+			return count, nil
+		}
+		cursor = next
+	}
+}
+
+// 来源集合和文档_id对应的key
+func (rc *RedisConsumer) key(collection, id string) string {
+	return strings.NewReplacer(
+		"{db}", rc.cfg.DestinationDb,
+		"{collection}", rc.cfg.GetDestinationCollection(collection),
+		"{id}", id,
+	).Replace(rc.options.KeyTemplate)
+}
+
+// 来源集合全部key的scan匹配模式，目标db和集合名中的通配符需要转义
+func (rc *RedisConsumer) keyPattern(collection string) string {
+	return strings.NewReplacer(
+		"{db}", redisGlobEscape(rc.cfg.DestinationDb),
+		"{collection}", redisGlobEscape(rc.cfg.GetDestinationCollection(collection)),
+		"{id}", "*",
+	).Replace(redisGlobEscape(rc.options.KeyTemplate))
+}
+
+// 来源集合对应的stream key
+func (rc *RedisConsumer) streamKey(collection string) string {
+	return strings.NewReplacer(
+		"{db}", rc.cfg.DestinationDb,
+		"{collection}", rc.cfg.GetDestinationCollection(collection),
+	).Replace(rc.options.StreamKey)
+}
+
+// 转义scan匹配模式中的通配符
+func redisGlobEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+// 文档字段转换为hash字段值，ObjectID为hex，字符串和数字为原值，其它类型为mongo扩展json
+func redisHashValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return val, nil
+	case primitive.ObjectID:
+		return val.Hex(), nil
+	case int32, int64, float64, bool:
+		return fmt.Sprint(val), nil
+	}
+	js, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, false, false)
+	if err != nil {
+		return "", err
+	}
+	// 去掉外层 {"v": 和 }
+	return string(js[5 : len(js)-1]), nil
+}
+
+// IsPermanentError 类型错误、语法错误等redis返回的错误重试无法解决，加载中、只读等错误为临时错误
+func (rc *RedisConsumer) IsPermanentError(err error) bool {
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return false
+	}
+	for _, prefix := range []string{"LOADING", "BUSY", "TRYAGAIN", "CLUSTERDOWN", "READONLY", "MASTERDOWN", "OOM", "MOVED", "ASK"} {
+		if strings.HasPrefix(redisErr.Error(), prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterField 删除无用
+func (rc *RedisConsumer) FilterField(collection string, document bson.M) error {
+	if document == nil {
+		return nil
+	}
+	for k := range document {
+		if !rc.cfg.InCollectionField(collection, k) {
+			delete(document, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 连接miniredis的redis消费者，goods写入t_goods
+func newTestRedisConsumer(t *testing.T, options map[string]interface{}) (*RedisConsumer, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	cfg := &config.SyncConfig{
+		Type:           TypeRedis,
+		DestinationUri: "redis://" + mr.Addr(),
+		SourceDb:       "src",
+		DestinationDb:  "dst",
+		Collections:    map[string]string{"goods": "t_goods", "users": "users"},
+		Options:        options,
+	}
+	consumer, err := NewRedisConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { consumer.Disconnect() })
+	return consumer.(*RedisConsumer), mr
+}
+
+func TestRedisInvalidate(t *testing.T) {
+	rc, mr := newTestRedisConsumer(t, nil)
+	mr.Set("dst:t_goods:1", "cached")
+	mr.Set("dst:t_goods:2", "cached")
+
+	// 增量更新没有完整文档，同样删除key
+	update := testEvent(t, "update", "goods", "1", nil)
+	update.Updates = &models.UpdateDescription{UpdatedFields: bson.M{"name": "b"}}
+	if err := rc.HandleData(context.Background(), update); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("dst:t_goods:1") {
+		t.Error("key not invalidated after update")
+	}
+	if !mr.Exists("dst:t_goods:2") {
+		t.Error("unrelated key invalidated")
+	}
+}
+
+func TestRedisHash(t *testing.T) {
+	rc, mr := newTestRedisConsumer(t, map[string]interface{}{"mode": RedisModeHash, "ttl_seconds": 60})
+	ctx := context.Background()
+
+	err := rc.HandleData(ctx, testEvent(t, "insert", "goods", "1", bson.M{"name": "a", "price": int32(3), "tags": bson.A{"x"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"name": "a", "price": "3", "tags": `["x"]`}
+	for k, v := range want {
+		if got := mr.HGet("dst:t_goods:1", k); got != v {
+			t.Errorf("field %s = %q, want %q", k, got, v)
+		}
+	}
+	if ttl := mr.TTL("dst:t_goods:1"); ttl <= 0 {
+		t.Errorf("ttl = %v, want > 0", ttl)
+	}
+
+	// 替换后已删除的字段不残留
+	if err := rc.HandleData(ctx, testEvent(t, "replace", "goods", "1", bson.M{"name": "b"})); err != nil {
+		t.Fatal(err)
+	}
+	fields, err := mr.HKeys("dst:t_goods:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || fields[0] != "name" || mr.HGet("dst:t_goods:1", "name") != "b" {
+		t.Errorf("fields after replace = %v", fields)
+	}
+
+	if err := rc.HandleData(ctx, testEvent(t, "delete", "goods", "1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("dst:t_goods:1") {
+		t.Error("key exists after delete")
+	}
+}
+
+func TestRedisJson(t *testing.T) {
+	rc, mr := newTestRedisConsumer(t, map[string]interface{}{"mode": RedisModeJson, "key_template": "cache:{collection}:{id}"})
+	ctx := context.Background()
+
+	if err := rc.HandleData(ctx, testEvent(t, "insert", "users", int32(7), bson.M{"name": "a", "age": int32(20)})); err != nil {
+		t.Fatal(err)
+	}
+	js, err := mr.Get("cache:users:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	document := bson.M{}
+	if err := bson.UnmarshalExtJSON([]byte(js), false, &document); err != nil {
+		t.Fatal(err)
+	}
+	if document["name"] != "a" || document["age"] != int32(20) {
+		t.Errorf("document = %s", js)
+	}
+
+	if err := rc.HandleData(ctx, testEvent(t, "delete", "users", int32(7), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("cache:users:7") {
+		t.Error("key exists after delete")
+	}
+}
+
+func TestRedisStream(t *testing.T) {
+	rc, mr := newTestRedisConsumer(t, map[string]interface{}{"mode": RedisModeStream})
+
+	err := rc.HandleBatch(context.Background(), []*models.ChangeEvent{
+		testEvent(t, "insert", "goods", "1", bson.M{"name": "a"}),
+		testEvent(t, "delete", "goods", "1", nil),
+		testEvent(t, "insert", "users", "2", bson.M{"name": "b"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := mr.Stream("dst:t_goods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("entries = %d, want 2", len(entries))
+	}
+	for i, operation := range []string{"insert", "delete"} {
+		values := make(map[string]string)
+		for j := 0; j+1 < len(entries[i].Values); j += 2 {
+			values[entries[i].Values[j]] = entries[i].Values[j+1]
+		}
+		if values["operation"] != operation || values["db"] != "dst" || values["collection"] != "t_goods" || values["document_key"] != `{"_id":"1"}` {
+			t.Errorf("entry %d = %v", i, values)
+		}
+		if !json.Valid([]byte(values["event"])) {
+			t.Errorf("entry %d event is not json: %s", i, values["event"])
+		}
+	}
+	if entries, _ := mr.Stream("dst:users"); len(entries) != 1 {
+		t.Errorf("users entries = %d, want 1", len(entries))
+	}
+}
+
+func TestRedisDrop(t *testing.T) {
+	rc, mr := newTestRedisConsumer(t, map[string]interface{}{"mode": RedisModeHash})
+	keys := []string{"dst:t_goods:1", "dst:t_goods:2", "dst:users:1", "dst:t_goods"}
+	for _, v := range keys {
+		mr.Set(v, "cached")
+	}
+
+	// 未开启删除时忽略
+	if err := rc.HandleData(context.Background(), testEvent(t, "drop", "goods", nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.Keys(); len(got) != len(keys) {
+		t.Fatalf("keys after ignored drop = %v", got)
+	}
+
+	// 删除前后的写入按顺序执行
+	rc.cfg.DDL = &config.DDLConfig{Drop: config.DDLDropDrop, AllowDrop: true}
+	err := rc.HandleBatch(context.Background(), []*models.ChangeEvent{
+		testEvent(t, "insert", "goods", "3", bson.M{"name": "a"}),
+		testEvent(t, "drop", "goods", nil, nil),
+		testEvent(t, "insert", "goods", "4", bson.M{"name": "b"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := mr.Keys()
+	sort.Strings(got)
+	want := []string{"dst:t_goods", "dst:t_goods:4", "dst:users:1"}
+	if len(got) != len(want) {
+		t.Fatalf("keys after drop = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("keys after drop = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package consumers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+)
+
+/* 消费者注册，每种目标类型注册一个Factory，新的目标类型放在单独的包中，导入后即可在配置中使用 */
+
+// Factory 按sync配置创建消费者并初始化连接，专有配置使用 cfg.DecodeOptions 解析
+type Factory func(cfg *config.SyncConfig) (Consumer, error)
+
+// 本仓库以外的消费者包不能导入internal包，通过别名使用同步配置和事件
+type (
+	SyncConfig  = config.SyncConfig
+	ChangeEvent = models.ChangeEvent
+)
+
+var (
+	factories    = make(map[string]Factory) // 下标为目标类型
+	factoryMutex sync.RWMutex
+)
+
+// Register 注册一种目标类型的消费者，通常在包的init中调用，重复注册会panic
+func Register(typeName string, factory Factory) {
+	factoryMutex.Lock()
+	defer factoryMutex.Unlock()
+	if factory == nil {
+		panic("消费者Factory不能为nil: " + typeName)
+	}
+	if _, ok := factories[typeName]; ok {
+		panic("消费者类型重复注册: " + typeName)
+	}
+	factories[typeName] = factory
+}
+
+// Types 已注册的目标类型
+func Types() []string {
+	factoryMutex.RLock()
+	defer factoryMutex.RUnlock()
+	types := make([]string, 0, len(factories))
+	for k := range factories {
+		types = append(types, k)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New 按sync配置的type创建消费者，检查配置需要的能力
+func New(cfg *config.SyncConfig) (Consumer, error) {
+	factoryMutex.RLock()
+	factory := factories[cfg.Type]
+	factoryMutex.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("不支持的目标类型: %s，可用的类型: %s", cfg.Type, strings.Join(Types(), " "))
+	}
+	consumer, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	capabilities := consumer.Capabilities()
+	if cfg.GetUpdateMode() == config.UpdateModeDelta && !capabilities.DeltaUpdate {
+		consumer.Disconnect()
+		return nil, fmt.Errorf("%s目标不支持update_mode为%s", cfg.Type, config.UpdateModeDelta)
+	}
+	if cfg.DDL.RenameEnabled() && !capabilities.Rename {
+		logger.GlobalLogger.Warnw("目标不支持重命名，将忽略来源集合重命名事件", "type", cfg.Type, "cfg", cfg)
+	}
+	if cfg.DDL.DropAction() != config.DDLDropIgnore && !capabilities.Drop {
+		logger.GlobalLogger.Warnw("目标不支持删除，将忽略来源集合删除事件", "type", cfg.Type, "cfg", cfg)
+	}
+	return consumer, nil
+}
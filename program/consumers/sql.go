@@ -0,0 +1,639 @@
+package consumers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite"
+)
+
+/* 通用sql目标，基于database/sql，按dialect处理mysql postgres sqlite的语法差异
+ * 文档顶层字段对应列，唯一标识写入key_columns配置的列，写入使用upsert，重放事件不会产生重复行
+ * 嵌套文档和数组以mongo扩展json写入，开启auto_create时自动建表和加列 */
+
+const (
+	TypeSql = "sql"
+
+	// 一条语句的最大参数个数，多行插入超过时拆分为多条语句
+	SqlMaxArgs = 30000
+)
+
+func init() {
+	Register(TypeSql, NewSqlConsumer)
+}
+
+// SqlConsumer 通用sql消费者
+type SqlConsumer struct {
+	debug   bool
+	cfg     *config.SyncConfig
+	options *SqlOptions
+	dialect sqlDialect
+	db      *sql.DB
+
+	lock    sync.Mutex
+	columns map[string]map[string]bool // 自动建表时已知的表和列，事务回滚后清空重新查询
+}
+
+// SqlOptions sql目标专有配置 [sync.options]
+type SqlOptions struct {
+	Dialect        string `json:"dialect"`         // 数据库类型 mysql postgres sqlite，默认mysql
+	AutoCreate     bool   `json:"auto_create"`     // 表不存在时自动创建，唯一标识列为主键，文档出现新字段时自动加列
+	DocumentColumn string `json:"document_column"` // 完整文档以json写入的列，为空时不写入
+	MaxOpenConns   int    `json:"max_open_conns"`  // 最大连接数，默认不限制，sqlite固定为1
+	LogSql         bool   `json:"log_sql"`         // 输出执行的sql，全局debug开启时也会输出
+}
+
+// sql.DB和sql.Tx都可以执行语句
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// NewSqlConsumer 创建一个通用sql消费对象
+func NewSqlConsumer(cfg *config.SyncConfig) (Consumer, error) {
+	options := new(SqlOptions)
+	err := cfg.DecodeOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	dialect, err := newSqlDialect(options.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	sqlConsumer := &SqlConsumer{
+		debug:   cfg.Debug() || options.LogSql,
+		cfg:     cfg,
+		options: options,
+		dialect: dialect,
+		columns: make(map[string]map[string]bool),
+	}
+	err = sqlConsumer.InitClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sqlConsumer, nil
+}
+
+// 初始化连接
+func (sc *SqlConsumer) InitClient(cfg *config.SyncConfig) (err error) {
+	if cfg == nil || cfg.DestinationUri == "" {
+		return errors.New("sql目标db链接(destination_uri)配置不能为空")
+	}
+	sc.db, err = sql.Open(sc.dialect.driverName(), cfg.DestinationUri)
+	if err != nil {
+		return err
+	}
+	// sqlite同一时间只能有一个写入连接
+	if _, ok := sc.dialect.(sqliteDialect); ok {
+		sc.db.SetMaxOpenConns(1)
+	} else if sc.options.MaxOpenConns > 0 {
+		sc.db.SetMaxOpenConns(sc.options.MaxOpenConns)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TimeoutCtx)
+	defer cancel()
+	err = sc.db.PingContext(ctx)
+	if err != nil {
+		sc.db.Close()
+		return err
+	}
+	return nil
+}
+
+// Capabilities 支持事务、批量、增量更新、删表和重命名表
+func (sc *SqlConsumer) Capabilities() Capabilities {
+	return Capabilities{
+		Transaction: true,
+		Batch:       true,
+		DeltaUpdate: true,
+		Rename:      true,
+		Drop:        true,
+	}
+}
+
+// Health ping数据库，同时保持连接活跃
+func (sc *SqlConsumer) Health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+	defer cancel()
+	return sc.db.PingContext(ctx)
+}
+
+// 销毁连接
+func (sc *SqlConsumer) Disconnect() error {
+	if sc.db != nil {
+		return sc.db.Close()
+	}
+	return nil
+}
+
+// IsPermanentError 数据库返回的非临时错误(语法、类型、约束等)为永久错误，连接错误为临时错误
+func (sc *SqlConsumer) IsPermanentError(err error) bool {
+	return sc.dialect.isPermanentError(err)
+}
+
+// FilterField 删除无用
+func (sc *SqlConsumer) FilterField(collection string, document bson.M) error {
+	if document == nil {
+		return nil
+	}
+	for k := range document {
+		if !sc.cfg.InCollectionField(collection, k) {
+			delete(document, k)
+		}
+	}
+	return nil
+}
+
+// 处理一条消息
+func (sc *SqlConsumer) HandleData(ctx context.Context, data *models.ChangeEvent) error {
+	if data == nil {
+		return errors.New("sql处理收到数据为nil")
+	}
+	// 替换为先删后插，在事务中执行，避免读到中间状态或插入失败后行被删除
+	if data.Operation == "replace" {
+		return sc.inTx(ctx, []*models.ChangeEvent{data}, func(tx *sql.Tx) error {
+			return sc.handle(ctx, tx, data)
+		})
+	}
+	return sc.handle(ctx, sc.db, data)
+}
+
+// HandleTransaction 同一个源事务的多条消息在一个数据库事务中处理
+func (sc *SqlConsumer) HandleTransaction(ctx context.Context, data []*models.ChangeEvent) error {
+	log.Println("sql处理收到事务", len(data))
+	return sc.inTx(ctx, data, func(tx *sql.Tx) error {
+		for _, v := range data {
+			if err := sc.handle(ctx, tx, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// HandleBatch 一批消息在一个数据库事务中处理，连续插入同一个表且列相同的行合并为一条语句
+func (sc *SqlConsumer) HandleBatch(ctx context.Context, data []*models.ChangeEvent) error {
+	log.Println("sql批量处理收到数据", len(data))
+	return sc.inTx(ctx, data, func(tx *sql.Tx) error {
+		for i := 0; i < len(data); {
+			j := i + 1
+			if data[i].Operation == "insert" {
+				for j < len(data) && data[j].Operation == "insert" && data[j].Namespace.Coll == data[i].Namespace.Coll {
+					j++
+				}
+			}
+			var err error
+			if j-i > 1 {
+				err = sc.insertRows(ctx, tx, data[i:j])
+			} else {
+				err = sc.handle(ctx, tx, data[i])
+			}
+			if err != nil {
+				return err
+			}
+			i = j
+		}
+		return nil
+	})
+}
+
+// 在事务中处理一组消息，失败时回滚
+func (sc *SqlConsumer) inTx(ctx context.Context, data []*models.ChangeEvent, fn func(tx *sql.Tx) error) error {
+	// mysql建表会隐式提交事务，需要在事务开始前完成
+	for _, v := range data {
+		if err := sc.prepareTable(ctx, sc.db, v); err != nil {
+			return err
+		}
+	}
+	tx, err := sc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		// postgres和sqlite的表结构变化随事务回滚
+		sc.resetColumns()
+		logger.GlobalLogger.Errorw("sql事务处理错误，已回滚", "err", err, "count", len(data), "cfg", sc.cfg)
+		return err
+	}
+	return nil
+}
+
+// 使用指定连接或事务处理一条消息
+func (sc *SqlConsumer) handle(ctx context.Context, conn sqlConn, data *models.ChangeEvent) (err error) {
+	log.Println("sql处理收到数据", data.Namespace.Db, data.Namespace.Coll, data.Operation)
+	table := sc.cfg.GetDestinationCollection(data.Namespace.Coll)
+	// 表结构变化事件
+	switch data.Operation {
+	case "drop", "dropDatabase":
+		return sc.drop(ctx, conn, data)
+	case "rename":
+		return sc.rename(ctx, conn, data, table)
+	}
+	err = sc.prepareTable(ctx, conn, data)
+	if err != nil {
+		return err
+	}
+	switch data.Operation {
+	case "insert":
+		err = sc.upsert(ctx, conn, data, table)
+	case "update":
+		err = sc.update(ctx, conn, data, table)
+	case "delete":
+		err = sc.delete(ctx, conn, data, table)
+	case "replace":
+		err = sc.delete(ctx, conn, data, table)
+		if err == nil {
+			err = sc.upsert(ctx, conn, data, table)
+		}
+	default:
+		return Permanent(errors.New("未知事件类型"))
+	}
+	if err != nil {
+		logger.GlobalLogger.Errorw("sql处理数据错误", "err", err, "data", data, "cfg", sc.cfg)
+		return err
+	}
+	logger.GlobalLogger.Debugw("sql数据处理成功", "data", data, "cfg", sc.cfg)
+	return nil
+}
+
+// 执行语句
+func (sc *SqlConsumer) exec(ctx context.Context, conn sqlConn, query string, args ...interface{}) (sql.Result, error) {
+	if sc.debug {
+		log.Println("sql", query, args)
+	}
+	return conn.ExecContext(ctx, query, args...)
+}
+
+// 唯一标识列名
+func (sc *SqlConsumer) keyColumns(collection string) []string {
+	keyColumns := sc.cfg.GetKeyColumns(collection)
+	columns := make([]string, 0, len(keyColumns))
+	for _, v := range keyColumns {
+		columns = append(columns, v.Column)
+	}
+	return columns
+}
+
+// 文档转换为一行，包含唯一标识列和完整文档列
+func (sc *SqlConsumer) row(data *models.ChangeEvent) (map[string]interface{}, error) {
+	row := make(map[string]interface{}, len(data.Document)+2)
+	for k, v := range data.Document {
+		val, err := sqlValue(v)
+		if err != nil {
+			return nil, err
+		}
+		row[k] = val
+	}
+	if sc.options.DocumentColumn != "" && data.Document != nil {
+		js, err := bson.MarshalExtJSON(data.Document, false, false)
+		if err != nil {
+			return nil, Permanent(err)
+		}
+		row[sc.options.DocumentColumn] = string(js)
+	}
+	for _, v := range sc.cfg.GetKeyColumns(data.Namespace.Coll) {
+		row[v.Column] = data.DocumentKey.String(v.Field)
+	}
+	return row, nil
+}
+
+// 行的列名，排序保证语句稳定
+func rowColumns(row map[string]interface{}) []string {
+	columns := make([]string, 0, len(row))
+	for k := range row {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// 文档字段值转换为列值，ObjectID为hex，时间为time.Time，嵌套文档、数组等其它类型为mongo扩展json
+func sqlValue(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return nil, nil
+	case string, int64, float64, bool, time.Time:
+		return val, nil
+	case int32:
+		return int64(val), nil
+	case int:
+		return int64(val), nil
+	case primitive.ObjectID:
+		return val.Hex(), nil
+	case primitive.DateTime:
+		return val.Time().UTC(), nil
+	case primitive.Decimal128:
+		return val.String(), nil
+	}
+	js, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, false, false)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	// 去掉外层 {"v": 和 }
+	return string(js[5 : len(js)-1]), nil
+}
+
+// 唯一标识列查询条件，占位符从start开始编号
+func (sc *SqlConsumer) keyWhere(data *models.ChangeEvent, start int) (string, []interface{}) {
+	keyColumns := sc.cfg.GetKeyColumns(data.Namespace.Coll)
+	conds := make([]string, 0, len(keyColumns))
+	args := make([]interface{}, 0, len(keyColumns))
+	for i, v := range keyColumns {
+		conds = append(conds, sc.dialect.quote(v.Column)+" = "+sc.dialect.placeholder(start+i))
+		args = append(args, data.DocumentKey.String(v.Field))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// 插入数据，唯一标识已存在时更新
+func (sc *SqlConsumer) upsert(ctx context.Context, conn sqlConn, data *models.ChangeEvent, table string) error {
+	if data.Document == nil {
+		logger.GlobalLogger.Warnw("没有文档内容，跳过写入", "table", table, "operation", data.Operation, "document_key", data.DocumentKey, "cfg", sc.cfg)
+		return nil
+	}
+	row, err := sc.row(data)
+	if err != nil {
+		return err
+	}
+	columns := rowColumns(row)
+	args := make([]interface{}, 0, len(columns))
+	for _, v := range columns {
+		args = append(args, row[v])
+	}
+	_, err = sc.exec(ctx, conn, sc.dialect.upsert(table, columns, sc.keyColumns(data.Namespace.Coll), 1), args...)
+	return err
+}
+
+// 多行插入同一个表，列不同或参数过多时拆分为多条语句
+func (sc *SqlConsumer) insertRows(ctx context.Context, conn sqlConn, data []*models.ChangeEvent) error {
+	table := sc.cfg.GetDestinationCollection(data[0].Namespace.Coll)
+	keyColumns := sc.keyColumns(data[0].Namespace.Coll)
+	var columns []string
+	args := make([]interface{}, 0)
+	rows := 0
+	flush := func() error {
+		if rows == 0 {
+			return nil
+		}
+		_, err := sc.exec(ctx, conn, sc.dialect.upsert(table, columns, keyColumns, rows), args...)
+		args = args[:0]
+		rows = 0
+		return err
+	}
+	for _, v := range data {
+		if v.Document == nil {
+			continue
+		}
+		row, err := sc.row(v)
+		if err != nil {
+			return err
+		}
+		next := rowColumns(row)
+		if !sameColumns(columns, next) || len(args)+len(next) > SqlMaxArgs {
+			if err := flush(); err != nil {
+				return err
+			}
+			columns = next
+		}
+		for _, column := range columns {
+			args = append(args, row[column])
+		}
+		rows++
+	}
+	return flush()
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 更新数据，全量模式为upsert，delta模式只更新变化的列，行不存在时使用变更后文档插入
+func (sc *SqlConsumer) update(ctx context.Context, conn sqlConn, data *models.ChangeEvent, table string) error {
+	if sc.cfg.GetUpdateMode() != config.UpdateModeDelta || data.Updates == nil {
+		return sc.upsert(ctx, conn, data, table)
+	}
+	columns := deltaUpdateColumns(data)
+	if sc.options.DocumentColumn != "" && data.Document != nil {
+		columns[sc.options.DocumentColumn] = data.Document
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	sets := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns))
+	for _, k := range rowColumns(columns) {
+		val, err := sqlValue(columns[k])
+		if err != nil {
+			return err
+		}
+		sets = append(sets, sc.dialect.quote(k)+" = "+sc.dialect.placeholder(len(args)+1))
+		args = append(args, val)
+	}
+	where, whereArgs := sc.keyWhere(data, len(args)+1)
+	result, err := sc.exec(ctx, conn, fmt.Sprintf("UPDATE %s SET %s WHERE %s", sc.dialect.quote(table), strings.Join(sets, ","), where), append(args, whereArgs...)...)
+	if err != nil {
+		return err
+	}
+	// mysql值未变化时影响行数也为0，此时upsert同样不会改变数据
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		if data.Document == nil {
+			logger.GlobalLogger.Warnw("目标行不存在且没有变更后文档，跳过更新", "table", table, "document_key", data.DocumentKey, "cfg", sc.cfg)
+			return nil
+		}
+		return sc.upsert(ctx, conn, data, table)
+	}
+	return nil
+}
+
+// 删除
+func (sc *SqlConsumer) delete(ctx context.Context, conn sqlConn, data *models.ChangeEvent, table string) error {
+	where, args := sc.keyWhere(data, 1)
+	_, err := sc.exec(ctx, conn, fmt.Sprintf("DELETE FROM %s WHERE %s", sc.dialect.quote(table), where), args...)
+	return err
+}
+
+// 表是否存在
+func (sc *SqlConsumer) hasTable(ctx context.Context, conn sqlConn, table string) (bool, error) {
+	var count int64
+	err := conn.QueryRowContext(ctx, sc.dialect.tableExistsSql(), table).Scan(&count)
+	return count > 0, err
+}
+
+// 来源集合或db删除，按配置删除或清空目标表
+func (sc *SqlConsumer) drop(ctx context.Context, conn sqlConn, data *models.ChangeEvent) error {
+	action, collections := dropCollections(sc.cfg, data)
+	for _, v := range collections {
+		table := sc.cfg.GetDestinationCollection(v)
+		query := "DROP TABLE IF EXISTS " + sc.dialect.quote(table)
+		if action == config.DDLDropTruncate {
+			ok, err := sc.hasTable(ctx, conn, table)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			query = sc.dialect.truncateSql(table)
+		}
+		_, err := sc.exec(ctx, conn, query)
+		if err != nil {
+			logger.GlobalLogger.Errorw("sql删除目标表错误", "err", err, "action", action, "table", table, "cfg", sc.cfg)
+			return err
+		}
+		sc.forgetTable(table)
+		log.Println("sql删除目标表成功", action, table)
+	}
+	return nil
+}
+
+// 来源集合重命名，同步重命名目标表
+func (sc *SqlConsumer) rename(ctx context.Context, conn sqlConn, data *models.ChangeEvent, table string) error {
+	to, ok := renameDestination(sc.cfg, data)
+	if !ok {
+		return nil
+	}
+	ok, err := sc.hasTable(ctx, conn, table)
+	if err != nil || !ok {
+		return err
+	}
+	_, err = sc.exec(ctx, conn, sc.dialect.renameSql(table, to))
+	if err != nil {
+		logger.GlobalLogger.Errorw("sql重命名目标表错误", "err", err, "table", table, "to", to, "cfg", sc.cfg)
+		return err
+	}
+	sc.forgetTable(table)
+	sc.forgetTable(to)
+	log.Println("sql重命名目标表成功", table, to)
+	return nil
+}
+
+// 开启auto_create时保证目标表和文档中的列存在
+func (sc *SqlConsumer) prepareTable(ctx context.Context, conn sqlConn, data *models.ChangeEvent) error {
+	if !sc.options.AutoCreate || data.Document == nil {
+		return nil
+	}
+	switch data.Operation {
+	case "insert", "update", "replace":
+	default:
+		return nil
+	}
+	row, err := sc.row(data)
+	if err != nil {
+		return err
+	}
+	table := sc.cfg.GetDestinationCollection(data.Namespace.Coll)
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	known, ok := sc.columns[table]
+	if !ok {
+		known, err = sc.loadColumns(ctx, conn, table)
+		if err != nil {
+			return err
+		}
+	}
+	if len(known) == 0 {
+		err = sc.createTable(ctx, conn, table, row, sc.keyColumns(data.Namespace.Coll))
+		if err != nil {
+			return err
+		}
+		for k := range row {
+			known[k] = true
+		}
+		sc.columns[table] = known
+		return nil
+	}
+	for _, k := range rowColumns(row) {
+		if known[k] {
+			continue
+		}
+		_, err = sc.exec(ctx, conn, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", sc.dialect.quote(table), sc.dialect.quote(k), sc.dialect.columnType(row[k])))
+		if err != nil {
+			logger.GlobalLogger.Errorw("sql添加列错误", "err", err, "table", table, "column", k, "cfg", sc.cfg)
+			return err
+		}
+		known[k] = true
+	}
+	sc.columns[table] = known
+	return nil
+}
+
+// 查询表的所有列，表不存在时为空
+func (sc *SqlConsumer) loadColumns(ctx context.Context, conn sqlConn, table string) (map[string]bool, error) {
+	rows, err := conn.QueryContext(ctx, sc.dialect.columnsSql(), table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns[column] = true
+	}
+	return columns, rows.Err()
+}
+
+// 按第一行文档建表，唯一标识列为主键
+func (sc *SqlConsumer) createTable(ctx context.Context, conn sqlConn, table string, row map[string]interface{}, keyColumns []string) error {
+	keys := make(map[string]bool, len(keyColumns))
+	defs := make([]string, 0, len(row))
+	for _, v := range keyColumns {
+		keys[v] = true
+		defs = append(defs, sc.dialect.quote(v)+" "+sc.dialect.keyColumnType()+" NOT NULL")
+	}
+	for _, k := range rowColumns(row) {
+		if !keys[k] {
+			defs = append(defs, sc.dialect.quote(k)+" "+sc.dialect.columnType(row[k]))
+		}
+	}
+	defs = append(defs, "PRIMARY KEY ("+strings.Join(quoteColumns(sc.dialect, keyColumns), ",")+")")
+	_, err := sc.exec(ctx, conn, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", sc.dialect.quote(table), strings.Join(defs, ",")))
+	if err != nil {
+		logger.GlobalLogger.Errorw("sql创建目标表错误", "err", err, "table", table, "cfg", sc.cfg)
+		return err
+	}
+	log.Println("sql创建目标表成功", table)
+	return nil
+}
+
+// 表结构变化后重新查询列
+func (sc *SqlConsumer) forgetTable(table string) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	delete(sc.columns, table)
+}
+
+func (sc *SqlConsumer) resetColumns() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.columns = make(map[string]map[string]bool)
+}
@@ -0,0 +1,325 @@
+package consumers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sql目标的方言，处理各数据库在引用、占位符、upsert、列类型和表结构语句上的差异
+type sqlDialect interface {
+	// database/sql驱动名
+	driverName() string
+	// 引用表名或列名
+	quote(name string) string
+	// 第n个参数的占位符，n从1开始
+	placeholder(n int) string
+	// 插入多行，唯一标识冲突时更新其余列
+	upsert(table string, columns, keyColumns []string, rows int) string
+	// 值对应的列类型，自动建表和加列时使用
+	columnType(val interface{}) string
+	// 唯一标识列类型，需要能作为主键
+	keyColumnType() string
+	// 查询表是否存在，返回行数
+	tableExistsSql() string
+	// 查询表的所有列名
+	columnsSql() string
+	// 清空表
+	truncateSql(table string) string
+	// 重命名表
+	renameSql(from, to string) string
+	// 是否为重试无法解决的错误
+	isPermanentError(err error) bool
+}
+
+// 按配置名称获取方言
+func newSqlDialect(name string) (sqlDialect, error) {
+	switch name {
+	case "", "mysql":
+		return mysqlDialect{}, nil
+	case "postgres", "postgresql":
+		return postgresDialect{}, nil
+	case "sqlite", "sqlite3":
+		return sqliteDialect{}, nil
+	}
+	return nil, fmt.Errorf("sql配置dialect只能为 mysql postgres sqlite: %s", name)
+}
+
+// 双引号引用，内部双引号转义
+func quoteDouble(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// 占位符列表，按行生成 (?,?),(?,?)
+func sqlValues(d sqlDialect, columns, rows int) string {
+	values := make([]string, 0, rows)
+	n := 1
+	for i := 0; i < rows; i++ {
+		row := make([]string, 0, columns)
+		for j := 0; j < columns; j++ {
+			row = append(row, d.placeholder(n))
+			n++
+		}
+		values = append(values, "("+strings.Join(row, ",")+")")
+	}
+	return strings.Join(values, ",")
+}
+
+// 引用后的列名列表
+func quoteColumns(d sqlDialect, columns []string) []string {
+	quoted := make([]string, 0, len(columns))
+	for _, v := range columns {
+		quoted = append(quoted, d.quote(v))
+	}
+	return quoted
+}
+
+// 非唯一标识列
+func nonKeyColumns(columns, keyColumns []string) []string {
+	keys := make(map[string]bool, len(keyColumns))
+	for _, v := range keyColumns {
+		keys[v] = true
+	}
+	others := make([]string, 0, len(columns))
+	for _, v := range columns {
+		if !keys[v] {
+			others = append(others, v)
+		}
+	}
+	return others
+}
+
+// ON CONFLICT 形式的upsert，postgres和sqlite通用
+func upsertOnConflict(d sqlDialect, table string, columns, keyColumns []string, rows int) string {
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON CONFLICT (%s)", d.quote(table),
+		strings.Join(quoteColumns(d, columns), ","), sqlValues(d, len(columns), rows), strings.Join(quoteColumns(d, keyColumns), ","))
+	others := nonKeyColumns(columns, keyColumns)
+	if len(others) == 0 {
+		return sql + " DO NOTHING"
+	}
+	sets := make([]string, 0, len(others))
+	for _, v := range others {
+		sets = append(sets, d.quote(v)+"=EXCLUDED."+d.quote(v))
+	}
+	return sql + " DO UPDATE SET " + strings.Join(sets, ",")
+}
+
+/* mysql */
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) driverName() string {
+	return "mysql"
+}
+
+func (mysqlDialect) quote(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func (mysqlDialect) placeholder(n int) string {
+	return "?"
+}
+
+func (d mysqlDialect) upsert(table string, columns, keyColumns []string, rows int) string {
+	others := nonKeyColumns(columns, keyColumns)
+	// 只有唯一标识列时更新为自身，效果同忽略
+	if len(others) == 0 {
+		others = keyColumns[:1]
+	}
+	sets := make([]string, 0, len(others))
+	for _, v := range others {
+		sets = append(sets, d.quote(v)+"=VALUES("+d.quote(v)+")")
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON DUPLICATE KEY UPDATE %s", d.quote(table),
+		strings.Join(quoteColumns(d, columns), ","), sqlValues(d, len(columns), rows), strings.Join(sets, ","))
+}
+
+func (mysqlDialect) columnType(val interface{}) string {
+	switch val.(type) {
+	case string, nil:
+		return "TEXT"
+	case int64:
+		return "BIGINT"
+	case float64:
+		return "DOUBLE"
+	case bool:
+		return "BOOLEAN"
+	case time.Time:
+		return "DATETIME(3)"
+	}
+	return "JSON"
+}
+
+func (mysqlDialect) keyColumnType() string {
+	return "VARCHAR(255)"
+}
+
+func (mysqlDialect) tableExistsSql() string {
+	return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+}
+
+func (mysqlDialect) columnsSql() string {
+	return "SELECT column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?"
+}
+
+func (d mysqlDialect) truncateSql(table string) string {
+	return "TRUNCATE TABLE " + d.quote(table)
+}
+
+func (d mysqlDialect) renameSql(from, to string) string {
+	return fmt.Sprintf("RENAME TABLE %s TO %s", d.quote(from), d.quote(to))
+}
+
+func (mysqlDialect) isPermanentError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return !mysqlTransientErrors[mysqlErr.Number]
+}
+
+/* postgres */
+
+type postgresDialect struct{}
+
+func (postgresDialect) driverName() string {
+	return "postgres"
+}
+
+func (postgresDialect) quote(name string) string {
+	return quoteDouble(name)
+}
+
+func (postgresDialect) placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (d postgresDialect) upsert(table string, columns, keyColumns []string, rows int) string {
+	return upsertOnConflict(d, table, columns, keyColumns, rows)
+}
+
+func (postgresDialect) columnType(val interface{}) string {
+	switch val.(type) {
+	case string, nil:
+		return "TEXT"
+	case int64:
+		return "BIGINT"
+	case float64:
+		return "DOUBLE PRECISION"
+	case bool:
+		return "BOOLEAN"
+	case time.Time:
+		return "TIMESTAMPTZ"
+	}
+	return "JSONB"
+}
+
+func (postgresDialect) keyColumnType() string {
+	return "TEXT"
+}
+
+func (postgresDialect) tableExistsSql() string {
+	return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1"
+}
+
+func (postgresDialect) columnsSql() string {
+	return "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1"
+}
+
+func (d postgresDialect) truncateSql(table string) string {
+	return "TRUNCATE TABLE " + d.quote(table)
+}
+
+func (d postgresDialect) renameSql(from, to string) string {
+	return fmt.Sprintf("ALTER TABLE %s RENAME TO %s", d.quote(from), d.quote(to))
+}
+
+// postgres临时错误类别: 08连接异常 40事务回滚(死锁、序列化失败) 53资源不足 57运维干预(关闭、取消)
+var postgresTransientClasses = map[pq.ErrorClass]bool{
+	"08": true,
+	"40": true,
+	"53": true,
+	"57": true,
+}
+
+func (postgresDialect) isPermanentError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	// 55P03 lock_not_available
+	if pqErr.Code == "55P03" {
+		return false
+	}
+	return !postgresTransientClasses[pqErr.Code.Class()]
+}
+
+/* sqlite 嵌入式数据库，destination_uri为文件路径 */
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) driverName() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) quote(name string) string {
+	return quoteDouble(name)
+}
+
+func (sqliteDialect) placeholder(n int) string {
+	return "?"
+}
+
+func (d sqliteDialect) upsert(table string, columns, keyColumns []string, rows int) string {
+	return upsertOnConflict(d, table, columns, keyColumns, rows)
+}
+
+// sqlite没有json和时间类型，json以文本存储，可使用json函数查询
+func (sqliteDialect) columnType(val interface{}) string {
+	switch val.(type) {
+	case int64, bool:
+		return "INTEGER"
+	case float64:
+		return "REAL"
+	}
+	return "TEXT"
+}
+
+func (sqliteDialect) keyColumnType() string {
+	return "TEXT"
+}
+
+func (sqliteDialect) tableExistsSql() string {
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+}
+
+func (sqliteDialect) columnsSql() string {
+	return "SELECT name FROM pragma_table_info(?)"
+}
+
+func (d sqliteDialect) truncateSql(table string) string {
+	return "DELETE FROM " + d.quote(table)
+}
+
+func (d sqliteDialect) renameSql(from, to string) string {
+	return fmt.Sprintf("ALTER TABLE %s RENAME TO %s", d.quote(from), d.quote(to))
+}
+
+// 数据库文件被其它连接锁定时为临时错误
+func (sqliteDialect) isPermanentError(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,312 @@
+package consumers
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 内存sqlite的sql消费者，目标表为t_goods
+func newTestSqlConsumer(t *testing.T, options map[string]interface{}) (*SqlConsumer, *config.SyncConfig) {
+	t.Helper()
+	options["dialect"] = "sqlite"
+	cfg := &config.SyncConfig{
+		Type:           TypeSql,
+		DestinationUri: ":memory:",
+		SourceDb:       "src",
+		DestinationDb:  "dst",
+		Collections:    map[string]string{"goods": "t_goods"},
+		Options:        options,
+	}
+	consumer, err := NewSqlConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { consumer.Disconnect() })
+	return consumer.(*SqlConsumer), cfg
+}
+
+// 查询一行一列
+func queryValue(t *testing.T, sc *SqlConsumer, query string, args ...interface{}) interface{} {
+	t.Helper()
+	var val interface{}
+	err := sc.db.QueryRow(query, args...).Scan(&val)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
+
+func tableColumns(t *testing.T, sc *SqlConsumer, table string) map[string]string {
+	t.Helper()
+	rows, err := sc.db.Query("SELECT name, type FROM pragma_table_info(?)", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			t.Fatal(err)
+		}
+		columns[name] = typ
+	}
+	return columns
+}
+
+func TestSqlConsumerEvents(t *testing.T) {
+	sc, cfg := newTestSqlConsumer(t, map[string]interface{}{"auto_create": true, "document_column": "doc"})
+	ctx := context.Background()
+	count := func() int64 {
+		return queryValue(t, sc, `SELECT COUNT(*) FROM "t_goods"`).(int64)
+	}
+	name := func() interface{} {
+		return queryValue(t, sc, `SELECT "name" FROM "t_goods" WHERE "document_key" = ?`, "1")
+	}
+
+	if err := sc.HandleData(ctx, testEvent(t, "insert", "goods", "1", bson.M{"name": "a", "age": int32(18)})); err != nil {
+		t.Fatal(err)
+	}
+	// 重放的插入不会产生重复行
+	if err := sc.HandleData(ctx, testEvent(t, "insert", "goods", "1", bson.M{"name": "a", "age": int32(18)})); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("insert count = %d, want 1", n)
+	}
+	if doc := queryValue(t, sc, `SELECT "doc" FROM "t_goods"`); doc != `{"age":18,"name":"a"}` && doc != `{"name":"a","age":18}` {
+		t.Errorf("document column = %v", doc)
+	}
+
+	// 全量更新
+	if err := sc.HandleData(ctx, testEvent(t, "update", "goods", "1", bson.M{"name": "b", "age": int32(19)})); err != nil {
+		t.Fatal(err)
+	}
+	if v := name(); v != "b" {
+		t.Errorf("full update name = %v, want b", v)
+	}
+
+	// 增量更新只修改变化的列，删除的字段置为NULL
+	cfg.UpdateMode = config.UpdateModeDelta
+	update := testEvent(t, "update", "goods", "1", nil)
+	update.Updates = &models.UpdateDescription{UpdatedFields: bson.M{"name": "c"}, RemovedFields: []string{"age"}}
+	if err := sc.HandleData(ctx, update); err != nil {
+		t.Fatal(err)
+	}
+	if v := name(); v != "c" {
+		t.Errorf("delta update name = %v, want c", v)
+	}
+	if v := queryValue(t, sc, `SELECT "age" FROM "t_goods"`); v != nil {
+		t.Errorf("delta update age = %v, want NULL", v)
+	}
+	// 行不存在且没有变更后文档时跳过
+	missing := testEvent(t, "update", "goods", "2", nil)
+	missing.Updates = &models.UpdateDescription{UpdatedFields: bson.M{"name": "x"}}
+	if err := sc.HandleData(ctx, missing); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("delta update of missing row count = %d, want 1", n)
+	}
+	cfg.UpdateMode = ""
+
+	// 替换后文档中没有的字段为NULL
+	if err := sc.HandleData(ctx, testEvent(t, "update", "goods", "1", bson.M{"name": "c", "age": int32(20)})); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.HandleData(ctx, testEvent(t, "replace", "goods", "1", bson.M{"name": "d"})); err != nil {
+		t.Fatal(err)
+	}
+	if v := name(); v != "d" {
+		t.Errorf("replace name = %v, want d", v)
+	}
+	if v := queryValue(t, sc, `SELECT "age" FROM "t_goods"`); v != nil {
+		t.Errorf("replace age = %v, want NULL", v)
+	}
+
+	if err := sc.HandleData(ctx, testEvent(t, "delete", "goods", "1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("delete count = %d, want 0", n)
+	}
+}
+
+func TestSqlConsumerBatch(t *testing.T) {
+	sc, _ := newTestSqlConsumer(t, map[string]interface{}{"auto_create": true})
+	ctx := context.Background()
+	err := sc.HandleBatch(ctx, []*models.ChangeEvent{
+		testEvent(t, "insert", "goods", "1", bson.M{"name": "a"}),
+		testEvent(t, "insert", "goods", "2", bson.M{"name": "b"}),
+		testEvent(t, "insert", "goods", "3", bson.M{"name": "c", "age": int32(1)}),
+		testEvent(t, "delete", "goods", "2", nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := queryValue(t, sc, `SELECT COUNT(*) FROM "t_goods"`); n != int64(2) {
+		t.Errorf("batch count = %v, want 2", n)
+	}
+
+	// 批次中任一事件失败时整批回滚
+	sc.options.AutoCreate = false
+	err = sc.HandleBatch(ctx, []*models.ChangeEvent{
+		testEvent(t, "insert", "goods", "4", bson.M{"name": "d"}),
+		testEvent(t, "insert", "goods", "5", bson.M{"unknown": "e"}),
+	})
+	if err == nil {
+		t.Fatal("batch with unknown column succeeded")
+	}
+	if !sc.IsPermanentError(err) {
+		t.Errorf("unknown column error %v is not permanent", err)
+	}
+	if n := queryValue(t, sc, `SELECT COUNT(*) FROM "t_goods"`); n != int64(2) {
+		t.Errorf("count after rollback = %v, want 2", n)
+	}
+}
+
+func TestSqlConsumerAutoCreate(t *testing.T) {
+	sc, _ := newTestSqlConsumer(t, map[string]interface{}{"auto_create": true})
+	ctx := context.Background()
+	err := sc.HandleData(ctx, testEvent(t, "insert", "goods", "1", bson.M{
+		"name":  "a",
+		"age":   int32(18),
+		"price": 1.5,
+		"tags":  bson.A{"x", "y"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"document_key": "TEXT",
+		"name":         "TEXT",
+		"age":          "INTEGER",
+		"price":        "REAL",
+		"tags":         "TEXT",
+	}
+	columns := tableColumns(t, sc, "t_goods")
+	for k, v := range want {
+		if columns[k] != v {
+			t.Errorf("column %s type = %q, want %q", k, columns[k], v)
+		}
+	}
+	if tags := queryValue(t, sc, `SELECT "tags" FROM "t_goods"`); tags != `["x","y"]` {
+		t.Errorf("tags = %v", tags)
+	}
+
+	// 新字段自动加列
+	err = sc.HandleData(ctx, testEvent(t, "insert", "goods", "2", bson.M{"name": "b", "on_sale": true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ := tableColumns(t, sc, "t_goods")["on_sale"]; typ != "INTEGER" {
+		t.Errorf("added column type = %q, want INTEGER", typ)
+	}
+	if v := queryValue(t, sc, `SELECT "on_sale" FROM "t_goods" WHERE "document_key" = ?`, "2"); v != int64(1) {
+		t.Errorf("on_sale = %v, want 1", v)
+	}
+}
+
+func TestSqlConsumerDrop(t *testing.T) {
+	sc, cfg := newTestSqlConsumer(t, map[string]interface{}{"auto_create": true})
+	ctx := context.Background()
+	insert := func() {
+		t.Helper()
+		if err := sc.HandleData(ctx, testEvent(t, "insert", "goods", "1", bson.M{"name": "a"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func() bool {
+		t.Helper()
+		ok, err := sc.hasTable(ctx, sc.db, "t_goods")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	insert()
+
+	// 未开启删除时忽略
+	if err := sc.HandleData(ctx, testEvent(t, "drop", "goods", nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if n := queryValue(t, sc, `SELECT COUNT(*) FROM "t_goods"`); n != int64(1) {
+		t.Fatalf("count after ignored drop = %v, want 1", n)
+	}
+
+	cfg.DDL = &config.DDLConfig{Drop: config.DDLDropTruncate, AllowDrop: true}
+	if err := sc.HandleData(ctx, testEvent(t, "drop", "goods", nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !exists() {
+		t.Fatal("table dropped by truncate")
+	}
+	if n := queryValue(t, sc, `SELECT COUNT(*) FROM "t_goods"`); n != int64(0) {
+		t.Fatalf("count after truncate = %v, want 0", n)
+	}
+
+	insert()
+	cfg.DDL.Drop = config.DDLDropDrop
+	if err := sc.HandleData(ctx, testEvent(t, "dropDatabase", "", nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if exists() {
+		t.Fatal("table exists after drop")
+	}
+	// 删除后再次写入重新建表
+	insert()
+	if !exists() {
+		t.Fatal("table not recreated after drop")
+	}
+}
+
+func TestSqlDialectUpsert(t *testing.T) {
+	columns := []string{"document_key", "age", "name"}
+	keyColumns := []string{"document_key"}
+	tests := []struct {
+		dialect sqlDialect
+		want    string
+		keyOnly string
+	}{
+		{
+			dialect: mysqlDialect{},
+			want:    "INSERT INTO `t` (`document_key`,`age`,`name`) VALUES (?,?,?),(?,?,?) ON DUPLICATE KEY UPDATE `age`=VALUES(`age`),`name`=VALUES(`name`)",
+			keyOnly: "INSERT INTO `t` (`document_key`) VALUES (?) ON DUPLICATE KEY UPDATE `document_key`=VALUES(`document_key`)",
+		},
+		{
+			dialect: postgresDialect{},
+			want:    `INSERT INTO "t" ("document_key","age","name") VALUES ($1,$2,$3),($4,$5,$6) ON CONFLICT ("document_key") DO UPDATE SET "age"=EXCLUDED."age","name"=EXCLUDED."name"`,
+			keyOnly: `INSERT INTO "t" ("document_key") VALUES ($1) ON CONFLICT ("document_key") DO NOTHING`,
+		},
+		{
+			dialect: sqliteDialect{},
+			want:    `INSERT INTO "t" ("document_key","age","name") VALUES (?,?,?),(?,?,?) ON CONFLICT ("document_key") DO UPDATE SET "age"=EXCLUDED."age","name"=EXCLUDED."name"`,
+			keyOnly: `INSERT INTO "t" ("document_key") VALUES (?) ON CONFLICT ("document_key") DO NOTHING`,
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.upsert("t", columns, keyColumns, 2); got != tt.want {
+			t.Errorf("%s upsert:\n got %s\nwant %s", tt.dialect.driverName(), got, tt.want)
+		}
+		if got := tt.dialect.upsert("t", keyColumns, keyColumns, 1); got != tt.keyOnly {
+			t.Errorf("%s key only upsert:\n got %s\nwant %s", tt.dialect.driverName(), got, tt.keyOnly)
+		}
+	}
+}
+
+func TestSqlDialectQuote(t *testing.T) {
+	if got := (mysqlDialect{}).quote("a`b"); got != "`a``b`" {
+		t.Errorf("mysql quote = %s", got)
+	}
+	if got := (postgresDialect{}).quote(`a"b`); got != `"a""b"` {
+		t.Errorf("postgres quote = %s", got)
+	}
+}
@@ -0,0 +1,286 @@
+package consumers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/* http webhook目标，每个事件或一批事件POST到来源集合对应的url
+ * 默认请求体为 {"db":"目标db","collection":"目标集合","event":{事件}}，批量时为数组
+ * 配置secret后请求头带有请求体的HMAC-SHA256签名 */
+
+const (
+	TypeWebhook = "webhook"
+
+	DefaultWebhookTimeoutMs       = 10000
+	DefaultWebhookSignatureHeader = "X-Signature-256"
+)
+
+func init() {
+	Register(TypeWebhook, NewWebhookConsumer)
+}
+
+// WebhookConsumer http webhook消费者
+type WebhookConsumer struct {
+	cfg     *config.SyncConfig
+	options *WebhookOptions
+	client  *http.Client
+}
+
+// WebhookOptions webhook目标专有配置 [sync.options]
+type WebhookOptions struct {
+	Urls            map[string]string `json:"urls"`             // 来源集合对应的url，未配置的集合使用destination_uri
+	Headers         map[string]string `json:"headers"`          // 附加的请求头
+	Secret          string            `json:"secret"`           // 签名密钥，为空时不签名
+	SignatureHeader string            `json:"signature_header"` // 签名请求头，值为 sha256=十六进制签名，默认X-Signature-256
+	TimeoutMs       int               `json:"timeout_ms"`       // 请求超时毫秒数，默认10000
+	Batch           bool              `json:"batch"`            // 是否批量发送，一批事件中连续发往同一个url的事件合并为一个数组
+	Fields          map[string]string `json:"fields"`           // 自定义请求体 key:请求体字段 val:默认请求体中的路径，例如 event.document_key._id
+	HealthUrl       string            `json:"health_url"`       // 健康检查url，GET返回2xx为可用，为空时不检查
+}
+
+// NewWebhookConsumer 创建一个webhook消费对象
+func NewWebhookConsumer(cfg *config.SyncConfig) (Consumer, error) {
+	webhookConsumer := &WebhookConsumer{
+		cfg:     cfg,
+		options: new(WebhookOptions),
+	}
+	err := cfg.DecodeOptions(webhookConsumer.options)
+	if err != nil {
+		return nil, err
+	}
+	for collection := range cfg.Collections {
+		if webhookConsumer.url(collection) == "" {
+			return nil, fmt.Errorf("webhook集合%s没有配置url，请配置destination_uri或options.urls", collection)
+		}
+	}
+	timeout := time.Duration(webhookConsumer.options.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeoutMs * time.Millisecond
+	}
+	webhookConsumer.client = &http.Client{Timeout: timeout}
+	return webhookConsumer, nil
+}
+
+// 来源集合对应的url
+func (wc *WebhookConsumer) url(collection string) string {
+	if url := wc.options.Urls[collection]; url != "" {
+		return url
+	}
+	return wc.cfg.DestinationUri
+}
+
+// Capabilities 事件原样发送，由接收方处理增量更新和表结构变化，不支持事务
+func (wc *WebhookConsumer) Capabilities() Capabilities {
+	return Capabilities{
+		Batch:       wc.options.Batch,
+		DeltaUpdate: true,
+		Rename:      true,
+		Drop:        true,
+	}
+}
+
+// Health 请求健康检查url
+func (wc *WebhookConsumer) Health(ctx context.Context) error {
+	if wc.options.HealthUrl == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, TimeoutCtx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wc.options.HealthUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := wc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook健康检查返回%s", resp.Status)
+	}
+	return nil
+}
+
+// 销毁连接
+func (wc *WebhookConsumer) Disconnect() error {
+	wc.client.CloseIdleConnections()
+	return nil
+}
+
+// 处理一条消息
+func (wc *WebhookConsumer) HandleData(ctx context.Context, data *models.ChangeEvent) error {
+	if data == nil {
+		return errors.New("webhook处理收到数据为nil")
+	}
+	log.Println("webhook处理收到数据", data.Namespace.Db, data.Namespace.Coll, data.Operation)
+	body, err := wc.body(data)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(body)
+	if err != nil {
+		return Permanent(err)
+	}
+	return wc.post(ctx, wc.url(data.Namespace.Coll), js)
+}
+
+// HandleBatch 一批消息中连续发往同一个url的事件合并为一个数组发送，保证顺序
+func (wc *WebhookConsumer) HandleBatch(ctx context.Context, data []*models.ChangeEvent) error {
+	log.Println("webhook批量处理收到数据", len(data))
+	url := ""
+	batch := make([]interface{}, 0, len(data))
+	for _, v := range data {
+		if next := wc.url(v.Namespace.Coll); next != url {
+			if err := wc.postBatch(ctx, url, batch); err != nil {
+				return err
+			}
+			url = next
+			batch = batch[:0]
+		}
+		body, err := wc.body(v)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, body)
+	}
+	return wc.postBatch(ctx, url, batch)
+}
+
+func (wc *WebhookConsumer) postBatch(ctx context.Context, url string, batch []interface{}) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	js, err := json.Marshal(batch)
+	if err != nil {
+		return Permanent(err)
+	}
+	return wc.post(ctx, url, js)
+}
+
+// 一条事件的请求体，配置了fields时按路径从默认请求体中取值
+func (wc *WebhookConsumer) body(data *models.ChangeEvent) (interface{}, error) {
+	body := newEventMessage(wc.cfg, data)
+	if len(wc.options.Fields) == 0 {
+		return body, nil
+	}
+	js, err := json.Marshal(body)
+	if err != nil {
+		logger.GlobalLogger.Errorw("webhook处理收到数据转json错误", "err", err, "data", data)
+		return nil, Permanent(err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(js))
+	decoder.UseNumber()
+	var doc interface{}
+	err = decoder.Decode(&doc)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	fields := make(map[string]interface{}, len(wc.options.Fields))
+	for k, path := range wc.options.Fields {
+		fields[k] = lookupJsonPath(doc, path)
+	}
+	return fields, nil
+}
+
+// 按.分隔的路径取值，不存在时为nil
+func lookupJsonPath(doc interface{}, path string) interface{} {
+	for _, key := range strings.Split(path, ".") {
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		doc = m[key]
+	}
+	return doc
+}
+
+// 发送请求，2xx为成功，408、429和5xx为临时错误，其它状态码为永久错误
+func (wc *WebhookConsumer) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range wc.options.Headers {
+		req.Header.Set(k, v)
+	}
+	if wc.options.Secret != "" {
+		header := wc.options.SignatureHeader
+		if header == "" {
+			header = DefaultWebhookSignatureHeader
+		}
+		req.Header.Set(header, "sha256="+wc.sign(body))
+	}
+	resp, err := wc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		logger.GlobalLogger.Debugw("webhook发送成功", "url", url, "status", resp.StatusCode)
+		return nil
+	}
+	err = fmt.Errorf("webhook返回%s: %s", resp.Status, string(respBody))
+	logger.GlobalLogger.Errorw("webhook发送失败", "err", err, "url", url, "cfg", wc.cfg)
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return WithRetryAfter(err, parseRetryAfter(resp.Header.Get("Retry-After")))
+	default:
+		return Permanent(err)
+	}
+}
+
+// 请求体的HMAC-SHA256签名
+func (wc *WebhookConsumer) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(wc.options.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 解析Retry-After，支持秒数和http时间，无法解析时返回0
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(val); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// FilterField 删除无用
+func (wc *WebhookConsumer) FilterField(collection string, document bson.M) error {
+	if document == nil {
+		return nil
+	}
+	for k := range document {
+		if !wc.cfg.InCollectionField(collection, k) {
+			delete(document, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package consumers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 记录收到的请求
+type webhookRecorder struct {
+	mutex    sync.Mutex
+	requests []*webhookRequest
+}
+
+type webhookRequest struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+func (wr *webhookRecorder) handler(status int, header http.Header) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		wr.mutex.Lock()
+		wr.requests = append(wr.requests, &webhookRequest{path: r.URL.Path, header: r.Header, body: body})
+		wr.mutex.Unlock()
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(status)
+	}
+}
+
+func newTestWebhookConsumer(t *testing.T, url string, options map[string]interface{}) *WebhookConsumer {
+	t.Helper()
+	cfg := &config.SyncConfig{
+		Type:           TypeWebhook,
+		DestinationUri: url,
+		SourceDb:       "src",
+		DestinationDb:  "dst",
+		Collections:    map[string]string{"goods": "goods", "users": "users"},
+		Options:        options,
+	}
+	consumer, err := NewWebhookConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return consumer.(*WebhookConsumer)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	recorder := new(webhookRecorder)
+	server := httptest.NewServer(recorder.handler(http.StatusOK, nil))
+	defer server.Close()
+	wc := newTestWebhookConsumer(t, server.URL, map[string]interface{}{"secret": "s3cret"})
+
+	if err := wc.HandleData(context.Background(), testEvent(t, "insert", "goods", "1", bson.M{"name": "a"})); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.requests) != 1 {
+		t.Fatalf("requests = %d, want 1", len(recorder.requests))
+	}
+	req := recorder.requests[0]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(req.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.header.Get(DefaultWebhookSignatureHeader); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("content type = %s", got)
+	}
+	body := struct {
+		Db         string              `json:"db"`
+		Collection string              `json:"collection"`
+		Event      *models.ChangeEvent `json:"event"`
+	}{}
+	if err := json.Unmarshal(req.body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Db != "dst" || body.Collection != "goods" || body.Event.Operation != "insert" {
+		t.Errorf("body = %s", req.body)
+	}
+}
+
+func TestWebhookBatchAndUrls(t *testing.T) {
+	recorder := new(webhookRecorder)
+	mux := http.NewServeMux()
+	mux.Handle("/", recorder.handler(http.StatusOK, nil))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	wc := newTestWebhookConsumer(t, server.URL+"/default", map[string]interface{}{
+		"batch": true,
+		"urls":  map[string]interface{}{"users": server.URL + "/users"},
+	})
+
+	err := wc.HandleBatch(context.Background(), []*models.ChangeEvent{
+		testEvent(t, "insert", "goods", "1", bson.M{"name": "a"}),
+		testEvent(t, "insert", "goods", "2", bson.M{"name": "b"}),
+		testEvent(t, "delete", "users", "3", nil),
+		testEvent(t, "insert", "goods", "4", bson.M{"name": "c"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 连续发往同一个url的事件合并为一个数组，保持顺序
+	want := []struct {
+		path  string
+		count int
+	}{
+		{"/default", 2},
+		{"/users", 1},
+		{"/default", 1},
+	}
+	if len(recorder.requests) != len(want) {
+		t.Fatalf("requests = %d, want %d", len(recorder.requests), len(want))
+	}
+	for i, w := range want {
+		req := recorder.requests[i]
+		if req.path != w.path {
+			t.Errorf("request %d path = %s, want %s", i, req.path, w.path)
+		}
+		var batch []json.RawMessage
+		if err := json.Unmarshal(req.body, &batch); err != nil {
+			t.Fatalf("request %d body is not an array: %s", i, req.body)
+		}
+		if len(batch) != w.count {
+			t.Errorf("request %d batch size = %d, want %d", i, len(batch), w.count)
+		}
+	}
+}
+
+func TestWebhookErrorClassification(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryAfter string
+		permanent  bool
+		delay      time.Duration
+	}{
+		{status: http.StatusTooManyRequests, retryAfter: "7", delay: 7 * time.Second},
+		{status: http.StatusServiceUnavailable, retryAfter: "3", delay: 3 * time.Second},
+		{status: http.StatusInternalServerError},
+		{status: http.StatusRequestTimeout},
+		{status: http.StatusBadRequest, permanent: true},
+		{status: http.StatusNotFound, permanent: true},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.retryAfter != "" {
+			header.Set("Retry-After", tt.retryAfter)
+		}
+		server := httptest.NewServer(new(webhookRecorder).handler(tt.status, header))
+		wc := newTestWebhookConsumer(t, server.URL, nil)
+		err := wc.HandleData(context.Background(), testEvent(t, "insert", "goods", "1", bson.M{"name": "a"}))
+		server.Close()
+		if err == nil {
+			t.Errorf("status %d: no error", tt.status)
+			continue
+		}
+		if got := IsPermanentError(wc, err); got != tt.permanent {
+			t.Errorf("status %d: permanent = %v, want %v", tt.status, got, tt.permanent)
+		}
+		delay, ok := RetryAfter(err)
+		if ok != (tt.delay > 0) || delay != tt.delay {
+			t.Errorf("status %d: retry after = %v %v, want %v", tt.status, delay, ok, tt.delay)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package program
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/deadletter"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/program/consumers"
+)
+
+/* 死信查看、重新写入和丢弃，可以在程序运行时执行 */
+
+// ListDeadLetters 按创建时间顺序读取死信，key为空时读取全部
+func ListDeadLetters(cfg *config.Config, key string) ([]*deadletter.Record, error) {
+	logger.NewLogger(cfg.Debug)
+	defer logger.DestroyLogger()
+	store, err := deadletter.NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	return store.List(key)
+}
+
+// GetDeadLetter 读取一条死信
+func GetDeadLetter(cfg *config.Config, id string) (*deadletter.Record, error) {
+	logger.NewLogger(cfg.Debug)
+	defer logger.DestroyLogger()
+	store, err := deadletter.NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	return store.Get(id)
+}
+
+// RedriveDeadLetters 重新写入死信，成功后删除，失败时更新错误和写入次数
+// ids为空时重新写入全部死信，返回成功写入的条数
+// 死信之后同一文档的事件可能已写入目标，重新写入会把文档回退到死信中的旧状态，需要force确认
+func RedriveDeadLetters(cfg *config.Config, ids []string, force bool) (int, error) {
+	if !force {
+		return 0, errors.New("重新写入死信可能把文档回退到旧状态，确认后使用--force执行")
+	}
+	logger.NewLogger(cfg.Debug)
+	defer logger.DestroyLogger()
+	store, err := deadletter.NewStore(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+	records, err := getDeadLetters(store, ids)
+	if err != nil {
+		return 0, err
+	}
+	// 只初始化死信涉及的消费者，结束后断开
+	initialized := make(map[string]consumers.Consumer)
+	defer func() {
+		for _, consumer := range initialized {
+			consumer.Disconnect()
+		}
+	}()
+	redriven := 0
+	for _, record := range records {
+		consumer := initialized[record.Key]
+		if consumer == nil {
+			syncCfg, err := findSyncConfig(cfg, record.Key)
+			if err != nil {
+				return redriven, err
+			}
+			consumer, err = consumers.New(syncCfg)
+			if err != nil {
+				return redriven, fmt.Errorf("初始化目标db消费者错误: %v", err)
+			}
+			initialized[record.Key] = consumer
+		}
+		err = consumers.HandleData(context.Background(), consumer, record.Events)
+		if err != nil {
+			record.Error = err.Error()
+			record.Attempts++
+			record.UpdatedAt = time.Now()
+			if putErr := store.Put(record); putErr != nil {
+				logger.GlobalLogger.Errorw("更新死信错误", "err", putErr, "id", record.ID)
+			}
+			return redriven, fmt.Errorf("重新写入死信 %s 错误: %v", record.ID, err)
+		}
+		err = store.Delete(record.ID)
+		if err != nil {
+			return redriven, fmt.Errorf("删除已重新写入的死信 %s 错误: %v", record.ID, err)
+		}
+		redriven++
+		logger.GlobalLogger.Infow("死信已重新写入", "id", record.ID, "key", record.Key, "events", len(record.Events))
+	}
+	return redriven, nil
+}
+
+// DiscardDeadLetters 丢弃死信，ids为空时丢弃全部，返回丢弃的条数
+func DiscardDeadLetters(cfg *config.Config, ids []string) (int, error) {
+	logger.NewLogger(cfg.Debug)
+	defer logger.DestroyLogger()
+	store, err := deadletter.NewStore(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+	records, err := getDeadLetters(store, ids)
+	if err != nil {
+		return 0, err
+	}
+	discarded := 0
+	for _, record := range records {
+		err = store.Delete(record.ID)
+		if err != nil {
+			return discarded, fmt.Errorf("丢弃死信 %s 错误: %v", record.ID, err)
+		}
+		discarded++
+		logger.GlobalLogger.Infow("死信已丢弃", "id", record.ID, "key", record.Key, "error", record.Error)
+	}
+	return discarded, nil
+}
+
+// 按id读取死信，ids为空时读取全部
+func getDeadLetters(store deadletter.Store, ids []string) ([]*deadletter.Record, error) {
+	if len(ids) == 0 {
+		return store.List("")
+	}
+	records := make([]*deadletter.Record, 0, len(ids))
+	for _, id := range ids {
+		record, err := store.Get(id)
+		if err != nil {
+			return nil, fmt.Errorf("读取死信 %s 错误: %v", id, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,461 @@
+package program
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/deadletter"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"github.com/shiguanghuxian/mongodb-sync/program/consumers"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/* 消费者分区，同一个文档的事件在同一个分区按顺序处理，不同文档的事件并发处理 */
+
+const (
+	DefaultConsumerWorkers = 4  // 默认每个sync配置的消费分区数
+	PartitionQueueSize     = 64 // 每个分区等待处理的事件组数
+)
+
+// 分区待处理的一组事件
+type partitionTask struct {
+	seq    uint64
+	events []*models.ChangeEvent
+}
+
+// 事件分发，按命名空间和文档唯一标识分区
+type eventDispatcher struct {
+	ctx        context.Context // 取消后分区停止处理，未完成的事件不标记完成
+	key        string
+	consumer   consumers.Consumer
+	batch      *config.BatchConfig
+	partitions []chan *partitionTask
+	mutex      sync.Mutex // 多个订阅同时分发时保证分配序号和入队顺序一致
+	tracker    *checkpointTracker
+	retry      *config.RetryConfig
+
+	deadLetters deadletter.Store // 死信存储，为nil时写入失败一直重试
+	maxAttempts int              // 永久错误写入失败多少次后保存为死信
+}
+
+func newEventDispatcher(ctx context.Context, syncCfg *config.SyncConfig, consumer consumers.Consumer, setLastEventIds func(key string, val []byte), deadLetters deadletter.Store, maxAttempts int) *eventDispatcher {
+	key := syncCfg.GetKey()
+	workers := syncCfg.Workers
+	if workers <= 0 {
+		workers = DefaultConsumerWorkers
+	}
+	d := &eventDispatcher{
+		ctx:        ctx,
+		key:        key,
+		consumer:   consumer,
+		batch:      syncCfg.Batch,
+		partitions: make([]chan *partitionTask, workers),
+		tracker:    newCheckpointTracker(ctx, setLastEventIds),
+		retry:      syncCfg.Retry,
+
+		deadLetters: deadLetters,
+		maxAttempts: maxAttempts,
+	}
+	for i := range d.partitions {
+		d.partitions[i] = make(chan *partitionTask, PartitionQueueSize)
+		go d.work(d.partitions[i])
+	}
+	return d
+}
+
+// 分区消费，单条事件按条数、字节数或等待时间合并为一批写入，源事务单独处理
+func (d *eventDispatcher) work(partition chan *partitionTask) {
+	maxCount, maxBytes, linger := d.batch.GetMaxCount(), d.batch.GetMaxBytes(), d.batch.GetLinger()
+	batch := make([]*partitionTask, 0, maxCount)
+	batchBytes := 0
+	var lingerTimer *time.Timer
+	var lingerChan <-chan time.Time
+	flush := func() {
+		if lingerTimer != nil {
+			lingerTimer.Stop()
+			lingerTimer, lingerChan = nil, nil
+		}
+		if len(batch) == 0 {
+			return
+		}
+		events := make([]*models.ChangeEvent, 0, len(batch))
+		for _, v := range batch {
+			events = append(events, v.events...)
+		}
+		// 多条事件的批次遇到永久错误时逐个事件写入，找出失败的事件，其余事件正常写入
+		if len(batch) > 1 {
+			_, err := d.handle(func() error {
+				return consumers.HandleBatch(d.ctx, d.consumer, events)
+			}, 1)
+			if err != nil {
+				if d.ctx.Err() != nil {
+					return
+				}
+				logger.GlobalLogger.Warnw("批量写入出现永久错误，逐条写入", "err", err, "key", d.key, "count", len(events))
+				for _, v := range batch {
+					v := v
+					if !d.apply(v.events, func() error {
+						return consumers.HandleBatch(d.ctx, d.consumer, v.events)
+					}) {
+						return
+					}
+				}
+			}
+		} else if !d.apply(events, func() error {
+			return consumers.HandleBatch(d.ctx, d.consumer, events)
+		}) {
+			return
+		}
+		for _, v := range batch {
+			d.tracker.done(v.seq)
+		}
+		batch = batch[:0]
+		batchBytes = 0
+	}
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case task := <-partition:
+			if len(task.events) > 1 {
+				flush()
+				if !d.apply(task.events, func() error {
+					return consumers.HandleData(d.ctx, d.consumer, task.events)
+				}) {
+					return
+				}
+				d.tracker.done(task.seq)
+				continue
+			}
+			batch = append(batch, task)
+			batchBytes += eventSize(task.events[0])
+			// 不等待时分区没有待处理事件即写入，否则等待凑满批次
+			if len(batch) >= maxCount || batchBytes >= maxBytes || (linger == 0 && len(partition) == 0) {
+				flush()
+			} else if lingerChan == nil && linger > 0 {
+				lingerTimer = time.NewTimer(linger)
+				lingerChan = lingerTimer.C
+			}
+		case <-lingerChan:
+			lingerTimer, lingerChan = nil, nil
+			flush()
+		}
+	}
+}
+
+// 写入目标，失败时按sync配置的重试策略重试
+// 临时错误按指数退避重试，超过重试次数后分区阻塞，按最大间隔一直重试，不跳过事件
+// 永久错误写入deadLetterAttempts次后返回错误和写入次数，deadLetterAttempts为0时同临时错误一直重试
+// 成功或保存为死信前不标记完成，结束位置不会越过未处理的事件，保证至少一次写入
+// 程序结束取消ctx时停止重试，返回ctx的错误
+func (d *eventDispatcher) handle(fn func() error, deadLetterAttempts int) (int, error) {
+	backoff := newRetryBackoff(d.retry)
+	maxAttempts := d.retry.GetMaxAttempts()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > maxAttempts {
+				logger.GlobalLogger.Infow("写入目标恢复，分区继续处理", "key", d.key, "attempts", attempt)
+			}
+			return attempt, nil
+		}
+		if d.ctx.Err() != nil {
+			return attempt, d.ctx.Err()
+		}
+		permanent := consumers.IsPermanentError(d.consumer, err)
+		if permanent && deadLetterAttempts > 0 && attempt >= deadLetterAttempts {
+			return attempt, err
+		}
+		if attempt >= maxAttempts {
+			retryInterval := retryAfter(backoff.max(), err)
+			logger.GlobalLogger.Errorw("写入目标重试次数用尽，分区阻塞，等待目标恢复", "err", err, "key", d.key, "permanent", permanent, "attempt", attempt, "retry_interval", retryInterval.String())
+			log.Println("写入目标重试次数用尽，分区阻塞", d.key, err)
+			if !d.sleep(retryInterval) {
+				return attempt, d.ctx.Err()
+			}
+			continue
+		}
+		retryInterval := retryAfter(backoff.next(), err)
+		logger.GlobalLogger.Warnw("写入目标失败，等待重试", "err", err, "key", d.key, "permanent", permanent, "attempt", attempt, "retry_interval", retryInterval.String())
+		if !d.sleep(retryInterval) {
+			return attempt, d.ctx.Err()
+		}
+	}
+}
+
+// 目标要求的重试间隔(例如Retry-After)大于退避间隔时按目标要求等待
+func retryAfter(interval time.Duration, err error) time.Duration {
+	if delay, ok := consumers.RetryAfter(err); ok && delay > interval {
+		return delay
+	}
+	return interval
+}
+
+// 等待重试间隔，ctx取消时返回false
+func (d *eventDispatcher) sleep(interval time.Duration) bool {
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-d.ctx.Done():
+		return false
+	}
+}
+
+// 写入一组事件，配置了死信存储时永久错误多次失败后保存为死信
+// 返回false表示程序结束，事件未处理，不能标记完成
+func (d *eventDispatcher) apply(events []*models.ChangeEvent, fn func() error) bool {
+	deadLetterAttempts := 0
+	if d.deadLetters != nil {
+		deadLetterAttempts = d.maxAttempts
+	}
+	attempts, err := d.handle(fn, deadLetterAttempts)
+	if err == nil {
+		return true
+	}
+	if d.ctx.Err() != nil {
+		return false
+	}
+	return d.deadLetter(events, err, attempts)
+}
+
+// 保存死信，保存失败时不能跳过事件，一直重试直到成功，程序结束时返回false
+func (d *eventDispatcher) deadLetter(events []*models.ChangeEvent, err error, attempts int) bool {
+	record := deadletter.NewRecord(d.key, events, err, attempts)
+	backoff := newRetryBackoff(d.retry)
+	for {
+		putErr := d.deadLetters.Put(record)
+		if putErr == nil {
+			break
+		}
+		retryInterval := backoff.next()
+		logger.GlobalLogger.Errorw("保存死信错误，等待重试", "err", putErr, "key", d.key, "retry_interval", retryInterval.String())
+		if !d.sleep(retryInterval) {
+			return false
+		}
+	}
+	logger.GlobalLogger.Errorw("写入目标失败，已保存为死信", "err", err, "key", d.key, "id", record.ID, "events", len(events), "attempts", attempts)
+	log.Println("写入目标失败，已保存为死信", d.key, record.ID, err)
+	return true
+}
+
+// 指数退避的重试间隔，按比例随机浮动，避免多个分区同时重试
+type retryBackoff struct {
+	cfg      *config.RetryConfig
+	interval time.Duration
+}
+
+func newRetryBackoff(cfg *config.RetryConfig) *retryBackoff {
+	return &retryBackoff{
+		cfg: cfg,
+	}
+}
+
+// 下一次重试间隔，从最小间隔开始翻倍，不超过最大间隔
+func (b *retryBackoff) next() time.Duration {
+	if b.interval == 0 {
+		b.interval = b.cfg.GetMinInterval()
+	} else {
+		b.interval *= 2
+	}
+	if max := b.cfg.GetMaxInterval(); b.interval > max {
+		b.interval = max
+	}
+	return b.jitter(b.interval)
+}
+
+// 最大重试间隔
+func (b *retryBackoff) max() time.Duration {
+	b.interval = b.cfg.GetMaxInterval()
+	return b.jitter(b.interval)
+}
+
+func (b *retryBackoff) jitter(interval time.Duration) time.Duration {
+	jitter := b.cfg.GetJitter()
+	return time.Duration(float64(interval) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+// 估算事件写入目标的字节数
+func eventSize(event *models.ChangeEvent) int {
+	size := 0
+	if event.Document != nil {
+		raw, _ := bson.Marshal(event.Document)
+		size += len(raw)
+	}
+	if event.Updates != nil {
+		raw, _ := bson.Marshal(event.Updates)
+		size += len(raw)
+	}
+	return size
+}
+
+// 分发一组事件，lastEventId为这组事件处理完成后checkpointKey的结束位置，返回分配的序号
+// events为空表示事件被跳过，只记录位置
+// 程序结束取消ctx后分区不再处理，返回ctx的错误，调用方需要停止读取
+func (d *eventDispatcher) dispatch(checkpointKey string, events []*models.ChangeEvent, lastEventId []byte) (uint64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(events) == 0 {
+		return d.tracker.add(checkpointKey, lastEventId, true), nil
+	}
+	partition, ok := d.partition(events)
+	if ok {
+		seq := d.tracker.add(checkpointKey, lastEventId, false)
+		return seq, d.send(partition, &partitionTask{seq: seq, events: events})
+	}
+	// 表结构变化和涉及多个分区的事务，等待之前的事件全部完成后单独处理，完成后再继续分发
+	if err := d.tracker.waitFor(d.tracker.last()); err != nil {
+		return 0, err
+	}
+	seq := d.tracker.add(checkpointKey, lastEventId, false)
+	if err := d.send(0, &partitionTask{seq: seq, events: events}); err != nil {
+		return seq, err
+	}
+	return seq, d.tracker.waitFor(seq)
+}
+
+// 放入分区队列，队列满时等待，ctx取消时返回ctx的错误
+func (d *eventDispatcher) send(partition int, task *partitionTask) error {
+	select {
+	case d.partitions[partition] <- task:
+		return nil
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	}
+}
+
+// 只记录位置，在之前的事件全部完成后生效
+func (d *eventDispatcher) checkpoint(checkpointKey string, lastEventId []byte) error {
+	_, err := d.dispatch(checkpointKey, nil, lastEventId)
+	return err
+}
+
+// 等待指定序号及之前的事件全部处理完成，ctx取消时返回ctx的错误
+func (d *eventDispatcher) waitFor(seq uint64) error {
+	return d.tracker.waitFor(seq)
+}
+
+// 一组事件所在分区，没有文档唯一标识或分布在多个分区时返回false
+func (d *eventDispatcher) partition(events []*models.ChangeEvent) (int, bool) {
+	partition := -1
+	for _, v := range events {
+		if v.DocumentKey.IsZero() {
+			return 0, false
+		}
+		h := fnv.New32a()
+		h.Write([]byte(v.Namespace.Db + "." + v.Namespace.Coll))
+		h.Write(v.DocumentKey.Raw())
+		i := int(h.Sum32() % uint32(len(d.partitions)))
+		if partition >= 0 && partition != i {
+			return 0, false
+		}
+		partition = i
+	}
+	return partition, true
+}
+
+// 结束位置跟踪，只有某个序号及之前的事件全部完成时才推进结束位置
+// 同一个分发中多个订阅的事件共用序号，结束位置按各自的checkpointKey保存
+type checkpointTracker struct {
+	ctx             context.Context // 取消后等待立即返回
+	setLastEventIds func(key string, val []byte)
+	mutex           sync.Mutex
+	cond            *sync.Cond
+	nextSeq         uint64                        // 下一个分配的序号，从1开始
+	completedSeq    uint64                        // 此序号及之前的事件已全部完成
+	pending         map[uint64]*pendingCheckpoint // 未推进的序号
+}
+
+type pendingCheckpoint struct {
+	key         string // 结束位置key，lastEventId为空时不使用
+	lastEventId []byte
+	done        bool
+}
+
+func newCheckpointTracker(ctx context.Context, setLastEventIds func(key string, val []byte)) *checkpointTracker {
+	t := &checkpointTracker{
+		ctx:             ctx,
+		setLastEventIds: setLastEventIds,
+		nextSeq:         1,
+		pending:         make(map[uint64]*pendingCheckpoint),
+	}
+	t.cond = sync.NewCond(&t.mutex)
+	// ctx取消时唤醒等待
+	go func() {
+		<-ctx.Done()
+		t.mutex.Lock()
+		t.cond.Broadcast()
+		t.mutex.Unlock()
+	}()
+	return t
+}
+
+// 添加一个序号
+func (t *checkpointTracker) add(key string, lastEventId []byte, done bool) uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	seq := t.nextSeq
+	t.nextSeq++
+	t.pending[seq] = &pendingCheckpoint{key: key, lastEventId: lastEventId, done: done}
+	if done {
+		t.advance()
+	}
+	return seq
+}
+
+// 最后分配的序号
+func (t *checkpointTracker) last() uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.nextSeq - 1
+}
+
+// 标记序号完成
+func (t *checkpointTracker) done(seq uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if v := t.pending[seq]; v != nil {
+		v.done = true
+	}
+	t.advance()
+}
+
+// 按顺序推进已完成的序号，保存每个结束位置key最后的结束位置
+func (t *checkpointTracker) advance() {
+	lastEventIds := make(map[string][]byte)
+	for {
+		v := t.pending[t.completedSeq+1]
+		if v == nil || !v.done {
+			break
+		}
+		delete(t.pending, t.completedSeq+1)
+		t.completedSeq++
+		if len(v.lastEventId) > 0 {
+			lastEventIds[v.key] = v.lastEventId
+		}
+	}
+	for key, lastEventId := range lastEventIds {
+		t.setLastEventIds(key, lastEventId)
+	}
+	t.cond.Broadcast()
+}
+
+// 等待序号及之前的事件全部完成，ctx取消时返回ctx的错误
+func (t *checkpointTracker) waitFor(seq uint64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for t.completedSeq < seq {
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+		t.cond.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package program
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"github.com/shiguanghuxian/mongodb-sync/program/consumers"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// 测试不写日志文件
+	logger.GlobalLogger = &logger.Logger{SugaredLogger: zap.NewNop().Sugar()}
+	os.Exit(m.Run())
+}
+
+// 批量写入前几次失败的消费者
+type failingBatchConsumer struct {
+	mutex    sync.Mutex
+	failures int
+	calls    int
+	failed   chan struct{} // 每次失败后通知
+}
+
+func (c *failingBatchConsumer) HandleBatch(ctx context.Context, data []*models.ChangeEvent) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.calls++
+	if c.calls <= c.failures {
+		c.failed <- struct{}{}
+		return errors.New("broker not available")
+	}
+	return nil
+}
+
+func (c *failingBatchConsumer) HandleData(ctx context.Context, data *models.ChangeEvent) error {
+	return c.HandleBatch(ctx, []*models.ChangeEvent{data})
+}
+
+func (c *failingBatchConsumer) FilterField(collection string, document bson.M) error {
+	return nil
+}
+
+func (c *failingBatchConsumer) Capabilities() consumers.Capabilities {
+	return consumers.Capabilities{Batch: true}
+}
+
+func (c *failingBatchConsumer) Health(ctx context.Context) error {
+	return nil
+}
+
+func (c *failingBatchConsumer) Disconnect() error {
+	return nil
+}
+
+func TestDispatcherBatchFailureKeepsCheckpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer := &failingBatchConsumer{failures: 2, failed: make(chan struct{}, 2)}
+	var mutex sync.Mutex
+	checkpoints := make(map[string][]byte)
+	syncCfg := &config.SyncConfig{
+		Name:    "test",
+		Workers: 1,
+		Retry:   &config.RetryConfig{MaxAttempts: 10, MinIntervalMs: 1, MaxIntervalMs: 1},
+	}
+	d := newEventDispatcher(ctx, syncCfg, consumer, func(key string, val []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		checkpoints[key] = val
+	}, nil, 0)
+
+	event := &models.ChangeEvent{Operation: "insert", Document: bson.M{"name": "a"}}
+	event.Namespace.Db = "src"
+	event.Namespace.Coll = "goods"
+	event.DocumentKey, _ = models.NewDocumentKey(bson.D{{Key: "_id", Value: "1"}})
+	seq, err := d.dispatch("cp", []*models.ChangeEvent{event}, []byte("position"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 写入失败时不推进结束位置
+	<-consumer.failed
+	mutex.Lock()
+	if _, ok := checkpoints["cp"]; ok {
+		t.Error("checkpoint advanced after failed batch")
+	}
+	mutex.Unlock()
+
+	// 重试成功后推进
+	if err := d.waitFor(seq); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if string(checkpoints["cp"]) != "position" {
+		t.Errorf("checkpoint = %q, want position", checkpoints["cp"])
+	}
+}
+
+func TestDispatcherStopsWaitingOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &failingBatchConsumer{failures: 1 << 30, failed: make(chan struct{}, 1)}
+	syncCfg := &config.SyncConfig{
+		Name:    "test",
+		Workers: 1,
+		Retry:   &config.RetryConfig{MaxAttempts: 1, MinIntervalMs: 1, MaxIntervalMs: 1},
+	}
+	d := newEventDispatcher(ctx, syncCfg, consumer, func(key string, val []byte) {}, nil, 0)
+	event := &models.ChangeEvent{Operation: "drop"}
+	event.Namespace.Db = "src"
+	event.Namespace.Coll = "goods"
+
+	// 没有文档唯一标识的事件等待处理完成，程序结束时返回ctx的错误
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.dispatch("cp", []*models.ChangeEvent{event}, []byte("position"))
+		done <- err
+	}()
+	<-consumer.failed
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("dispatch error = %v, want context canceled", err)
+	}
+}
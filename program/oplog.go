@@ -0,0 +1,364 @@
+package program
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/common"
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"github.com/shiguanghuxian/mongodb-sync/internal/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+)
+
+/* 直接读取local.oplog.rs，用于不支持change stream的3.6以下版本
+ * oplog记录转换为ChangeEvent交给消费者，按oplog的ts记录结束位置，继续读取时从ts之后开始 */
+
+// oplog中的一条记录
+type oplogEntry struct {
+	Ts primitive.Timestamp `bson:"ts"`
+	Op string              `bson:"op"`
+	Ns string              `bson:"ns"`
+	O  bson.M              `bson:"o"`
+	O2 bson.M              `bson:"o2"`
+}
+
+// 处理一个db的oplog读取
+func (p *Program) producerOplog(syncCfg *config.SyncConfig) {
+	if syncCfg == nil {
+		return
+	}
+	logger.GlobalLogger.Infow("处理一个db的oplog读取", "cfg", syncCfg)
+	log.Println("处理一个db的oplog读取", syncCfg)
+	key := syncCfg.GetKey()
+	dispatcher := p.dispatchers[key]
+	if dispatcher == nil {
+		logger.GlobalLogger.Errorw("出现了nil的分发", "key", key)
+		return
+	}
+	if syncCfg.Filter != nil && (syncCfg.Filter.Match != "" || syncCfg.Filter.Project != "") {
+		logger.GlobalLogger.Warnw("读取oplog时不支持filter.match和filter.project，已忽略", "cfg", syncCfg)
+	}
+	if err := p.startOplog(syncCfg, dispatcher); err != nil {
+		go p.restartOplog(syncCfg, dispatcher, err)
+	}
+}
+
+// 获取开始位置或全量同步失败后按指数退避重新开始，无法继续时标记为失败状态
+func (p *Program) restartOplog(syncCfg *config.SyncConfig, dispatcher *eventDispatcher, err error) {
+	p.restartWatch(syncCfg, err, func() error {
+		return p.startOplog(syncCfg, dispatcher)
+	})
+}
+
+// 开始读取oplog，需要时先全量同步，返回错误时由restartOplog重新开始
+// 全量同步在后台执行，失败时同样重新开始
+func (p *Program) startOplog(syncCfg *config.SyncConfig, dispatcher *eventDispatcher) error {
+	key := syncCfg.GetKey()
+	// 上次结束位置或配置的开始时间
+	if lastEventId, ok := p.GetLastEventIds(key); ok {
+		ts, ok := parseOperationTimeCheckpoint(lastEventId)
+		if !ok {
+			err := errors.New("上次结束位置不是oplog时间，无法读取oplog")
+			p.setWatchState(key, "", WatchStateFailed, err)
+			logger.GlobalLogger.Errorw("无法从上次结束位置读取oplog", "err", err, "cfg", syncCfg)
+			return nil
+		}
+		go p.tailOplog(syncCfg, ts, dispatcher)
+		return nil
+	}
+	if syncCfg.StartAt != "" {
+		ts, _ := common.ParseOperationTime(syncCfg.StartAt)
+		p.SetLastEventIds(key, operationTimeCheckpoint(ts))
+		go p.tailOplog(syncCfg, ts, dispatcher)
+		return nil
+	}
+
+	// 从最新位置开始，需要全量同步时在复制前记录位置，有未完成的全量同步时从其记录的位置继续
+	// 配置了全量同步或执行了backfill命令时需要全量同步
+	progress := p.getSnapshotProgress(key)
+	needSnapshot := syncCfg.Snapshot || progress != nil
+	var ts primitive.Timestamp
+	hasTs := false
+	if progress != nil {
+		ts, hasTs = parseOperationTimeCheckpoint(progress.ResumeTokens[""])
+	}
+	if !hasTs {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var err error
+		ts, err = mongodb.NewestOplogTime(ctx)
+		if err != nil {
+			logger.GlobalLogger.Errorw("获取oplog最新位置错误", "err", err, "cfg", syncCfg)
+			return err
+		}
+	}
+	if !needSnapshot {
+		p.SetLastEventIds(key, operationTimeCheckpoint(ts))
+		go p.tailOplog(syncCfg, ts, dispatcher)
+		return nil
+	}
+	if progress == nil {
+		progress = newSnapshotProgress()
+	}
+	if !hasTs {
+		progress.ResumeTokens[""] = operationTimeCheckpoint(ts)
+		p.setSnapshotProgress(key, progress)
+	}
+	go func() {
+		err := p.snapshot(syncCfg, progress, dispatcher)
+		if err != nil {
+			logger.GlobalLogger.Errorw("全量同步已有数据错误", "err", err, "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb)
+			// 从全量同步进度继续
+			p.restartOplog(syncCfg, dispatcher, err)
+			return
+		}
+		if err := dispatcher.checkpoint(key, operationTimeCheckpoint(ts)); err != nil {
+			return
+		}
+		p.deleteSnapshotProgress(key)
+		p.tailOplog(syncCfg, ts, dispatcher)
+	}()
+	return nil
+}
+
+// 从ts之后读取oplog，中断后从最后位置重新读取
+func (p *Program) tailOplog(syncCfg *config.SyncConfig, ts primitive.Timestamp, dispatcher *eventDispatcher) {
+	key := syncCfg.GetKey()
+	retryInterval := WatchRetryMinInterval
+	for {
+		// 位置已被oplog覆盖时无法继续，无法获取oplog范围时稍后重试
+		err := checkOplogWindow(ts)
+		if errors.Is(err, errOplogWindowExceeded) {
+			p.setWatchState(key, "", WatchStateFailed, err)
+			logger.GlobalLogger.Errorw("无法从最后位置继续读取oplog，同步已停止，需要人工处理", "err", err, "cfg", syncCfg)
+			log.Println("无法从最后位置继续读取oplog，同步已停止，需要人工处理", syncCfg.SourceDb, err)
+			return
+		}
+		count := 0
+		if err == nil {
+			p.setWatchState(key, "", WatchStateRunning, nil)
+			count, err = p.readOplog(syncCfg, &ts, dispatcher)
+		}
+		if p.stop {
+			return
+		}
+		if count > 0 {
+			retryInterval = WatchRetryMinInterval
+		}
+		p.setWatchState(key, "", WatchStateReconnecting, err)
+		logger.GlobalLogger.Warnw("读取oplog中断，准备重新读取", "err", err, "source_db", syncCfg.SourceDb, "retry_interval", retryInterval.String())
+		log.Println("读取oplog中断，准备重新读取", syncCfg.SourceDb, err)
+		time.Sleep(retryInterval)
+		if p.stop {
+			return
+		}
+		retryInterval *= 2
+		if retryInterval > WatchRetryMaxInterval {
+			retryInterval = WatchRetryMaxInterval
+		}
+	}
+}
+
+// 读取oplog直到游标结束，返回读取的记录数
+func (p *Program) readOplog(syncCfg *config.SyncConfig, ts *primitive.Timestamp, dispatcher *eventDispatcher) (int, error) {
+	key := syncCfg.GetKey()
+	ctx := context.TODO()
+	findOptions := options.Find().
+		SetCursorType(options.TailableAwait).
+		SetOplogReplay(true).
+		SetNoCursorTimeout(true).
+		SetMaxAwaitTime(time.Second)
+	cursor, err := mongodb.SourceClient.Database("local").Collection("oplog.rs").Find(ctx, oplogFilter(syncCfg, *ts), findOptions)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	count := 0
+	for cursor.Next(ctx) {
+		count++
+		entry := new(oplogEntry)
+		if err := cursor.Decode(entry); err != nil {
+			logger.GlobalLogger.Errorw("解析oplog错误", "err", err, "syncCfg", syncCfg)
+			continue
+		}
+		*ts = entry.Ts
+		changeEvent := p.oplogToChangeEvent(syncCfg, entry)
+		if changeEvent != nil {
+			changeEvent = postImageFallback(syncCfg, changeEvent)
+		}
+		// 本次数据变更处理完成时存储到lastEventIds
+		// 程序结束时分发返回错误，停止读取
+		if changeEvent == nil {
+			err = dispatcher.checkpoint(key, operationTimeCheckpoint(entry.Ts))
+		} else {
+			_, err = dispatcher.dispatch(key, []*models.ChangeEvent{changeEvent}, operationTimeCheckpoint(entry.Ts))
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, cursor.Err()
+}
+
+// 读取oplog的查询条件，只读取同步db的数据变更和删除、重命名命令
+func oplogFilter(syncCfg *config.SyncConfig, ts primitive.Timestamp) bson.M {
+	dbPattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(syncCfg.SourceDb+".")}
+	var ns interface{} = dbPattern
+	if syncCfg.Filter != nil && len(syncCfg.Filter.Namespaces) > 0 {
+		namespaces := make([]string, 0, len(syncCfg.Filter.Namespaces)+1)
+		for _, v := range syncCfg.Filter.Namespaces {
+			namespaces = append(namespaces, syncCfg.SourceDb+"."+v)
+		}
+		namespaces = append(namespaces, syncCfg.SourceDb+".$cmd")
+		ns = bson.M{"$in": namespaces}
+	}
+	return bson.M{
+		"ts":          bson.M{"$gt": ts},
+		"fromMigrate": bson.M{"$exists": false}, // 分片迁移产生的记录
+		"$or": bson.A{
+			bson.M{"ns": ns},
+			bson.M{"ns": "admin.$cmd", "o.renameCollection": dbPattern},
+		},
+	}
+}
+
+// oplog记录转换为ChangeEvent，不需要处理的记录返回nil
+func (p *Program) oplogToChangeEvent(syncCfg *config.SyncConfig, entry *oplogEntry) *models.ChangeEvent {
+	changeEvent := &models.ChangeEvent{
+		// 与change stream的resume token一样，事件id即为结束位置
+		ID:          bsonx.Doc{{Key: OperationTimeKey, Value: bsonx.Timestamp(entry.Ts.T, entry.Ts.I)}},
+		ClusterTime: entry.Ts,
+	}
+	changeEvent.Namespace.Db, changeEvent.Namespace.Coll = splitNamespace(entry.Ns)
+	// 文档唯一标识，更新和删除的oplog中包含分片键字段
+	var key bson.M
+	switch entry.Op {
+	case "i":
+		changeEvent.Operation = "insert"
+		changeEvent.Document = entry.O
+		key = bson.M{"_id": entry.O["_id"]}
+	case "u":
+		key = entry.O2
+		if isUpdateOperators(entry.O) {
+			changeEvent.Operation = "update"
+			changeEvent.Updates = oplogUpdateDescription(entry.O)
+			changeEvent.Document = p.lookupDocument(changeEvent.Namespace.Db, changeEvent.Namespace.Coll, entry.O2["_id"])
+		} else {
+			changeEvent.Operation = "replace"
+			changeEvent.Document = entry.O
+		}
+	case "d":
+		changeEvent.Operation = "delete"
+		key = entry.O
+	case "c":
+		if !oplogCommandEvent(entry, changeEvent) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	if syncCfg.Filter != nil && len(syncCfg.Filter.OperationTypes) > 0 && !inStrings(syncCfg.Filter.OperationTypes, changeEvent.Operation) {
+		return nil
+	}
+	if key != nil {
+		documentKey, err := models.NewDocumentKey(key)
+		if err != nil {
+			logger.GlobalLogger.Warnw("忽略文档唯一标识错误的oplog", "err", err, "ns", entry.Ns, "document_key", key)
+			return nil
+		}
+		changeEvent.DocumentKey = documentKey
+	}
+	return changeEvent
+}
+
+// 删除集合、重命名集合和删除db命令转换为对应事件
+func oplogCommandEvent(entry *oplogEntry, changeEvent *models.ChangeEvent) bool {
+	if coll, ok := entry.O["drop"].(string); ok {
+		changeEvent.Operation = "drop"
+		changeEvent.Namespace.Coll = coll
+		return true
+	}
+	if _, ok := entry.O["dropDatabase"]; ok {
+		changeEvent.Operation = "dropDatabase"
+		changeEvent.Namespace.Coll = ""
+		return true
+	}
+	if from, ok := entry.O["renameCollection"].(string); ok {
+		to, _ := entry.O["to"].(string)
+		toDb, toColl := splitNamespace(to)
+		changeEvent.Operation = "rename"
+		changeEvent.Namespace.Db, changeEvent.Namespace.Coll = splitNamespace(from)
+		changeEvent.NewCollectionName = bson.M{"db": toDb, "coll": toColl}
+		return true
+	}
+	return false
+}
+
+// 是否为$set $unset等更新操作，否则为整个文档替换
+func isUpdateOperators(o bson.M) bool {
+	for k, _ := range o {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// 将$set $unset转换为change stream的updateDescription格式
+func oplogUpdateDescription(o bson.M) *models.UpdateDescription {
+	updatedFields, _ := o["$set"].(bson.M)
+	if updatedFields == nil {
+		updatedFields = bson.M{}
+	}
+	removedFields := make([]string, 0)
+	if unset, ok := o["$unset"].(bson.M); ok {
+		for k, _ := range unset {
+			removedFields = append(removedFields, k)
+		}
+	}
+	return &models.UpdateDescription{UpdatedFields: updatedFields, RemovedFields: removedFields}
+}
+
+// 查询更新后的完整文档，与change stream的updateLookup一致，文档已删除时返回nil
+func (p *Program) lookupDocument(db, coll string, id interface{}) bson.M {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	document := bson.M{}
+	err := mongodb.SourceClient.Database(db).Collection(coll).FindOne(ctx, bson.M{"_id": id}).Decode(&document)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logger.GlobalLogger.Errorw("查询更新后的文档错误", "err", err, "db", db, "coll", coll, "_id", id)
+		}
+		return nil
+	}
+	return document
+}
+
+// 拆分db.collection格式的命名空间
+func splitNamespace(ns string) (string, string) {
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func inStrings(list []string, str string) bool {
+	for _, v := range list {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
@@ -1,31 +1,41 @@
 package program
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
 	"log"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/shiguanghuxian/mongodb-sync/internal/checkpoint"
 	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/deadletter"
 	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
-	"github.com/shiguanghuxian/mongodb-sync/internal/models"
 	"github.com/shiguanghuxian/mongodb-sync/internal/mongodb"
 	"github.com/shiguanghuxian/mongodb-sync/program/consumers"
 )
 
-const (
-	LastEventIdsFileName = "last_event_ids.json"
-)
-
 // Program 程序实体
 type Program struct {
-	cfg            *config.Config
-	collectionChan map[string]chan *models.ChangeEvent
-	lastEventIds   map[string][]byte // 保存最后watch的id
-	mutex          sync.RWMutex
-	stop           bool // 是否结束
+	cfg             *config.Config
+	dispatchers     map[string]*eventDispatcher   // 每个sync配置的事件分发
+	consumers       map[string]consumers.Consumer // 每个sync配置的目标db消费者
+	lastEventIds    map[string][]byte             // 保存最后watch的id
+	deletedEventIds map[string]bool               // 已删除，下次保存时从存储删除的结束位置
+	mutex           sync.RWMutex
+	checkpointStore checkpoint.Store // 结束位置存储
+	deadLetterStore deadletter.Store // 死信存储，未配置时为nil
+	// 未完成的全量同步进度
+	snapshotProgress map[string]*snapshotProgress
+	snapshotMutex    sync.Mutex
+	// 订阅运行状态
+	watchStates map[string]*WatchState
+	stateMutex  sync.Mutex
+	stop        bool // 是否结束
+	// 结束时取消正在进行的写入和重试
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // New 创建程序实例
@@ -37,46 +47,67 @@ func New(cfg *config.Config) (*Program, error) {
 	if err != nil {
 		logger.GlobalLogger.Errorw("初始化源mongo连接错误", "err", err, "cfg", cfg)
 	}
-	// 初始化消费者
+	// 初始化结束位置存储
+	checkpointStore, err := checkpoint.NewStore(cfg)
+	if err != nil {
+		logger.GlobalLogger.Errorw("初始化结束位置存储错误", "err", err, "checkpoint", cfg.Checkpoint)
+		return nil, err
+	}
+	// 读取上次结束位置和全量同步进度，读取失败时不启动，避免重新订阅或全量同步后覆盖已有结束位置
+	lastEventIds, err := loadLastEventIds(checkpointStore)
+	if err != nil {
+		logger.GlobalLogger.Errorw("读取上次结束位置lastEventIds错误", "err", err, "checkpoint", cfg.Checkpoint)
+		checkpointStore.Close()
+		return nil, err
+	}
+	snapshotProgress, err := loadSnapshotProgress(checkpointStore)
+	if err != nil {
+		logger.GlobalLogger.Errorw("读取全量同步进度错误", "err", err, "checkpoint", cfg.Checkpoint)
+		checkpointStore.Close()
+		return nil, err
+	}
+	// 初始化死信存储
+	var deadLetterStore deadletter.Store
+	if cfg.DeadLetter.Enabled() {
+		deadLetterStore, err = deadletter.NewStore(cfg)
+		if err != nil {
+			logger.GlobalLogger.Errorw("初始化死信存储错误", "err", err, "dead_letter", cfg.DeadLetter)
+			checkpointStore.Close()
+			return nil, err
+		}
+	}
+	// 初始化消费者，初始化失败的sync配置不订阅
+	consumerMap := make(map[string]consumers.Consumer)
 	for _, v := range cfg.Sync {
 		if !v.Enable {
 			continue
 		}
-		v := v
-		var err error
-		switch {
-		case v.Type == config.SyncTypeMongo && v.Enable:
-			err = consumers.NewMongoConsumer(v)
-		case v.Type == config.SyncTypeFile && v.Enable:
-			err = consumers.NewFileLogConsumer(v)
-		case v.Type == config.SyncTypeEs && v.Enable:
-			err = consumers.NewElasticsearchConsumer(v)
-		case v.Type == config.SyncTypeMysql && v.Enable:
-			err = consumers.NewMysqlConsumer(v, cfg.Debug)
-		default:
-			logger.GlobalLogger.Warnw("不支持的的目标db类型", "type", v.Type)
-			continue
-		}
+		consumer, err := consumers.New(v)
 		if err != nil {
 			logger.GlobalLogger.Errorw("初始化目标db消费者错误", "err", err, "cfg", v)
+			continue
 		}
+		consumerMap[v.GetKey()] = consumer
 	}
-	// 读取上次结束位置lastEventIds
-	lastEventIds := make(map[string][]byte)
-	body, err := ioutil.ReadFile(LastEventIdsFileName)
-	if err != nil {
-		logger.GlobalLogger.Warnw("读取上次结束位置lastEventIds错误", "err", err)
-	} else {
-		err = json.Unmarshal(body, &lastEventIds)
-		if err != nil {
-			logger.GlobalLogger.Warnw("解析上次结束位置lastEventIds错误", "err", err, "body", string(body))
-		}
+	// 新配置name的sync配置沿用按默认key记录的结束位置和全量同步进度
+	migratedKeys := migrateNamedCheckpoints(cfg, lastEventIds, snapshotProgress)
+	deletedEventIds := make(map[string]bool, len(migratedKeys))
+	for _, v := range migratedKeys {
+		deletedEventIds[v] = true
 	}
-
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Program{
-		cfg:          cfg,
-		lastEventIds: lastEventIds,
-		mutex:        sync.RWMutex{},
+		cfg:              cfg,
+		consumers:        consumerMap,
+		checkpointStore:  checkpointStore,
+		deadLetterStore:  deadLetterStore,
+		lastEventIds:     lastEventIds,
+		deletedEventIds:  deletedEventIds,
+		mutex:            sync.RWMutex{},
+		snapshotProgress: snapshotProgress,
+		watchStates:      make(map[string]*WatchState),
+		ctx:              ctx,
+		cancel:           cancel,
 	}, nil
 }
 
@@ -86,10 +117,10 @@ func (p *Program) Run() {
 		js, _ := json.Marshal(p.cfg)
 		log.Println(string(js))
 	}
-	// 判断mongo版本
-	if p.cfg.Mongo.SourceVersion < 3.6 {
-		logger.GlobalLogger.Errorw("不支持mongodb 3.6以下版本", "version", p.cfg.Mongo.SourceVersion)
-		log.Println("不支持mongodb 3.6以下版本", p.cfg.Mongo.SourceVersion)
+	// 判断mongo版本，3.6以下只能读取oplog
+	if p.cfg.Mongo.SourceVersion < 3.6 && p.cfg.Mongo.GetSourceMode() != config.SourceModeOplog {
+		logger.GlobalLogger.Errorw("mongodb 3.6以下版本不支持change stream，请配置source_mode为oplog", "version", p.cfg.Mongo.SourceVersion)
+		log.Println("mongodb 3.6以下版本不支持change stream，请配置source_mode为oplog", p.cfg.Mongo.SourceVersion)
 		os.Exit(1)
 	}
 	logger.GlobalLogger.Infow("启动mongodb-sync", "cfg", p.cfg)
@@ -104,25 +135,80 @@ func (p *Program) Stop() {
 	p.stop = true // 标识结束
 	logger.DestroyLogger()
 	mongodb.DisconnectSourceClient()
-	// 将最后处理id存储到文件
-	js, _ := p.GetLastEventIdsToJsonBytes()
-	err := ioutil.WriteFile(LastEventIdsFileName, js, os.ModePerm)
+	// 存储最后处理位置
+	err := p.saveLastEventIds()
 	if err != nil {
-		logger.GlobalLogger.Infow("将lastEventIds写入文件错误", "err", err, "lastEventIds", string(js))
+		logger.GlobalLogger.Infow("存储lastEventIds错误", "err", err)
+	}
+	p.saveSnapshotProgress()
+	p.checkpointStore.Close()
+	if p.deadLetterStore != nil {
+		p.deadLetterStore.Close()
 	}
 	// 休息3秒，保证数据完成
 	time.Sleep(3 * time.Second)
-	// 销毁所有目标数据源
-	for _, v := range p.cfg.Sync {
-		if consumers.ConsumerMap[v.GetKey()] != nil {
-			err := consumers.ConsumerMap[v.GetKey()].Disconnect()
-			if err != nil {
-				logger.GlobalLogger.Errorw("销毁目标db消费者错误", "err", err, "cfg", v)
-			}
+	// 取消未完成的写入，销毁所有目标数据源
+	p.cancel()
+	for key, consumer := range p.consumers {
+		err := consumer.Disconnect()
+		if err != nil {
+			logger.GlobalLogger.Errorw("销毁目标db消费者错误", "err", err, "key", key)
+		}
+	}
+}
+
+// 检查所有目标db是否可用，同时保持连接活跃
+func (p *Program) checkConsumerHealth() {
+	for key, consumer := range p.consumers {
+		err := consumer.Health(p.ctx)
+		if err != nil {
+			logger.GlobalLogger.Errorw("目标db健康检查失败", "err", err, "key", key)
+			log.Println("目标db健康检查失败", key, err)
 		}
 	}
 }
 
+// 读取上次结束位置lastEventIds，存储中没有结束位置时返回空map
+func loadLastEventIds(store checkpoint.Store) (map[string][]byte, error) {
+	checkpoints, err := loadCheckpoints(store)
+	if err != nil {
+		return nil, err
+	}
+	lastEventIds := make(map[string][]byte, len(checkpoints))
+	for k, v := range checkpoints {
+		lastEventIds[k] = v.Token
+	}
+	return lastEventIds, nil
+}
+
+// 存储最后处理位置，并从存储删除已删除的结束位置
+func (p *Program) saveLastEventIds() error {
+	p.mutex.RLock()
+	checkpoints := make(map[string]*checkpoint.Checkpoint, len(p.lastEventIds))
+	for k, v := range p.lastEventIds {
+		checkpoints[k] = checkpoint.New(k, v)
+	}
+	deletedKeys := make([]string, 0, len(p.deletedEventIds))
+	for k := range p.deletedEventIds {
+		deletedKeys = append(deletedKeys, k)
+	}
+	p.mutex.RUnlock()
+	err := p.checkpointStore.Save(checkpoints)
+	if err != nil || len(deletedKeys) == 0 {
+		return err
+	}
+	err = p.checkpointStore.Delete(deletedKeys)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, k := range deletedKeys {
+		delete(p.deletedEventIds, k)
+	}
+	return nil
+}
+
 // 定时存储最后事件id到文件
 // 防止中途未捕获的结束事件，导致丢失数据
 func (p *Program) timerLastEventIds() {
@@ -132,10 +218,12 @@ func (p *Program) timerLastEventIds() {
 		if p.stop {
 			return
 		}
-		js, _ := p.GetLastEventIdsToJsonBytes()
-		err := ioutil.WriteFile(LastEventIdsFileName, js, os.ModePerm)
+		err := p.saveLastEventIds()
 		if err != nil {
-			logger.GlobalLogger.Infow("定时将lastEventIds写入文件错误", "err", err, "lastEventIds", string(js))
+			logger.GlobalLogger.Infow("定时存储lastEventIds错误", "err", err)
 		}
+		p.saveSnapshotProgress()
+		p.logFailedWatchStates()
+		p.checkConsumerHealth()
 	}
 }
@@ -0,0 +1,41 @@
+package program
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/checkpoint"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLoadLastEventIds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	store := checkpoint.NewFileStore(path, 0)
+
+	// 没有结束位置文件时为首次启动
+	lastEventIds, err := loadLastEventIds(store)
+	if err != nil || len(lastEventIds) != 0 {
+		t.Fatalf("missing file: %v %v", lastEventIds, err)
+	}
+
+	// 文件损坏时返回错误，不能当作没有结束位置
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadLastEventIds(store); err == nil {
+		t.Fatal("corrupt file loaded without error")
+	}
+
+	token := operationTimeCheckpoint(primitive.Timestamp{T: 1700000000, I: 1})
+	if err := store.Save(map[string]*checkpoint.Checkpoint{"goods": checkpoint.New("goods", token)}); err != nil {
+		t.Fatal(err)
+	}
+	lastEventIds, err = loadLastEventIds(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(lastEventIds["goods"]) != string(token) {
+		t.Errorf("token = %v, want %v", lastEventIds["goods"], token)
+	}
+}
@@ -0,0 +1,160 @@
+package program
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/checkpoint"
+	"github.com/shiguanghuxian/mongodb-sync/internal/common"
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/mongodb"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* 从指定时间点开始订阅，以及将已有结束位置回退到指定时间点 */
+
+// 时间已被oplog覆盖，无法重试
+var errOplogWindowExceeded = errors.New("无法从此时间订阅")
+
+// 检查时间是否还在源mongo oplog范围内，超出范围时返回errOplogWindowExceeded
+// 无法获取oplog范围时返回读取错误，由调用方重试
+func checkOplogWindow(ts primitive.Timestamp) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	oldest, err := mongodb.OldestOplogTime(ctx)
+	if err != nil {
+		return fmt.Errorf("获取源mongo oplog范围错误: %w", err)
+	}
+	if ts.T < oldest.T || (ts.T == oldest.T && ts.I < oldest.I) {
+		return fmt.Errorf("指定时间 %s 早于源mongo oplog最早时间 %s，%w",
+			time.Unix(int64(ts.T), 0).Format(time.RFC3339), time.Unix(int64(oldest.T), 0).Format(time.RFC3339), errOplogWindowExceeded)
+	}
+	return nil
+}
+
+// 按key查找sync配置，不存在时返回可用的配置
+func findSyncConfig(cfg *config.Config, key string) (*config.SyncConfig, error) {
+	keys := make([]string, 0, len(cfg.Sync))
+	for _, v := range cfg.Sync {
+		keys = append(keys, v.GetKey())
+		if v.GetKey() == key {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("sync配置不存在: %s\n可用的配置:\n%s", key, strings.Join(keys, "\n"))
+}
+
+// 读取全部结束位置，存储中没有结束位置时返回空map
+func loadCheckpoints(store checkpoint.Store) (map[string]*checkpoint.Checkpoint, error) {
+	checkpoints, err := store.Load()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if checkpoints == nil {
+		checkpoints = make(map[string]*checkpoint.Checkpoint)
+	}
+	return checkpoints, nil
+}
+
+// Rewind 将一个sync配置的结束位置设置为指定时间，下次启动时从此时间开始订阅
+// 逐个订阅collection时每个collection的结束位置都回退，不影响其它sync配置
+// 需要在程序停止时执行，否则会被运行中的程序覆盖
+func Rewind(cfg *config.Config, key, at string) error {
+	logger.NewLogger(cfg.Debug)
+	defer logger.DestroyLogger()
+	_, err := findSyncConfig(cfg, key)
+	if err != nil {
+		return err
+	}
+	ts, err := common.ParseOperationTime(at)
+	if err != nil {
+		return err
+	}
+
+	err = mongodb.InitSourceClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer mongodb.DisconnectSourceClient()
+	err = checkOplogWindow(ts)
+	if err != nil {
+		return err
+	}
+
+	store, err := checkpoint.NewStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	checkpoints, err := loadCheckpoints(store)
+	if err != nil {
+		return err
+	}
+	rewound := map[string]*checkpoint.Checkpoint{
+		key: checkpoint.New(key, operationTimeCheckpoint(ts)),
+	}
+	for k := range checkpoints {
+		if isCheckpointKeyOf(k, key) {
+			rewound[k] = checkpoint.New(k, operationTimeCheckpoint(ts))
+		}
+	}
+	for k, v := range rewound {
+		checkpoints[k] = v
+	}
+	err = store.Save(checkpoints)
+	if err != nil {
+		return err
+	}
+	logger.GlobalLogger.Infow("结束位置已回退", "key", key, "at", at, "operation_time", ts, "checkpoints", len(rewound))
+	return nil
+}
+
+// Backfill 删除一个sync配置的全部结束位置并标记为需要全量同步
+// 下次启动时此sync配置从当前位置重新订阅并全量同步已有数据，即使未配置snapshot，其它sync配置从各自结束位置继续
+// 需要在程序停止时执行，否则会被运行中的程序覆盖
+func Backfill(cfg *config.Config, key string) error {
+	logger.NewLogger(cfg.Debug)
+	defer logger.DestroyLogger()
+	_, err := findSyncConfig(cfg, key)
+	if err != nil {
+		return err
+	}
+
+	store, err := checkpoint.NewStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	checkpoints, err := loadCheckpoints(store)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0)
+	for k := range checkpoints {
+		if isCheckpointKeyOf(k, key) {
+			keys = append(keys, k)
+		}
+	}
+	err = store.Delete(keys)
+	if err != nil {
+		return err
+	}
+
+	// 未完成的全量同步进度一起丢弃，重新开始
+	js, err := json.Marshal(newSnapshotProgress())
+	if err != nil {
+		return err
+	}
+	err = store.SaveSnapshotProgress(map[string][]byte{key: js})
+	if err != nil {
+		return err
+	}
+	logger.GlobalLogger.Infow("已标记为重新全量同步", "key", key, "checkpoints", keys)
+	return nil
+}
@@ -0,0 +1,432 @@
+package program
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/checkpoint"
+	"github.com/shiguanghuxian/mongodb-sync/internal/config"
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+	"github.com/shiguanghuxian/mongodb-sync/internal/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* 全量同步已有数据，复制的每条文档作为一次replace事件交给消费者 */
+
+const (
+	SnapshotBatchSize        = 1000             // 全量同步每批读取文档数
+	SnapshotSampleRate       = 10               // 拆分区间时每个区间采样的_id数
+	SnapshotReportInterval   = 30 * time.Second // 输出全量同步进度间隔
+	DefaultSnapshotWorkers   = 4                // 默认并发复制区间数
+	DefaultSnapshotChunkSize = 100000           // 默认每个区间文档数
+)
+
+// 可以按区间拆分的_id类型，值为$type查询使用的别名
+var snapshotRangeTypes = map[bsontype.Type]string{
+	bsontype.ObjectID:   "objectId",
+	bsontype.String:     "string",
+	bsontype.DateTime:   "date",
+	bsontype.Int32:      "number",
+	bsontype.Int64:      "number",
+	bsontype.Double:     "number",
+	bsontype.Decimal128: "number",
+}
+
+// 一个sync配置的全量同步进度
+type snapshotProgress struct {
+	ResumeTokens map[string][]byte              `json:"resume_tokens"` // 全量同步开始前打开订阅的位置，下标为订阅的collection，订阅整个db时为空字符串
+	Collections  map[string]*collectionProgress `json:"collections"`   // 下标为来源collection
+}
+
+// 一个collection的全量同步进度
+type collectionProgress struct {
+	Total  int64            `json:"total"` // 开始时估算的文档数
+	Chunks []*snapshotChunk `json:"chunks"`
+}
+
+// 按_id拆分的一个复制区间
+type snapshotChunk struct {
+	Min         []byte `json:"min,omitempty"`          // 区间下限(包含)，bson文档{_id: 值}，为空表示无下限
+	Max         []byte `json:"max,omitempty"`          // 区间上限(不包含)，bson文档{_id: 值}，为空表示无上限
+	ExcludeType string `json:"exclude_type,omitempty"` // 不为空时区间为_id不是此类型的全部文档
+	Done        bool   `json:"done"`                   // 是否复制完成
+	Count       int64  `json:"count"`                  // 已复制文档数
+}
+
+// 创建全量同步进度
+func newSnapshotProgress() *snapshotProgress {
+	return &snapshotProgress{
+		ResumeTokens: make(map[string][]byte),
+		Collections:  make(map[string]*collectionProgress),
+	}
+}
+
+// 记录复制开始前的订阅位置，已记录的位置不变
+// 3.6、4.0的订阅在收到第一个事件前没有resume token，记录订阅打开前的集群时间
+func (sp *snapshotProgress) addResumeTokens(watchCollections []string, cursors []*mongo.ChangeStream, operationTime primitive.Timestamp) {
+	if sp.ResumeTokens == nil {
+		sp.ResumeTokens = make(map[string][]byte)
+	}
+	if sp.Collections == nil {
+		sp.Collections = make(map[string]*collectionProgress)
+	}
+	for i, cursor := range cursors {
+		if len(sp.ResumeTokens[watchCollections[i]]) > 0 {
+			continue
+		}
+		if resumeToken := cursor.ResumeToken(); len(resumeToken) > 0 {
+			sp.ResumeTokens[watchCollections[i]] = resumeToken
+		} else if !operationTime.IsZero() {
+			sp.ResumeTokens[watchCollections[i]] = operationTimeCheckpoint(operationTime)
+		}
+	}
+}
+
+// 区间查询条件
+func (c *snapshotChunk) filter() bson.M {
+	if c.ExcludeType != "" {
+		return bson.M{"_id": bson.M{"$not": bson.M{"$type": c.ExcludeType}}}
+	}
+	cond := bson.M{}
+	if len(c.Min) > 0 {
+		cond["$gte"] = bson.Raw(c.Min).Lookup("_id")
+	}
+	if len(c.Max) > 0 {
+		cond["$lt"] = bson.Raw(c.Max).Lookup("_id")
+	}
+	if len(cond) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"_id": cond}
+}
+
+// 全量同步一个sync配置下所有collection的已有数据
+func (p *Program) snapshot(syncCfg *config.SyncConfig, progress *snapshotProgress, dispatcher *eventDispatcher) error {
+	logger.GlobalLogger.Infow("开始全量同步已有数据", "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb)
+	log.Println("开始全量同步已有数据", syncCfg.SourceDb)
+	for sourceCollection, _ := range syncCfg.Collections {
+		err := p.snapshotCollection(syncCfg, progress, sourceCollection, dispatcher)
+		if err != nil {
+			return err
+		}
+	}
+	logger.GlobalLogger.Infow("全量同步已有数据完成", "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb)
+	return nil
+}
+
+// 全量同步一个collection，按_id区间并发复制
+func (p *Program) snapshotCollection(syncCfg *config.SyncConfig, progress *snapshotProgress, sourceCollection string, dispatcher *eventDispatcher) error {
+	coll := mongodb.SourceClient.Database(syncCfg.SourceDb).Collection(sourceCollection)
+	// 首次复制时拆分区间，中断后继续时使用已保存的区间
+	p.snapshotMutex.Lock()
+	collProgress := progress.Collections[sourceCollection]
+	p.snapshotMutex.Unlock()
+	if collProgress == nil {
+		chunkSize := syncCfg.SnapshotChunkSize
+		if chunkSize <= 0 {
+			chunkSize = DefaultSnapshotChunkSize
+		}
+		var err error
+		collProgress, err = splitSnapshotChunks(coll, chunkSize)
+		if err != nil {
+			logger.GlobalLogger.Errorw("全量同步拆分区间错误", "err", err, "source_db", syncCfg.SourceDb, "source_collection", sourceCollection)
+			return err
+		}
+		p.snapshotMutex.Lock()
+		progress.Collections[sourceCollection] = collProgress
+		p.snapshotMutex.Unlock()
+		p.saveSnapshotProgress()
+	}
+
+	// 待复制区间和已复制文档数
+	var copied int64
+	chunkChan := make(chan *snapshotChunk, len(collProgress.Chunks))
+	p.snapshotMutex.Lock()
+	for _, chunk := range collProgress.Chunks {
+		if chunk.Done {
+			copied += chunk.Count
+			continue
+		}
+		chunk.Count = 0
+		chunkChan <- chunk
+	}
+	p.snapshotMutex.Unlock()
+	close(chunkChan)
+	logger.GlobalLogger.Infow("开始全量同步collection", "source_db", syncCfg.SourceDb, "source_collection", sourceCollection, "total", collProgress.Total, "chunks", len(collProgress.Chunks), "copied", copied)
+
+	// 定时输出进度
+	reportDone := make(chan struct{})
+	defer close(reportDone)
+	go reportSnapshotProgress(syncCfg, sourceCollection, collProgress.Total, &copied, reportDone)
+
+	workers := syncCfg.SnapshotWorkers
+	if workers <= 0 {
+		workers = DefaultSnapshotWorkers
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunkChan {
+				err := p.copySnapshotChunk(ctx, syncCfg, coll, chunk, &copied, dispatcher)
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+				p.saveSnapshotProgress()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	logger.GlobalLogger.Infow("全量同步collection完成", "source_db", syncCfg.SourceDb, "source_collection", sourceCollection, "count", atomic.LoadInt64(&copied))
+	return nil
+}
+
+// 复制一个区间
+func (p *Program) copySnapshotChunk(ctx context.Context, syncCfg *config.SyncConfig, coll *mongo.Collection, chunk *snapshotChunk, copied *int64, dispatcher *eventDispatcher) error {
+	findOptions := options.Find().SetBatchSize(SnapshotBatchSize).SetNoCursorTimeout(true)
+	cursor, err := coll.Find(ctx, chunk.filter(), findOptions)
+	if err != nil {
+		logger.GlobalLogger.Errorw("全量同步查询collection错误", "err", err, "source_db", syncCfg.SourceDb, "source_collection", coll.Name())
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var lastSeq uint64
+	for cursor.Next(ctx) {
+		if p.stop {
+			return errors.New("程序结束，全量同步中断")
+		}
+		document := bson.M{}
+		if err := cursor.Decode(&document); err != nil {
+			logger.GlobalLogger.Errorw("全量同步解析文档错误", "err", err, "source_db", syncCfg.SourceDb, "source_collection", coll.Name())
+			continue
+		}
+		documentKey, err := models.NewDocumentKey(bson.D{{Key: "_id", Value: document["_id"]}})
+		if err != nil {
+			logger.GlobalLogger.Warnw("全量同步忽略文档唯一标识错误的文档", "err", err, "source_db", syncCfg.SourceDb, "source_collection", coll.Name(), "_id", document["_id"])
+			continue
+		}
+		changeEvent := &models.ChangeEvent{
+			Operation: "replace",
+			Document:  document,
+		}
+		changeEvent.Namespace.Db = syncCfg.SourceDb
+		changeEvent.Namespace.Coll = coll.Name()
+		changeEvent.DocumentKey = documentKey
+		lastSeq, err = dispatcher.dispatch("", []*models.ChangeEvent{changeEvent}, nil)
+		if err != nil {
+			return err
+		}
+
+		p.snapshotMutex.Lock()
+		chunk.Count++
+		p.snapshotMutex.Unlock()
+		atomic.AddInt64(copied, 1)
+	}
+	if err := cursor.Err(); err != nil {
+		logger.GlobalLogger.Errorw("全量同步读取collection错误", "err", err, "source_db", syncCfg.SourceDb, "source_collection", coll.Name())
+		return err
+	}
+	// 区间内的文档全部写入目标后才标记完成
+	if err := dispatcher.waitFor(lastSeq); err != nil {
+		return err
+	}
+	p.snapshotMutex.Lock()
+	chunk.Done = true
+	p.snapshotMutex.Unlock()
+	return nil
+}
+
+// 按_id采样拆分复制区间
+// _id类型不一致或文档数较少时不拆分，整个collection作为一个区间
+func splitSnapshotChunks(coll *mongo.Collection, chunkSize int64) (*collectionProgress, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	total, err := coll.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collProgress := &collectionProgress{
+		Total:  total,
+		Chunks: []*snapshotChunk{{}},
+	}
+	chunkNum := total / chunkSize
+	if chunkNum <= 1 {
+		return collProgress, nil
+	}
+
+	// 随机采样_id并排序
+	pipeline := mongo.Pipeline{
+		{{Key: "$sample", Value: bson.M{"size": chunkNum * SnapshotSampleRate}}},
+		{{Key: "$project", Value: bson.M{"_id": 1}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	samples := make([]bson.RawValue, 0, chunkNum*SnapshotSampleRate)
+	for cursor.Next(ctx) {
+		id := cursor.Current.Lookup("_id")
+		samples = append(samples, bson.RawValue{Type: id.Type, Value: append([]byte(nil), id.Value...)})
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return collProgress, nil
+	}
+	typeAlias, ok := snapshotRangeTypes[samples[0].Type]
+	if !ok {
+		return collProgress, nil
+	}
+	for _, v := range samples {
+		if snapshotRangeTypes[v.Type] != typeAlias {
+			return collProgress, nil
+		}
+	}
+
+	// 每SnapshotSampleRate个采样取一个边界
+	boundaries := make([][]byte, 0, chunkNum)
+	for i := SnapshotSampleRate; i < len(samples); i += SnapshotSampleRate {
+		boundary, err := bson.Marshal(bson.D{{Key: "_id", Value: samples[i]}})
+		if err != nil {
+			return nil, err
+		}
+		if len(boundaries) > 0 && bytes.Equal(boundaries[len(boundaries)-1], boundary) {
+			continue
+		}
+		boundaries = append(boundaries, boundary)
+	}
+	chunks := make([]*snapshotChunk, 0, len(boundaries)+2)
+	var min []byte
+	for _, boundary := range boundaries {
+		chunks = append(chunks, &snapshotChunk{Min: min, Max: boundary})
+		min = boundary
+	}
+	chunks = append(chunks, &snapshotChunk{Min: min})
+	// 区间查询只匹配同类型_id，其它类型单独作为一个区间
+	chunks = append(chunks, &snapshotChunk{ExcludeType: typeAlias})
+	collProgress.Chunks = chunks
+	return collProgress, nil
+}
+
+// 定时输出一个collection的全量同步进度和预计剩余时间
+func reportSnapshotProgress(syncCfg *config.SyncConfig, sourceCollection string, total int64, copied *int64, done chan struct{}) {
+	t := time.NewTicker(SnapshotReportInterval)
+	defer t.Stop()
+	start := time.Now()
+	startCopied := atomic.LoadInt64(copied)
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			current := atomic.LoadInt64(copied)
+			var percent float64
+			if total > 0 {
+				percent = float64(current) * 100 / float64(total)
+			}
+			// 按本次启动以来的速度估算剩余时间
+			var eta time.Duration
+			rate := float64(current-startCopied) / time.Since(start).Seconds()
+			if rate > 0 && total > current {
+				eta = time.Duration(float64(total-current)/rate) * time.Second
+			}
+			logger.GlobalLogger.Infow("全量同步进度", "source_db", syncCfg.SourceDb, "source_collection", sourceCollection, "copied", current, "total", total, "percent", percent, "rate", rate, "eta", eta.String())
+			log.Printf("全量同步进度 %s.%s %d/%d %.2f%% 预计剩余 %s\n", syncCfg.SourceDb, sourceCollection, current, total, percent, eta)
+		}
+	}
+}
+
+// 读取一个sync配置未完成的全量同步进度
+func (p *Program) getSnapshotProgress(key string) *snapshotProgress {
+	p.snapshotMutex.Lock()
+	defer p.snapshotMutex.Unlock()
+	return p.snapshotProgress[key]
+}
+
+// 设置一个sync配置的全量同步进度并保存
+func (p *Program) setSnapshotProgress(key string, progress *snapshotProgress) {
+	p.snapshotMutex.Lock()
+	p.snapshotProgress[key] = progress
+	p.snapshotMutex.Unlock()
+	p.saveSnapshotProgress()
+}
+
+// 全量同步完成或失效时删除进度
+func (p *Program) deleteSnapshotProgress(key string) {
+	p.snapshotMutex.Lock()
+	delete(p.snapshotProgress, key)
+	p.snapshotMutex.Unlock()
+	p.saveSnapshotProgress()
+}
+
+// 从结束位置存储读取全量同步进度
+func loadSnapshotProgress(store checkpoint.Store) (map[string]*snapshotProgress, error) {
+	items, err := store.LoadSnapshotProgress()
+	if err != nil {
+		return nil, err
+	}
+	progressMap := make(map[string]*snapshotProgress, len(items))
+	for key, val := range items {
+		progress := newSnapshotProgress()
+		err = json.Unmarshal(val, progress)
+		if err != nil {
+			return nil, fmt.Errorf("解析全量同步进度 %s 错误: %v", key, err)
+		}
+		progressMap[key] = progress
+	}
+	return progressMap, nil
+}
+
+// 保存全量同步进度到结束位置存储
+// 只写入本实例sync配置的进度，没有进度的删除，共用存储的其它实例的进度不变
+func (p *Program) saveSnapshotProgress() {
+	p.snapshotMutex.Lock()
+	defer p.snapshotMutex.Unlock()
+	items := make(map[string][]byte)
+	for _, v := range p.cfg.Sync {
+		for _, key := range []string{v.GetKey(), v.DefaultKey()} {
+			items[key] = nil
+			if progress := p.snapshotProgress[key]; progress != nil {
+				js, err := json.Marshal(progress)
+				if err != nil {
+					logger.GlobalLogger.Errorw("全量同步进度转json错误", "err", err, "key", key)
+					delete(items, key)
+					continue
+				}
+				items[key] = js
+			}
+		}
+	}
+	err := p.checkpointStore.SaveSnapshotProgress(items)
+	if err != nil {
+		logger.GlobalLogger.Errorw("保存全量同步进度错误", "err", err)
+	}
+}
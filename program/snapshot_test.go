@@ -0,0 +1,40 @@
+package program
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSnapshotChunkFilter(t *testing.T) {
+	bound := func(id interface{}) []byte {
+		body, err := bson.Marshal(bson.M{"_id": id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	value := func(id interface{}) bson.RawValue {
+		return bson.Raw(bound(id)).Lookup("_id")
+	}
+	tests := []struct {
+		name  string
+		chunk *snapshotChunk
+		want  bson.M
+	}{
+		{"all", &snapshotChunk{}, bson.M{}},
+		{"min", &snapshotChunk{Min: bound(int32(10))}, bson.M{"_id": bson.M{"$gte": value(int32(10))}}},
+		{"max", &snapshotChunk{Max: bound("m")}, bson.M{"_id": bson.M{"$lt": value("m")}}},
+		{"range", &snapshotChunk{Min: bound(int32(10)), Max: bound(int32(20))},
+			bson.M{"_id": bson.M{"$gte": value(int32(10)), "$lt": value(int32(20))}}},
+		// 其它类型的_id单独复制，忽略区间
+		{"exclude type", &snapshotChunk{Min: bound(int32(10)), ExcludeType: "objectId"},
+			bson.M{"_id": bson.M{"$not": bson.M{"$type": "objectId"}}}},
+	}
+	for _, tt := range tests {
+		if got := tt.chunk.filter(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
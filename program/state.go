@@ -0,0 +1,88 @@
+package program
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/* 订阅运行状态，订阅中断时自动重新订阅，无法继续时标记为失败 */
+
+const (
+	WatchStateRunning      = "running"      // 正常订阅
+	WatchStateReconnecting = "reconnecting" // 订阅中断，正在重新订阅
+	WatchStateFailed       = "failed"       // 无法继续订阅，需要人工处理
+
+	WatchRetryMinInterval = time.Second // 重新订阅最小间隔
+	WatchRetryMaxInterval = time.Minute // 重新订阅最大间隔
+)
+
+// 无法从最后位置继续订阅的错误码
+var fatalWatchErrorCodes = map[int32]bool{
+	136: true, // CappedPositionLost
+	260: true, // InvalidResumeToken
+	280: true, // ChangeStreamFatalError
+	286: true, // ChangeStreamHistoryLost
+}
+
+// WatchState 一个订阅的运行状态
+type WatchState struct {
+	State     string    `json:"state"`
+	Err       string    `json:"err,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 设置订阅状态，sourceCollection为空表示订阅整个db
+func (p *Program) setWatchState(key, sourceCollection, state string, err error) {
+	watchState := &WatchState{
+		State:     state,
+		UpdatedAt: time.Now(),
+	}
+	if err != nil {
+		watchState.Err = err.Error()
+	}
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.watchStates[watchStateKey(key, sourceCollection)] = watchState
+}
+
+// GetWatchStates 获取全部订阅状态，下标为sync配置key和订阅collection
+func (p *Program) GetWatchStates() map[string]*WatchState {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	watchStates := make(map[string]*WatchState, len(p.watchStates))
+	for k, v := range p.watchStates {
+		watchStates[k] = v
+	}
+	return watchStates
+}
+
+// 输出失败的订阅，提醒人工处理
+func (p *Program) logFailedWatchStates() {
+	for k, v := range p.GetWatchStates() {
+		if v.State != WatchStateFailed {
+			continue
+		}
+		logger.GlobalLogger.Errorw("订阅已失败，同步已停止，需要人工处理", "key", k, "err", v.Err, "updated_at", v.UpdatedAt)
+		log.Println("订阅已失败，同步已停止，需要人工处理", k, v.Err)
+	}
+}
+
+func watchStateKey(key, sourceCollection string) string {
+	if sourceCollection == "" {
+		return key
+	}
+	return key + "/" + sourceCollection
+}
+
+// 是否为无法从最后位置继续订阅的错误
+func isFatalWatchError(err error) bool {
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	return fatalWatchErrorCodes[cmdErr.Code] || cmdErr.HasErrorLabel("NonResumableChangeStreamError")
+}
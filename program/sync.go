@@ -3,15 +3,17 @@ package program
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"time"
 
+	"github.com/shiguanghuxian/mongodb-sync/internal/common"
 	"github.com/shiguanghuxian/mongodb-sync/internal/config"
 	"github.com/shiguanghuxian/mongodb-sync/internal/logger"
 	"github.com/shiguanghuxian/mongodb-sync/internal/models"
 	"github.com/shiguanghuxian/mongodb-sync/internal/mongodb"
-	"github.com/shiguanghuxian/mongodb-sync/program/consumers"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/x/bsonx"
@@ -19,22 +21,32 @@ import (
 
 // 同步源mongo数据到目标mongo
 func (p *Program) sync() {
-	p.collectionChan = make(map[string]chan *models.ChangeEvent)
-	// 对每一个collection初始化一个chan
+	p.dispatchers = make(map[string]*eventDispatcher)
+	// 对每一个sync配置初始化分区消费
 	for _, v := range p.cfg.Sync {
 		v := v
+		// 未启用的配置没有消费者，不订阅
+		if !v.Enable {
+			continue
+		}
 		key := v.GetKey()
-		// 一个db一个chan
-		if p.collectionChan[key] != nil {
+		// 一个db一个分发
+		if p.dispatchers[key] != nil {
+			continue
+		}
+		consumer := p.consumers[key]
+		if consumer == nil {
+			logger.GlobalLogger.Errorw("目标db消费者未初始化，不订阅", "key", key)
 			continue
 		}
-		documentChan := make(chan *models.ChangeEvent, 1)
-		go p.consumer(key, documentChan)
-		// 保存
-		p.collectionChan[key] = documentChan
+		p.dispatchers[key] = newEventDispatcher(p.ctx, v, consumer, p.SetLastEventIds, p.deadLetterStore, p.cfg.DeadLetter.GetMaxAttempts())
 
 		// 处理每一个db的数据订阅
-		p.producerDbWatch(v)
+		if p.cfg.Mongo.GetSourceMode() == config.SourceModeOplog {
+			p.producerOplog(v)
+		} else {
+			p.producerDbWatch(v)
+		}
 	}
 }
 
@@ -46,94 +58,378 @@ func (p *Program) producerDbWatch(syncCfg *config.SyncConfig) {
 	logger.GlobalLogger.Infow("处理一个db的数据订阅", "cfg", syncCfg)
 	log.Println("处理一个db的数据订阅", syncCfg)
 	key := syncCfg.GetKey()
-	documentChan := p.collectionChan[key]
-	if documentChan == nil {
-		logger.GlobalLogger.Errorw("出现了nil的chan", "key", key)
+	dispatcher := p.dispatchers[key]
+	if dispatcher == nil {
+		logger.GlobalLogger.Errorw("出现了nil的分发", "key", key)
 		return
 	}
+	if err := p.startDbWatch(syncCfg, dispatcher); err != nil {
+		go p.restartDbWatch(syncCfg, dispatcher, err)
+	}
+}
+
+// 打开订阅失败或全量同步失败后按指数退避重新开始，无法从最后位置继续时标记为失败状态
+func (p *Program) restartDbWatch(syncCfg *config.SyncConfig, dispatcher *eventDispatcher, err error) {
+	p.restartWatch(syncCfg, err, func() error {
+		return p.startDbWatch(syncCfg, dispatcher)
+	})
+}
+
+// 按指数退避重新执行start直到成功，订阅和读取oplog共用
+func (p *Program) restartWatch(syncCfg *config.SyncConfig, err error, start func() error) {
+	key := syncCfg.GetKey()
+	retryInterval := WatchRetryMinInterval
+	for err != nil {
+		if p.stop {
+			return
+		}
+		if isFatalWatchError(err) {
+			p.setWatchState(key, "", WatchStateFailed, err)
+			logger.GlobalLogger.Errorw("无法从最后位置继续订阅，同步已停止，需要人工处理", "err", err, "source_db", syncCfg.SourceDb, "cfg", syncCfg)
+			log.Println("无法从最后位置继续订阅，同步已停止，需要人工处理", syncCfg.SourceDb, err)
+			return
+		}
+		p.setWatchState(key, "", WatchStateReconnecting, err)
+		logger.GlobalLogger.Warnw("订阅db失败，准备重新订阅", "err", err, "source_db", syncCfg.SourceDb, "retry_interval", retryInterval.String())
+		log.Println("订阅db失败，准备重新订阅", syncCfg.SourceDb, err)
+		time.Sleep(retryInterval)
+		if p.stop {
+			return
+		}
+		retryInterval *= 2
+		if retryInterval > WatchRetryMaxInterval {
+			retryInterval = WatchRetryMaxInterval
+		}
+		err = start()
+	}
+}
+
+// 打开一个db的订阅，需要时先全量同步，返回错误时由restartDbWatch重新开始
+// 全量同步在后台执行，失败时同样重新开始
+func (p *Program) startDbWatch(syncCfg *config.SyncConfig, dispatcher *eventDispatcher) error {
+	key := syncCfg.GetKey()
+	// 4.0及以上订阅整个db，否则逐个订阅collection
+	watchCollections := []string{""}
+	if p.cfg.Mongo.SourceVersion < 4.0 {
+		watchCollections = make([]string, 0, len(syncCfg.Collections))
+		for sourceCollection, _ := range syncCfg.Collections {
+			watchCollections = append(watchCollections, sourceCollection)
+		}
+	}
+	// 每个订阅的上次结束位置，没有结束位置时需要先全量同步已有数据，有未完成的全量同步时从其订阅位置继续
+	lastEventIds, hasLastEventId := p.watchLastEventIds(key, watchCollections)
+	// 配置了开始时间时从此时间订阅，不做全量同步
+	if !hasLastEventId && syncCfg.StartAt != "" {
+		ts, _ := common.ParseOperationTime(syncCfg.StartAt)
+		if err := checkOplogWindow(ts); errors.Is(err, errOplogWindowExceeded) {
+			p.setWatchState(key, "", WatchStateFailed, err)
+			logger.GlobalLogger.Errorw("无法从配置的开始时间订阅", "err", err, "start_at", syncCfg.StartAt, "cfg", syncCfg)
+			log.Println("无法从配置的开始时间订阅", syncCfg.SourceDb, err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		hasLastEventId = true
+		for _, sourceCollection := range watchCollections {
+			lastEventIds[sourceCollection] = operationTimeCheckpoint(ts)
+			p.SetLastEventIds(checkpointKey(key, sourceCollection), lastEventIds[sourceCollection])
+		}
+	}
+	// 配置了全量同步或执行了backfill命令时需要全量同步
+	var progress *snapshotProgress
+	if !hasLastEventId {
+		progress = p.getSnapshotProgress(key)
+	}
+	needSnapshot := !hasLastEventId && (syncCfg.Snapshot || progress != nil)
+
+	// 订阅超时
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 全量同步时在订阅打开前记录集群时间，订阅没有返回位置时从此时间继续，不丢失复制期间的变更
+	var operationTime primitive.Timestamp
+	if needSnapshot {
+		var err error
+		operationTime, err = mongodb.OperationTime(ctx)
+		if err != nil {
+			logger.GlobalLogger.Errorw("获取源mongo集群时间错误", "err", err, "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb)
+			return err
+		}
+	}
+	cursors := make([]*mongo.ChangeStream, 0, len(watchCollections))
+	for _, sourceCollection := range watchCollections {
+		resumeToken := lastEventIds[sourceCollection]
+		if progress != nil {
+			resumeToken = progress.ResumeTokens[sourceCollection]
+		}
+		cursor, err := p.watch(ctx, syncCfg, sourceCollection, resumeToken)
+		if err != nil {
+			logger.GlobalLogger.Errorw("订阅db错误", "err", err, "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb, "source_collection", sourceCollection)
+			for _, cursor := range cursors {
+				cursor.Close(context.Background())
+			}
+			// 未完成的全量同步订阅位置已失效，只能重新全量同步
+			if progress != nil && len(progress.ResumeTokens) > 0 {
+				logger.GlobalLogger.Warnw("未完成的全量同步无法从原订阅位置继续，重新全量同步", "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb)
+				p.setSnapshotProgress(key, newSnapshotProgress())
+				return p.startDbWatch(syncCfg, dispatcher)
+			}
+			return err
+		}
+		cursors = append(cursors, cursor)
+	}
+
+	if !needSnapshot {
+		for i, cursor := range cursors {
+			go p.producer(cursor, syncCfg, watchCollections[i], dispatcher)
+		}
+		return nil
+	}
+	// 订阅在复制前已经打开，复制完成后从订阅打开位置继续处理，保证不丢失复制期间的变更
+	if progress == nil {
+		progress = newSnapshotProgress()
+	}
+	progress.addResumeTokens(watchCollections, cursors, operationTime)
+	p.setSnapshotProgress(key, progress)
+	go func() {
+		err := p.snapshot(syncCfg, progress, dispatcher)
+		if err != nil {
+			logger.GlobalLogger.Errorw("全量同步已有数据错误", "err", err, "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb)
+			for _, cursor := range cursors {
+				cursor.Close(context.Background())
+			}
+			// 从全量同步进度继续
+			p.restartDbWatch(syncCfg, dispatcher, err)
+			return
+		}
+		for i, cursor := range cursors {
+			// 记录订阅打开时的位置，防止全量同步完成后未收到变更就退出导致重复全量同步
+			// 订阅没有位置时使用复制前记录的集群时间，订阅中断后从此时间重新订阅
+			resumeToken := []byte(cursor.ResumeToken())
+			if len(resumeToken) == 0 {
+				resumeToken = progress.ResumeTokens[watchCollections[i]]
+			}
+			if len(resumeToken) > 0 {
+				if err := dispatcher.checkpoint(checkpointKey(key, watchCollections[i]), resumeToken); err != nil {
+					for _, cursor := range cursors {
+						cursor.Close(context.Background())
+					}
+					return
+				}
+			}
+			go p.producer(cursor, syncCfg, watchCollections[i], dispatcher)
+		}
+		p.deleteSnapshotProgress(key)
+	}()
+	return nil
+}
+
+// 读取每个订阅的上次结束位置，下标为订阅的collection，有任一结束位置时返回true
+// 逐个订阅collection时兼容旧版本按sync配置key记录的结束位置，将其复制到没有结束位置的collection
+func (p *Program) watchLastEventIds(key string, watchCollections []string) (map[string][]byte, bool) {
+	lastEventIds := make(map[string][]byte, len(watchCollections))
+	for _, sourceCollection := range watchCollections {
+		if lastEventId, ok := p.GetLastEventIds(checkpointKey(key, sourceCollection)); ok {
+			lastEventIds[sourceCollection] = lastEventId
+		}
+	}
+	if len(watchCollections) == 1 && watchCollections[0] == "" {
+		return lastEventIds, len(lastEventIds) > 0
+	}
+	if lastEventId, ok := p.GetLastEventIds(key); ok {
+		for _, sourceCollection := range watchCollections {
+			if _, ok := lastEventIds[sourceCollection]; !ok {
+				lastEventIds[sourceCollection] = lastEventId
+				p.SetLastEventIds(checkpointKey(key, sourceCollection), lastEventId)
+			}
+		}
+		p.deleteLastEventIds(key)
+		logger.GlobalLogger.Infow("旧版本结束位置已按collection拆分", "key", key, "collections", watchCollections)
+	}
+	return lastEventIds, len(lastEventIds) > 0
+}
+
+// 打开一个订阅，sourceCollection为空时订阅整个db
+func (p *Program) watch(ctx context.Context, syncCfg *config.SyncConfig, sourceCollection string, resumeToken []byte) (*mongo.ChangeStream, error) {
 	// 订阅配置
 	configOptions := new(options.ChangeStreamOptions)
-	configOptions.SetFullDocument("updateLookup")
+	configOptions.SetFullDocument(options.FullDocument(syncCfg.GetFullDocument()))
+	if before := syncCfg.GetFullDocumentBeforeChange(); before != config.FullDocumentOff {
+		configOptions.SetFullDocumentBeforeChange(options.FullDocument(before))
+	}
 	// 从上次结束位置开始订阅
-	if rtStr, ok := p.GetLastEventIds(syncCfg.GetKey()); ok && len(rtStr) > 0 {
+	if ts, ok := parseOperationTimeCheckpoint(resumeToken); ok {
+		configOptions.SetStartAtOperationTime(&ts)
+	} else if startAfter, ok := parseStartAfterCheckpoint(resumeToken); ok {
+		configOptions.SetStartAfter(startAfter)
+	} else if len(resumeToken) > 0 {
 		rt := &bsonx.Doc{}
-		err := bson.Unmarshal(rtStr, rt)
+		err := bson.Unmarshal(resumeToken, rt)
 		if err != nil {
-			logger.GlobalLogger.Errorw("解析上次结束位置错误", "err", err, "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb, "rtStr", rtStr)
+			logger.GlobalLogger.Errorw("解析上次结束位置错误", "err", err, "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb, "rtStr", resumeToken)
 		} else {
 			configOptions.SetResumeAfter(rt)
 		}
 	}
+	// 服务端过滤
+	pipeline, err := syncCfg.Filter.Pipeline()
+	if err != nil {
+		return nil, err
+	}
+	db := mongodb.SourceClient.Database(syncCfg.SourceDb)
+	if sourceCollection == "" {
+		return db.Watch(ctx, pipeline, configOptions)
+	}
+	return db.Collection(sourceCollection).Watch(ctx, pipeline, configOptions)
+}
 
-	// 订阅超时
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if p.cfg.Mongo.SourceVersion >= 4.0 {
-		cursor, err := mongodb.SourceClient.Database(syncCfg.SourceDb).Watch(ctx, bson.A{}, configOptions)
-		if err != nil {
-			logger.GlobalLogger.Errorw("订阅db错误", "err", err, "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb)
+// 从源读取数据，订阅中断后从最后位置重新订阅
+// 无法从最后位置继续时(例如oplog已被覆盖)，标记为失败状态，需要人工处理
+func (p *Program) producer(cursor *mongo.ChangeStream, syncCfg *config.SyncConfig, sourceCollection string, dispatcher *eventDispatcher) {
+	key := syncCfg.GetKey()
+	cpKey := checkpointKey(key, sourceCollection)
+	p.setWatchState(key, sourceCollection, WatchStateRunning, nil)
+	retryInterval := WatchRetryMinInterval
+	for {
+		count, invalidate := p.readStream(cursor, syncCfg, cpKey, dispatcher)
+		// 优先使用驱动缓存的位置，包含没有事件时服务端返回的位置
+		resumeToken := []byte(cursor.ResumeToken())
+		if len(resumeToken) == 0 {
+			resumeToken, _ = p.GetLastEventIds(cpKey)
+		}
+		err := cursor.Err()
+		cursor.Close(context.Background())
+		if p.stop {
 			return
 		}
-		go p.producer(cursor, syncCfg, documentChan)
-	} else {
-		for sourceCollection, _ := range syncCfg.Collections {
-			cursor, err := mongodb.SourceClient.Database(syncCfg.SourceDb).Collection(sourceCollection).Watch(ctx, bson.A{}, configOptions)
-			if err != nil {
-				logger.GlobalLogger.Errorw("订阅db错误", "err", err, "source_db", syncCfg.SourceDb, "destination_db", syncCfg.DestinationDb, "source_collection", sourceCollection)
+		if count > 0 {
+			retryInterval = WatchRetryMinInterval
+		}
+		if invalidate != nil {
+			// 集合或db删除、重命名后订阅失效，从失效事件之后重新订阅
+			resumeToken = p.invalidateCheckpoint(invalidate)
+			dispatcher.checkpoint(cpKey, resumeToken)
+			retryInterval = 0
+			logger.GlobalLogger.Infow("订阅失效，重新订阅", "source_db", syncCfg.SourceDb, "source_collection", sourceCollection, "namespace", invalidate.Namespace)
+		} else {
+			logger.GlobalLogger.Warnw("订阅中断，准备重新订阅", "err", err, "source_db", syncCfg.SourceDb, "source_collection", sourceCollection, "retry_interval", retryInterval.String())
+			log.Println("订阅中断，准备重新订阅", syncCfg.SourceDb, sourceCollection, err)
+		}
+
+		// 指数退避重新订阅
+		for {
+			if isFatalWatchError(err) {
+				p.setWatchState(key, sourceCollection, WatchStateFailed, err)
+				logger.GlobalLogger.Errorw("无法从最后位置继续订阅，同步已停止，需要人工处理", "err", err, "source_db", syncCfg.SourceDb, "source_collection", sourceCollection, "cfg", syncCfg)
+				log.Println("无法从最后位置继续订阅，同步已停止，需要人工处理", syncCfg.SourceDb, sourceCollection, err)
+				return
+			}
+			p.setWatchState(key, sourceCollection, WatchStateReconnecting, err)
+			time.Sleep(retryInterval)
+			if p.stop {
 				return
 			}
-			go p.producer(cursor, syncCfg, documentChan)
+			retryInterval *= 2
+			if retryInterval < WatchRetryMinInterval {
+				retryInterval = WatchRetryMinInterval
+			}
+			if retryInterval > WatchRetryMaxInterval {
+				retryInterval = WatchRetryMaxInterval
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			cursor, err = p.watch(ctx, syncCfg, sourceCollection, resumeToken)
+			cancel()
+			if err == nil {
+				break
+			}
+			logger.GlobalLogger.Errorw("重新订阅错误", "err", err, "source_db", syncCfg.SourceDb, "source_collection", sourceCollection, "retry_interval", retryInterval.String())
 		}
+		p.setWatchState(key, sourceCollection, WatchStateRunning, nil)
+		logger.GlobalLogger.Infow("重新订阅成功", "source_db", syncCfg.SourceDb, "source_collection", sourceCollection)
 	}
 }
 
-// 从源读取数据
-func (p *Program) producer(cursor *mongo.ChangeStream, syncCfg *config.SyncConfig, documentChan chan *models.ChangeEvent) {
+// 读取订阅直到订阅结束，返回读取的事件数，订阅因invalidate事件结束时返回该事件
+// 同一个源事务的事件连续出现，合并为一组交给消费者，保证在目标一起处理，处理完成后结束位置保存到cpKey
+func (p *Program) readStream(cursor *mongo.ChangeStream, syncCfg *config.SyncConfig, cpKey string, dispatcher *eventDispatcher) (int, *models.ChangeEvent) {
 	// ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	// defer cancel()
 	ctx := context.TODO()
+	count := 0
+	txn := newTransactionGroup(dispatcher, cpKey)
+	defer txn.flush()
+	// 事务组只在事务标识变化、订阅结束或出错时提交，跨getMore批次的事务不会被拆分
 	for cursor.Next(ctx) {
 		log.Println("监听db变化", syncCfg.SourceDb, "id", cursor.ID())
-		if cursor.ID() == 0 {
-			logger.GlobalLogger.Errorw("mongo客户端订阅对象已经关闭", "syncCfg", syncCfg)
-			break
-		}
 		if err := cursor.Err(); err != nil {
 			logger.GlobalLogger.Errorw("订阅mongo数据变化错误", "err", err, "syncCfg", syncCfg)
 			break
 		}
+		count++
 		changeEvent := new(models.ChangeEvent)
 		if err := cursor.Decode(changeEvent); err != nil {
 			logger.GlobalLogger.Errorw("解析mongo订阅事件错误", "err", err, "syncCfg", syncCfg, "_id", cursor.ID())
 			continue
 		}
+		// 失效事件不交给消费者，订阅随后结束
+		if changeEvent.Operation == "invalidate" {
+			return count, changeEvent
+		}
 
-		// 存储本次数据变更到lastEventIds
+		// 本次数据变更的位置，所在事件组处理完成时存储到lastEventIds
 		lastEventIdByte, err := bson.Marshal(changeEvent.ID)
 		if err != nil {
 			logger.GlobalLogger.Errorw("序列号最后变更id错误", "err", err, "syncCfg", syncCfg, "_id", cursor.ID(), "lastEventIdByte", string(lastEventIdByte))
 		}
-		// log.Println("记录最后事件id", string(lastEventIdByte))
-		if len(lastEventIdByte) > 0 {
-			p.SetLastEventIds(syncCfg.GetKey(), lastEventIdByte)
-		}
-
+		txnKey := transactionKey(changeEvent)
+		changeEvent = postImageFallback(syncCfg, changeEvent)
 		// js, _ := json.Marshal(changeEvent)
 		// log.Println("监听db变化", syncCfg.SourceDb, "data", string(js))
-		documentChan <- changeEvent
+		if err := txn.add(txnKey, changeEvent, lastEventIdByte); err != nil {
+			logger.GlobalLogger.Warnw("分发已停止，结束读取订阅", "err", err, "syncCfg", syncCfg)
+			break
+		}
 	}
+	return count, nil
 }
 
-// 消费源数据
-func (p *Program) consumer(key string, documentChan chan *models.ChangeEvent) {
-	if documentChan == nil {
-		return
+// 更新事件没有变更后文档时按配置处理，返回nil表示跳过
+// 例如updateLookup查询时文档已被删除，或full_document为default
+// update_mode为delta时只依赖updateDescription，不需要变更后文档
+func postImageFallback(syncCfg *config.SyncConfig, changeEvent *models.ChangeEvent) *models.ChangeEvent {
+	if changeEvent.Operation != "update" || changeEvent.Document != nil {
+		return changeEvent
 	}
-	for {
-		data := <-documentChan
-		// log.Println("哈哈", data)
-		consumers.HandleData(key, data)
+	if syncCfg.GetUpdateMode() == config.UpdateModeDelta && changeEvent.Updates != nil {
+		return changeEvent
 	}
+	switch syncCfg.GetPostImageMissing() {
+	case config.PostImageMissingDelete:
+		changeEvent.Operation = "delete"
+	case config.PostImageMissingUpdates:
+		changeEvent.Document = bson.M{}
+		if changeEvent.Updates != nil && changeEvent.Updates.UpdatedFields != nil {
+			changeEvent.Document = changeEvent.Updates.UpdatedFields
+		}
+	default:
+		logger.GlobalLogger.Debugw("更新事件没有变更后文档，跳过", "namespace", changeEvent.Namespace, "document_key", changeEvent.DocumentKey)
+		return nil
+	}
+	return changeEvent
+}
+
+// 订阅失效后重新订阅的位置
+// 4.2及以上使用startAfter从失效事件之后继续，否则从失效事件的下一个集群时间继续
+func (p *Program) invalidateCheckpoint(invalidate *models.ChangeEvent) []byte {
+	if p.cfg.Mongo.SourceVersion >= 4.2 {
+		resumeToken, err := bson.Marshal(invalidate.ID)
+		if err == nil {
+			return startAfterCheckpoint(resumeToken)
+		}
+		logger.GlobalLogger.Errorw("序列化失效事件id错误", "err", err, "namespace", invalidate.Namespace)
+	}
+	ts, _ := invalidate.ClusterTime.(primitive.Timestamp)
+	ts.I++
+	return operationTimeCheckpoint(ts)
 }
 
 // GetLastEventIds 读取上次结束位置lastEventId
@@ -149,6 +445,15 @@ func (p *Program) SetLastEventIds(key string, val []byte) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 	p.lastEventIds[key] = val
+	delete(p.deletedEventIds, key)
+}
+
+// 删除结束位置，下次保存时从存储删除
+func (p *Program) deleteLastEventIds(key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.lastEventIds, key)
+	p.deletedEventIds[key] = true
 }
 
 // GetLastEventIdsToJsonBytes 获取json字符
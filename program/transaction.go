@@ -0,0 +1,67 @@
+package program
+
+import (
+	"fmt"
+
+	"github.com/shiguanghuxian/mongodb-sync/internal/models"
+)
+
+/* 源事务事件合并，同一个事务的多条事件作为一组交给消费者 */
+
+// 合并中的事务事件组
+type transactionGroup struct {
+	dispatcher    *eventDispatcher
+	checkpointKey string                // 事件组处理完成后保存结束位置的key
+	txnKey        string                // 当前事务标识，为空表示没有合并中的事务
+	events        []*models.ChangeEvent // 当前事务的事件
+	lastEventId   []byte                // 当前事务最后一条事件的位置
+}
+
+func newTransactionGroup(dispatcher *eventDispatcher, checkpointKey string) *transactionGroup {
+	return &transactionGroup{
+		dispatcher:    dispatcher,
+		checkpointKey: checkpointKey,
+	}
+}
+
+// 事务标识，不在事务中的事件为空
+func transactionKey(changeEvent *models.ChangeEvent) string {
+	if changeEvent.Transaction == 0 || changeEvent.SessionID == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v-%d", changeEvent.SessionID["id"], changeEvent.Transaction)
+}
+
+// 添加一条事件，txnKey为原始事件的事务标识，changeEvent为nil表示事件被跳过，只记录位置
+// 不属于当前事务的事件会先提交当前事务组，被跳过的事务事件不会拆分所在事务
+// 返回错误表示程序结束，分发已停止
+func (tg *transactionGroup) add(txnKey string, changeEvent *models.ChangeEvent, lastEventId []byte) error {
+	if txnKey == "" || txnKey != tg.txnKey {
+		if err := tg.flush(); err != nil {
+			return err
+		}
+	}
+	if changeEvent != nil {
+		tg.events = append(tg.events, changeEvent)
+	}
+	if len(lastEventId) > 0 {
+		tg.lastEventId = lastEventId
+	}
+	tg.txnKey = txnKey
+	// 不在事务中的事件直接提交
+	if txnKey == "" {
+		return tg.flush()
+	}
+	return nil
+}
+
+// 提交当前事件组，处理完成后推进结束位置
+func (tg *transactionGroup) flush() (err error) {
+	if len(tg.events) > 0 || len(tg.lastEventId) > 0 {
+		_, err = tg.dispatcher.dispatch(tg.checkpointKey, tg.events, tg.lastEventId)
+	}
+	tg.txnKey = ""
+	tg.events = nil
+	tg.lastEventId = nil
+	return err
+}